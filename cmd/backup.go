@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/miladrahimi/shadowsocks/internal/config"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"github.com/miladrahimi/shadowsocks/pkg/utils"
+	"github.com/spf13/cobra"
+	"time"
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup [file]",
+	Short: "Back up the settings, keys, servers, usage, admins, and tokens into a single file.",
+	Long: "Back up the settings, keys, servers, usage, admins, and tokens into a single file " +
+		"(shadowsocks-backup-<time>.json by default), encrypted with the snapshot passphrase or the master key.\n" +
+		"The panel must be stopped; use the GET /v1/backup endpoint to back up a running panel.",
+	Args:          cobra.MaximumNArgs(1),
+	RunE:          backupFunc,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+func backupFunc(_ *cobra.Command, args []string) error {
+	c, err := config.New()
+	if err != nil {
+		return err
+	}
+	d, err := openDatabase(c)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+
+	backup, err := d.Backup()
+	if err != nil {
+		return err
+	}
+	content, err := d.EncodeBackup(backup, c.Snapshot.Passphrase)
+	if err != nil {
+		return err
+	}
+
+	path := database.BackupFileName(time.UnixMilli(backup.CreatedAt))
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if err = utils.AtomicWriteFile(path, content, 0600); err != nil {
+		return err
+	}
+
+	fmt.Println("Backed up into", path)
+	return nil
+}
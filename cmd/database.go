@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/miladrahimi/shadowsocks/internal/config"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+)
+
+// openDatabase opens the database for the commands; it prints the password of the owner account if it is seeded.
+func openDatabase(c *config.Config) (*database.Database, error) {
+	d, err := database.New(c)
+	if err != nil {
+		return nil, err
+	}
+	if password := d.AdminTable.GeneratedPassword(); password != "" {
+		fmt.Printf("Owner account created: %s / %s (change the password after signing in)\n", database.SeedUsername, password)
+	}
+	for _, path := range d.Archived {
+		fmt.Println("Imported JSON table archived (delete it with purge-migrated):", path)
+	}
+	return d, nil
+}
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"github.com/spf13/cobra"
+)
+
+var purgeMigratedCmd = &cobra.Command{
+	Use:   "purge-migrated",
+	Short: "Delete the JSON table files archived after importing them into the bolt database.",
+	Long: "Delete the JSON table files (*.migrated) archived after importing them into the bolt database.\n" +
+		"They are kept for rolling back to the json driver or an older release, and may hold secrets in plaintext.",
+	Args:          cobra.NoArgs,
+	RunE:          purgeMigratedFunc,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+func purgeMigratedFunc(_ *cobra.Command, _ []string) error {
+	paths, err := database.PurgeMigrated(database.Directory)
+	for _, path := range paths {
+		fmt.Println("Deleted", path)
+	}
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		fmt.Println("No archived JSON table files in", database.Directory)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miladrahimi/shadowsocks/internal/config"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"time"
+)
+
+var restoreFlags struct {
+	dryRun     bool
+	snapshot   string
+	passphrase string
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore [file]",
+	Short: "Restore a backup file or snapshot; all the admins are signed out.",
+	Long: "Restore a backup file or snapshot (by its ID, e.g., 20060102-150405, or latest), replacing the settings, " +
+		"keys, servers, usage, admins, and tokens; all the admins are signed out.\n" +
+		"The panel must be stopped; use the POST /v1/backup/restore endpoint to restore into a running panel.",
+	Args:          cobra.MaximumNArgs(1),
+	RunE:          restoreFunc,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+func init() {
+	restoreCmd.Flags().BoolVar(&restoreFlags.dryRun, "dry-run", false, "only validate the backup")
+	restoreCmd.Flags().StringVar(&restoreFlags.snapshot, "snapshot", "", "the ID of the snapshot to restore, or latest")
+	restoreCmd.Flags().StringVar(
+		&restoreFlags.passphrase, "passphrase", "", "the passphrase of the encrypted backup (the snapshot one by default)",
+	)
+}
+
+func restoreFunc(_ *cobra.Command, args []string) error {
+	if (len(args) == 0) == (restoreFlags.snapshot == "") {
+		return errors.New("either a backup file or a snapshot (--snapshot) is required")
+	}
+
+	c, err := config.New()
+	if err != nil {
+		return err
+	}
+	passphrase := restoreFlags.passphrase
+	if passphrase == "" {
+		passphrase = c.Snapshot.Passphrase
+	}
+
+	d, err := openDatabase(c)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+
+	var backup *database.Backup
+	if restoreFlags.snapshot != "" {
+		snapshot, err := database.FindSnapshot(c.Snapshot.Directory, restoreFlags.snapshot)
+		if err != nil {
+			return err
+		}
+		if snapshot == nil {
+			return errors.New(fmt.Sprintf("the snapshot %s is not found", restoreFlags.snapshot))
+		}
+		fmt.Println("Snapshot:", snapshot.Id)
+		if backup, err = d.ReadSnapshot(c.Snapshot.Directory, snapshot.Id, passphrase); err != nil {
+			return err
+		}
+	} else {
+		content, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		if backup, err = d.DecodeBackup(content, passphrase); err != nil {
+			return err
+		}
+	}
+
+	summary, err := d.Restore(backup, restoreFlags.dryRun)
+	if err != nil {
+		return err
+	}
+
+	if summary.DryRun {
+		fmt.Println("The backup is valid (dry run, nothing restored).")
+	} else {
+		fmt.Println("The backup is restored.")
+	}
+	fmt.Println("Created at:", time.UnixMilli(summary.CreatedAt).Format(time.RFC3339), "by", summary.AppVersion)
+
+	tables := make([]string, 0, len(summary.Rows))
+	for table := range summary.Rows {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		fmt.Printf("  %s: %d rows\n", table, summary.Rows[table])
+	}
+	for _, migration := range summary.Migrated {
+		fmt.Println("  migration:", migration)
+	}
+
+	return nil
+}
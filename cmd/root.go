@@ -15,6 +15,10 @@ func init() {
 
 	rootCmd.AddCommand(startCmd)
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(snapshotsCmd)
+	rootCmd.AddCommand(purgeMigratedCmd)
 }
 
 func Execute() error {
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/miladrahimi/shadowsocks/internal/config"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"github.com/spf13/cobra"
+	"time"
+)
+
+var snapshotsCmd = &cobra.Command{
+	Use:           "snapshots",
+	Short:         "List the snapshots (to restore with restore --snapshot), the newest first.",
+	RunE:          snapshotsFunc,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+func snapshotsFunc(_ *cobra.Command, _ []string) error {
+	c, err := config.New()
+	if err != nil {
+		return err
+	}
+	snapshots, err := database.ListSnapshots(c.Snapshot.Directory)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range snapshots {
+		fmt.Printf("%s  %s  %d bytes\n", s.Id, time.UnixMilli(s.CreatedAt).Format(time.RFC3339), s.Size)
+	}
+	if len(snapshots) == 0 {
+		fmt.Println("No snapshots in", c.Snapshot.Directory)
+	}
+	return nil
+}
@@ -17,7 +17,7 @@ func startFunc(_ *cobra.Command, _ []string) {
 	}
 	defer a.Shutdown()
 
-	go a.Coordinator.Run()
+	a.Coordinator.Run()
 	go a.HttpServer.Run()
 
 	a.Wait()
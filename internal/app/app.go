@@ -53,10 +53,32 @@ func New() (app *App, err error) {
 	app.HttpClient = client.New(app.Config)
 	app.Logger.Engine.Debug("http client initialized")
 
-	if app.Database, err = database.New(); err != nil {
+	if app.Database, err = database.New(app.Config); err != nil {
 		return app, err
 	}
 	app.Logger.Engine.Debug("database initialized and loaded")
+	for _, table := range app.Database.Recovered {
+		app.Logger.Engine.Warn("corrupted table restored from its last good generation", zap.String("table", table))
+	}
+	for _, migration := range app.Database.Migrated {
+		app.Logger.Engine.Info("database migration applied", zap.String("migration", migration))
+	}
+	if password := app.Database.AdminTable.GeneratedPassword(); password != "" {
+		app.Logger.Engine.Warn(
+			"owner account created with a random password; change it after signing in",
+			zap.String("username", database.SeedUsername), zap.String("password", password),
+		)
+	}
+	for _, table := range app.Database.Sealed {
+		app.Logger.Engine.Info("table secrets encrypted with the master key", zap.String("table", table))
+	}
+	for _, path := range app.Database.Archived {
+		app.Logger.Engine.Warn(
+			"json table file imported into the bolt database and archived; it may hold secrets in plaintext, "+
+				"so delete it with the purge-migrated command once it is no longer needed for a rollback",
+			zap.String("path", path),
+		)
+	}
 
 	app.Shadowsocks = shadowsocks.New(app.Logger.Engine, shadowsocksKeysPath, shadowsocksBinaryPaths)
 	app.Logger.Engine.Debug("shadowsocks initialized")
@@ -122,6 +144,11 @@ func (a *App) Shutdown() {
 	if a.HttpServer != nil {
 		a.HttpServer.Shutdown()
 	}
+	if a.Database != nil {
+		if err := a.Database.Close(); err != nil {
+			a.Logger.Engine.Error("cannot close the database", zap.Error(err))
+		}
+	}
 	if a.Logger != nil {
 		a.Logger.Shutdown()
 	}
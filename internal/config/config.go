@@ -15,6 +15,9 @@ type Config struct {
 	HttpServer struct {
 		Host string `json:"host"`
 		Port int    `json:"port"`
+		// TrustedProxies are the IP ranges (CIDRs) of the reverse proxies whose X-Forwarded-For headers are trusted;
+		// without them, the client IP is the address of the connection and the headers are ignored.
+		TrustedProxies []string `json:"trusted_proxies"`
 	} `json:"http_server"`
 
 	HttpClient struct {
@@ -34,6 +37,59 @@ type Config struct {
 	Worker struct {
 		Interval int `json:"interval"`
 	} `json:"worker"`
+
+	Database struct {
+		Driver string `json:"driver"`
+		// MasterKeyFile holds the master key that encrypts the secrets at rest (unless it is in the environment);
+		// empty with no key in the environment leaves them unencrypted.
+		MasterKeyFile string `json:"master_key_file"`
+	} `json:"database"`
+
+	// RateLimit protects the public and authentication endpoints against brute force, per client IP.
+	RateLimit struct {
+		// Rate is the number of the allowed requests per second; zero disables the rate limiter.
+		Rate float64 `json:"rate"`
+		// Burst is the number of the requests allowed at once above the rate.
+		Burst int `json:"burst"`
+		// SignInFailures is the number of the failed sign-ins before the lockout; zero disables the lockout.
+		SignInFailures int `json:"sign_in_failures"`
+		// SignInLockout is the first lockout (in seconds); it doubles with each failed sign-in after it.
+		SignInLockout int `json:"sign_in_lockout"`
+		// SignInMaxLockout is the longest lockout (in seconds).
+		SignInMaxLockout int `json:"sign_in_max_lockout"`
+	} `json:"rate_limit"`
+
+	Audit struct {
+		// Retention is the number of the days the audit entries are kept; zero keeps them forever.
+		Retention int `json:"retention"`
+	} `json:"audit"`
+
+	Usage struct {
+		// Retention is the number of the days the daily usage rollups are kept before they are compacted
+		// into monthly ones (at least two months); zero keeps them forever.
+		Retention int `json:"retention"`
+	} `json:"usage"`
+
+	Trash struct {
+		// Retention is the number of the days the deleted keys and servers can be restored before they are purged;
+		// zero keeps them until they are purged by hand.
+		Retention int `json:"retention"`
+	} `json:"trash"`
+
+	// Snapshot makes the coordinator back up the database into the directory periodically.
+	Snapshot struct {
+		// Directory is where the snapshots are written.
+		Directory string `json:"directory"`
+		// Interval is the number of the hours between the snapshots; zero disables them.
+		Interval int `json:"interval"`
+		// Passphrase encrypts the snapshots and backups (and decrypts them to restore);
+		// without it, they are encrypted with the master key, if there is one.
+		Passphrase string `json:"passphrase"`
+		// Daily is the number of the last days that their newest snapshots are kept.
+		Daily int `json:"daily"`
+		// Weekly is the number of the last weeks that their newest snapshots are kept.
+		Weekly int `json:"weekly"`
+	} `json:"snapshot"`
 }
 
 // New creates an instance of the Config.
@@ -47,6 +103,19 @@ func New() (*Config, error) {
 	}
 
 	var c Config
+	c.RateLimit.Rate = 5
+	c.RateLimit.Burst = 20
+	c.RateLimit.SignInFailures = 5
+	c.RateLimit.SignInLockout = 60
+	c.RateLimit.SignInMaxLockout = 3600
+	c.Audit.Retention = 365
+	c.Usage.Retention = 400
+	c.Trash.Retention = 30
+	c.Snapshot.Directory = "storage/snapshots"
+	c.Snapshot.Interval = 24
+	c.Snapshot.Daily = 7
+	c.Snapshot.Weekly = 4
+
 	err = json.Unmarshal(content, &c)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("cannot validate config file, err: %v", err))
@@ -0,0 +1,32 @@
+package coordinator
+
+import (
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"go.uber.org/zap"
+)
+
+// Audit records the change of the target in the audit log; before and after are the target
+// before and after the change (nil for creations and deletions).
+// Updates that changed nothing are not recorded. Failures are logged, as the change has already been made.
+func (c *Coordinator) Audit(actor, remoteIp, action, target string, before, after interface{}) {
+	changes := database.Diff(before, after)
+	if before != nil && after != nil && len(changes) == 0 {
+		return
+	}
+
+	_, err := c.Database.AuditTable.Append(database.AuditEntry{
+		Actor:    actor,
+		RemoteIp: remoteIp,
+		Action:   action,
+		Target:   target,
+		Changes:  changes,
+	})
+	if err != nil {
+		c.Logger.Error("cannot record the audit entry", zap.String("action", action), zap.Error(err))
+	}
+}
+
+// auditSystem records a change that the coordinator has made on its own.
+func (c *Coordinator) auditSystem(action, target string, before, after interface{}) {
+	c.Audit(database.AuditActorSystem, "", action, target, before, after)
+}
@@ -0,0 +1,61 @@
+package coordinator
+
+import (
+	"fmt"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"github.com/miladrahimi/shadowsocks/pkg/utils"
+	"time"
+)
+
+// FindCapMetric returns a copy of the usage of the given key in its current cap window or nil if there is no metric.
+// The usage is zero if the window has rolled over since the last metrics sync.
+func (c *Coordinator) FindCapMetric(k database.Key) *KeyMetric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.metricsSyncedAt < k.CapUsageStart(time.Now()).Unix() {
+		return &KeyMetric{Id: k.Id}
+	}
+	if m, found := c.capMetrics[k.Id]; found {
+		metric := *m
+		return &metric
+	}
+	return nil
+}
+
+// checkCaps moves the active keys that exceeded their traffic caps in their current cap windows
+// to the cap_exceeded status, and re-activates them once their windows roll over (or their caps are raised).
+// It returns true if any key changed.
+// Nodes never change the statuses pushed by the master, since their windows cover only their own traffic.
+func (c *Coordinator) checkCaps() (dirty bool) {
+	if c.IsNode() {
+		return false
+	}
+	now := time.Now()
+	for _, k := range c.Database.KeyTable.All() {
+		if k.Status != database.KeyStatusActive && k.Status != database.KeyStatusCapExceeded {
+			continue
+		}
+
+		var used int64
+		if m := c.FindCapMetric(k); m != nil {
+			used = m.Total
+		}
+		exceeded := k.Cap != 0 && used > int64(k.Cap)
+
+		if exceeded && k.Status == database.KeyStatusActive {
+			window := k.CapWindow
+			if window == "" {
+				window = database.CapWindowDaily
+			}
+			reason := fmt.Sprintf(
+				"Used %s of the %s %s cap; re-enables at %s.",
+				utils.Bytes(used), k.Cap, window, k.CapWindowEnd(now).UTC().Format(time.RFC3339),
+			)
+			dirty = c.updateKeyStatus(k.Id, k.Status, database.KeyStatusCapExceeded, reason) || dirty
+		} else if !exceeded && k.Status == database.KeyStatusCapExceeded {
+			dirty = c.updateKeyStatus(k.Id, k.Status, database.KeyStatusActive, "The usage is within the cap again.") || dirty
+		}
+	}
+	return dirty
+}
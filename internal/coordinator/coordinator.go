@@ -10,21 +10,30 @@ import (
 	"github.com/miladrahimi/shadowsocks/pkg/utils"
 	"go.uber.org/zap"
 	"net/http"
+	"sync"
 )
 
 type Coordinator struct {
-	Http          *http.Client
-	Logger        *zap.Logger
-	Config        *config.Config
-	Prometheus    *prometheus.Prometheus
-	Shadowsocks   *shadowsocks.Shadowsocks
-	Database      *database.Database
-	MetricsPort   int
-	ServerMetrics map[string]*ServerMetric
-	KeyMetrics    map[string]*KeyMetric
-	SyncedAt      int64
+	Http            *http.Client
+	Logger          *zap.Logger
+	Config          *config.Config
+	Prometheus      *prometheus.Prometheus
+	Shadowsocks     *shadowsocks.Shadowsocks
+	Database        *database.Database
+	MetricsPort     int
+	serverMetrics   map[string]*ServerMetric
+	keyMetrics      map[string]*KeyMetric
+	capMetrics      map[string]*KeyMetric
+	metricsSyncedAt int64
+	syncedAt        int64
+	mutex           sync.RWMutex
+	syncMutex       sync.Mutex
+	placementMutex  sync.Mutex
+	placed          placementInput
 }
 
+// Run initializes the coordinator state and starts the background services and workers.
+// It returns once the state is ready, so it must be called before serving HTTP requests.
 func (c *Coordinator) Run() {
 	c.initSettings()
 	c.initMetricsPort()
@@ -35,30 +44,51 @@ func (c *Coordinator) Run() {
 	go c.startWorkers()
 }
 
+// KeyServers returns the active servers (including the current one) that serve the given key.
+func (c *Coordinator) KeyServers(key *database.Key) []database.Server {
+	var servers []database.Server
+	for _, s := range append([]database.Server{*c.CurrentServer()}, c.Database.ServerTable.All()...) {
+		if s.ShadowsocksEnabled && s.Status == database.ServerStatusActive && key.AllowsServer(&s) {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// IsNode checks if this server is a node of a master, which fills its keys.
+// A node has only its own traffic, so the statuses of its keys pushed by the master are authoritative.
+func (c *Coordinator) IsNode() bool {
+	return c.Database.KeyTable.FilledAt() != 0
+}
+
 func (c *Coordinator) Sync() {
+	c.placeKeys()
 	c.syncShadowsocks(true)
 	c.syncServers(true)
 }
 
 func (c *Coordinator) initSettings() {
-	if c.Database.SettingTable.ApiToken == "api-token-secret" {
-		c.Database.SettingTable.ApiToken = random.String(32)
-	}
-
-	if c.Database.SettingTable.ShadowsocksPort == 1 {
-		var err error
-		if c.Database.SettingTable.ShadowsocksPort, err = utils.FreePort(); err != nil {
-			c.Logger.Fatal("cannot find a free port for the shadowsocks server", zap.Error(err))
+	before := c.Database.SettingTable.Get()
+	settings, err := c.Database.SettingTable.Modify(func(s *database.Settings) {
+		if s.ApiToken == "api-token-secret" {
+			s.ApiToken = random.String(32)
 		}
-	}
 
-	if c.Database.SettingTable.ExternalHttp == "http://empty" {
-		c.Database.SettingTable.ExternalHttp = fmt.Sprintf("http://127.0.0.1:%d", c.Config.HttpServer.Port)
-	}
+		if s.ShadowsocksPort == 1 {
+			var err error
+			if s.ShadowsocksPort, err = utils.FreePort(); err != nil {
+				c.Logger.Fatal("cannot find a free port for the shadowsocks server", zap.Error(err))
+			}
+		}
 
-	if err := c.Database.SettingTable.Save(); err != nil {
+		if s.ExternalHttp == "http://empty" {
+			s.ExternalHttp = fmt.Sprintf("http://127.0.0.1:%d", c.Config.HttpServer.Port)
+		}
+	})
+	if err != nil {
 		c.Logger.Fatal("cannot save settings", zap.Error(err))
 	}
+	c.auditSystem("settings.init", "settings", before, settings)
 }
 
 func (c *Coordinator) initMetricsPort() {
@@ -69,16 +99,22 @@ func (c *Coordinator) initMetricsPort() {
 }
 
 func (c *Coordinator) CurrentServer() *database.Server {
+	settings := c.Database.SettingTable.Get()
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
 	return &database.Server{
 		Id:                 "s-0",
 		Status:             database.ServerStatusActive,
 		HttpHost:           "127.0.0.1",
 		HttpPort:           c.Config.HttpServer.Port,
-		ShadowsocksEnabled: c.Database.SettingTable.ShadowsocksEnabled,
-		ShadowsocksHost:    c.Database.SettingTable.ShadowsocksHost,
-		ShadowsocksPort:    c.Database.SettingTable.ShadowsocksPort,
-		ApiToken:           c.Database.SettingTable.ApiToken,
-		SyncedAt:           c.SyncedAt,
+		ShadowsocksEnabled: settings.ShadowsocksEnabled,
+		ShadowsocksHost:    settings.ShadowsocksHost,
+		ShadowsocksPort:    settings.ShadowsocksPort,
+		Region:             settings.Region,
+		ApiToken:           settings.ApiToken,
+		SyncedAt:           c.syncedAt,
 	}
 }
 
@@ -97,7 +133,8 @@ func New(
 		Database:      db,
 		Prometheus:    p,
 		Shadowsocks:   ss,
-		ServerMetrics: map[string]*ServerMetric{},
-		KeyMetrics:    map[string]*KeyMetric{},
+		serverMetrics: map[string]*ServerMetric{},
+		keyMetrics:    map[string]*KeyMetric{},
+		capMetrics:    map[string]*KeyMetric{},
 	}
 }
@@ -0,0 +1,202 @@
+package coordinator
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/miladrahimi/shadowsocks/internal/config"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"github.com/miladrahimi/shadowsocks/pkg/prometheus"
+	"github.com/miladrahimi/shadowsocks/pkg/shadowsocks"
+	"go.uber.org/zap"
+)
+
+// prometheusResult is the answer of the fake Prometheus to every query; 2 MB of traffic for the first key.
+const prometheusResult = `{"status": "success", "data": {"resultType": "vector", "result": [
+	{"metric": {"access_key": "k-1", "dir": "c<p", "proto": "tcp", "service": "s-0"}, "value": [0, "2000000"]}
+]}}`
+
+// newTestCoordinator creates a coordinator with a database in a temporary directory and a fake Prometheus.
+func newTestCoordinator(t *testing.T) *Coordinator {
+	t.Helper()
+	t.Setenv(database.MasterKeyEnv, "")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(wd)
+	})
+	if err = os.MkdirAll(database.Directory, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Database.Driver = database.DriverJson
+	db, err := database.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(prometheusResult))
+	}))
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := zap.NewNop()
+	p := prometheus.New(l, server.Client(), "prometheus.yml", u.Hostname(), port)
+	ss := shadowsocks.New(l, "shadowsocks.yml", nil)
+	return New(cfg, l, server.Client(), p, db, ss)
+}
+
+func TestCoordinatorConcurrency(t *testing.T) {
+	c := newTestCoordinator(t)
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		k, err := c.Database.KeyTable.Store(database.Key{
+			Cipher:  "chacha20-ietf-poly1305",
+			Secret:  fmt.Sprintf("secret-%d", i),
+			Name:    fmt.Sprintf("key %d", i),
+			Enabled: true,
+			Tags:    []string{"a"},
+			Regions: []string{"eu"},
+			Quotas:  database.Quotas{Total: 1000000},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, k.Id)
+	}
+
+	var wg sync.WaitGroup
+	run := func(n int, fn func(i int)) {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				fn(i)
+			}(i)
+		}
+	}
+
+	run(4, func(int) {
+		c.syncMetrics()
+	})
+	run(8, func(i int) {
+		if _, err := c.ResetKeyUsage(ids[i%len(ids)]); err != nil {
+			t.Error(err)
+		}
+	})
+	run(8, func(i int) {
+		_, err := c.Database.KeyTable.Modify(ids[i%len(ids)], func(k *database.Key) {
+			k.Tags = append(k.Tags, fmt.Sprintf("t%d", i))
+			k.Placement = database.KeyPlacementAuto
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	run(4, func(int) {
+		c.Sync()
+	})
+	run(8, func(i int) {
+		for _, k := range c.Database.KeyTable.All() {
+			c.KeyServers(&k)
+			c.FindKeyMetric(k.Id)
+			c.FindCapMetric(k)
+			k.Tags = append(k.Tags[:0], "changed")
+		}
+	})
+	wg.Wait()
+
+	for _, k := range c.Database.KeyTable.All() {
+		if k.Tags[0] != "a" {
+			t.Errorf("the stored key %s changed through a copy: %v", k.Id, k.Tags)
+		}
+	}
+
+	// The first key used 2 MB of its 1 MB quota since its last reset.
+	c.syncMetrics()
+	if k := c.Database.KeyTable.Find(ids[0]); k.Status != database.KeyStatusQuotaExceeded {
+		t.Errorf("the status of %s is %s, want %s", k.Id, k.Status, database.KeyStatusQuotaExceeded)
+	}
+}
+
+// fillTestKey stores a key and fills the keys with it in the given status, as a master pushes it to a node.
+func fillTestKey(t *testing.T, c *Coordinator, status string, fn func(k *database.Key)) database.Key {
+	t.Helper()
+	k, err := c.Database.KeyTable.Store(database.Key{
+		Cipher:  "chacha20-ietf-poly1305",
+		Secret:  "secret-1",
+		Name:    "key 1",
+		Enabled: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.SetStatus(status, "Pushed by the master.")
+	fn(k)
+	if err = c.Database.KeyTable.Fill([]database.Key{*k}); err != nil {
+		t.Fatal(err)
+	}
+	return *k
+}
+
+func TestNodeKeepsQuotaStatuses(t *testing.T) {
+	c := newTestCoordinator(t)
+	if c.IsNode() {
+		t.Fatal("a coordinator without filled keys is a node")
+	}
+
+	// The node has used only 2 MB of the 1 GB quota, but the master knows the traffic of all the nodes.
+	k := fillTestKey(t, c, database.KeyStatusQuotaExceeded, func(k *database.Key) {
+		k.Quotas.Total = 1000000000
+	})
+	if !c.IsNode() {
+		t.Fatal("a coordinator with filled keys is not a node")
+	}
+
+	c.syncMetrics()
+	c.CheckStatuses()
+	if got := c.Database.KeyTable.Find(k.Id); got.Status != database.KeyStatusQuotaExceeded {
+		t.Errorf("the node changed the pushed status to %s", got.Status)
+	}
+}
+
+func TestNodeKeepsCapStatuses(t *testing.T) {
+	c := newTestCoordinator(t)
+
+	// The node has used only 2 MB of the 1 GB cap, but the master knows the traffic of all the nodes.
+	k := fillTestKey(t, c, database.KeyStatusCapExceeded, func(k *database.Key) {
+		k.Cap = 1000000000
+		k.CapWindow = database.CapWindowHourly
+	})
+
+	c.syncMetrics()
+	c.CheckStatuses()
+	if got := c.Database.KeyTable.Find(k.Id); got.Status != database.KeyStatusCapExceeded {
+		t.Errorf("the node changed the pushed status to %s", got.Status)
+	}
+}
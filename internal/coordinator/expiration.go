@@ -0,0 +1,53 @@
+package coordinator
+
+import (
+	"fmt"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"go.uber.org/zap"
+	"time"
+)
+
+// checkFirstUses records the first use of the keys that have traffic for the first time.
+// The expiration countdown of the keys with ExpiresAfter starts with the first use.
+func (c *Coordinator) checkFirstUses() {
+	for _, k := range c.Database.KeyTable.All() {
+		if k.FirstUsedAt != 0 {
+			continue
+		}
+
+		if m := c.FindKeyMetric(k.Id); m != nil && m.Total > 0 {
+			updated, err := c.Database.KeyTable.Modify(k.Id, func(k *database.Key) {
+				k.FirstUsedAt = time.Now().UnixMilli()
+			})
+			if err != nil {
+				c.Logger.Error("cannot update the key", zap.Error(err))
+			} else if updated != nil {
+				c.auditSystem("keys.first_use", k.Id, k, updated)
+			}
+		}
+	}
+}
+
+// checkExpirations moves the expired keys to the expired status,
+// and re-activates the ones that are no longer expired (e.g., the expiration time extended).
+// It returns true if any key changed. Nodes never change the statuses pushed by the master.
+func (c *Coordinator) checkExpirations() (dirty bool) {
+	if c.IsNode() {
+		return false
+	}
+	now := time.Now().UnixMilli()
+	for _, k := range c.Database.KeyTable.All() {
+		if k.Status == database.KeyStatusSuspended {
+			continue
+		}
+
+		expired := k.IsExpired(now)
+		if expired && k.Status != database.KeyStatusExpired {
+			reason := fmt.Sprintf("Expired at %s.", time.UnixMilli(k.ExpirationTime()).UTC().Format(time.RFC3339))
+			dirty = c.updateKeyStatus(k.Id, k.Status, database.KeyStatusExpired, reason) || dirty
+		} else if !expired && k.Status == database.KeyStatusExpired {
+			dirty = c.updateKeyStatus(k.Id, k.Status, database.KeyStatusActive, "The expiration time extended.") || dirty
+		}
+	}
+	return dirty
+}
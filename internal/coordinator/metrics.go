@@ -1,8 +1,13 @@
 package coordinator
 
 import (
+	"fmt"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"github.com/miladrahimi/shadowsocks/pkg/prometheus"
+	"github.com/miladrahimi/shadowsocks/pkg/utils"
 	"go.uber.org/zap"
 	"strconv"
+	"time"
 )
 
 type ServerMetric struct {
@@ -23,18 +28,197 @@ type KeyMetric struct {
 	Total   int64  `json:"total"`
 }
 
+// metricsDays is the number of the days (including today) that the usage of the servers is calculated over.
+const metricsDays = 30
+
+// syncMetrics calculates the usage of the servers in the last metrics days,
+// the usage of the keys in their current billing cycles (or since their last usage resets),
+// and the usage of the capped keys in their current cap windows.
+// The complete past days come from the usage rollups, so only today is fetched from Prometheus
+// (with the partial days that the usage of some keys starts in).
 func (c *Coordinator) syncMetrics() {
 	c.Logger.Debug("syncing metrics...")
 
-	metrics, err := c.Prometheus.Metrics()
+	now := time.Now()
+	today := startOfDay(now)
+
+	sms := map[string]*ServerMetric{}
+	tms := map[string]*KeyMetric{}
+	if now.Sub(today) >= time.Minute {
+		metrics, err := c.Prometheus.MetricsBetween(today, now)
+		if err != nil {
+			c.Logger.Error("prometheus query failed", zap.Error(err))
+			return
+		}
+		c.collectMetrics(metrics, sms, tms)
+	}
+
+	from := today.AddDate(0, 0, 1-metricsDays).Format(database.UsageDateLayout)
+	yesterday := today.AddDate(0, 0, -1).Format(database.UsageDateLayout)
+	for _, s := range append([]database.Server{*c.CurrentServer()}, c.Database.ServerTable.All()...) {
+		for _, u := range c.Database.UsageTable.Between(s.Id, from, yesterday) {
+			if _, found := sms[s.Id]; !found {
+				sms[s.Id] = &ServerMetric{Id: s.Id}
+			}
+			sms[s.Id].add(u)
+		}
+	}
+
+	keys := c.Database.KeyTable.All()
+
+	kms, err := c.keyMetricsSince(keys, now, tms, func(k database.Key) time.Time {
+		return k.UsageStart(now)
+	})
 	if err != nil {
 		c.Logger.Error("prometheus query failed", zap.Error(err))
 		return
 	}
 
-	sms := map[string]*ServerMetric{}
+	var capped []database.Key
+	for _, k := range keys {
+		if k.Cap != 0 {
+			capped = append(capped, k)
+		}
+	}
+	cms, err := c.keyMetricsSince(capped, now, tms, func(k database.Key) time.Time {
+		return k.CapUsageStart(now)
+	})
+	if err != nil {
+		c.Logger.Error("prometheus query failed", zap.Error(err))
+		return
+	}
+
+	c.mutex.Lock()
+	c.serverMetrics = sms
+	c.keyMetrics = kms
+	c.capMetrics = cms
+	c.metricsSyncedAt = now.Unix()
+	c.mutex.Unlock()
+
+	c.checkFirstUses()
+	c.CheckStatuses()
+}
+
+// keyMetricsSince calculates the usage of the given keys since the times returned by start,
+// from the usage rollups of the complete past days and the given traffic of the keys in today (tms).
+// The partial days (the first day of the usage, or today if the usage starts after midnight)
+// are fetched from Prometheus, in one query for the first days and one for today.
+// The usage in the months compacted into monthly rollups is counted for the whole months.
+func (c *Coordinator) keyMetricsSince(
+	keys []database.Key, now time.Time, tms map[string]*KeyMetric, start func(k database.Key) time.Time,
+) (map[string]*KeyMetric, error) {
+	today := startOfDay(now)
+	yesterday := today.AddDate(0, 0, -1).Format(database.UsageDateLayout)
+
 	kms := map[string]*KeyMetric{}
+	metric := func(id string) *KeyMetric {
+		if _, found := kms[id]; !found {
+			kms[id] = &KeyMetric{Id: id}
+		}
+		return kms[id]
+	}
 
+	firstDays, todays := keyWindows{}, keyWindows{}
+	for _, k := range keys {
+		from := start(k).In(now.Location())
+		if from.After(today) {
+			todays.add(k.Id, from, now)
+			continue
+		}
+
+		if tm, found := tms[k.Id]; found {
+			metric(k.Id).merge(*tm)
+		}
+		if from.Equal(today) {
+			continue
+		}
+
+		day := startOfDay(from)
+		if from.After(day) {
+			day = day.AddDate(0, 0, 1)
+			firstDays.add(k.Id, from, day)
+		}
+		for _, u := range c.Database.UsageTable.Between(k.Id, day.Format(database.UsageDateLayout), yesterday) {
+			metric(k.Id).add(u)
+		}
+	}
+
+	for _, windows := range []keyWindows{firstDays, todays} {
+		if len(windows) == 0 {
+			continue
+		}
+		metrics, err := c.Prometheus.MetricsIn(windows.list())
+		if err != nil {
+			return nil, err
+		}
+		c.collectMetrics(metrics, nil, kms)
+	}
+	return kms, nil
+}
+
+// keyWindows groups the keys into the Prometheus windows by the minutes that their usage starts in.
+type keyWindows map[int64]*prometheus.Window
+
+// add adds the key to the window from the given time to the end.
+// The start is rounded up to the minute, so the usage before it is never counted.
+func (kw keyWindows) add(id string, from, end time.Time) {
+	if t := from.Truncate(time.Minute); t.Before(from) {
+		from = t.Add(time.Minute)
+	}
+	if end.Sub(from) < time.Minute {
+		from = end.Add(-time.Minute)
+	}
+	if _, found := kw[from.Unix()]; !found {
+		kw[from.Unix()] = &prometheus.Window{Start: from, End: end}
+	}
+	kw[from.Unix()].Keys = append(kw[from.Unix()].Keys, id)
+}
+
+// list returns the windows.
+func (kw keyWindows) list() []prometheus.Window {
+	windows := make([]prometheus.Window, 0, len(kw))
+	for _, w := range kw {
+		windows = append(windows, *w)
+	}
+	return windows
+}
+
+// startOfDay returns the midnight that starts the day of the given time (in its time zone).
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// add adds the traffic of the daily rollup to the metric.
+func (m *ServerMetric) add(u database.Usage) {
+	m.DownTcp += u.DownTcp
+	m.UpTcp += u.UpTcp
+	m.DownUdp += u.DownUdp
+	m.UpUdp += u.UpUdp
+	m.Total += u.Total
+}
+
+// add adds the traffic of the daily rollup to the metric.
+func (m *KeyMetric) add(u database.Usage) {
+	m.DownTcp += u.DownTcp
+	m.UpTcp += u.UpTcp
+	m.DownUdp += u.DownUdp
+	m.UpUdp += u.UpUdp
+	m.Total += u.Total
+}
+
+// merge adds the traffic of the other metric to the metric.
+func (m *KeyMetric) merge(o KeyMetric) {
+	m.DownTcp += o.DownTcp
+	m.UpTcp += o.UpTcp
+	m.DownUdp += o.DownUdp
+	m.UpUdp += o.UpUdp
+	m.Total += o.Total
+}
+
+// collectMetrics adds the values of the Prometheus query result to the server and key metrics.
+// The server metrics are skipped if sms is nil.
+func (c *Coordinator) collectMetrics(metrics *prometheus.Stats, sms map[string]*ServerMetric, kms map[string]*KeyMetric) {
 	for _, r := range metrics.Data.Result {
 		f, err := strconv.ParseFloat(r.Value[1].(string), 64)
 		if err != nil {
@@ -43,58 +227,138 @@ func (c *Coordinator) syncMetrics() {
 		}
 		v := int64(f)
 
-		if _, found := sms[r.Metric.Service]; !found {
-			sms[r.Metric.Service] = &ServerMetric{Id: r.Metric.Service}
+		sm := &ServerMetric{}
+		if sms != nil {
+			if _, found := sms[r.Metric.Service]; !found {
+				sms[r.Metric.Service] = &ServerMetric{Id: r.Metric.Service}
+			}
+			sm = sms[r.Metric.Service]
 		}
 
 		if _, found := kms[r.Metric.AccessKey]; !found {
 			kms[r.Metric.AccessKey] = &KeyMetric{Id: r.Metric.AccessKey}
 		}
+		km := kms[r.Metric.AccessKey]
 
 		if r.Metric.Dir == "c<p" && r.Metric.Proto == "tcp" {
-			sms[r.Metric.Service].DownTcp += v
-			kms[r.Metric.AccessKey].DownTcp += v
+			sm.DownTcp += v
+			km.DownTcp += v
 		} else if r.Metric.Dir == "c<p" && r.Metric.Proto == "udp" {
-			sms[r.Metric.Service].DownUdp += v
-			kms[r.Metric.AccessKey].DownUdp += v
+			sm.DownUdp += v
+			km.DownUdp += v
 		} else if r.Metric.Dir == "c>p" && r.Metric.Proto == "tcp" {
-			sms[r.Metric.Service].UpTcp += v
-			kms[r.Metric.AccessKey].UpTcp += v
+			sm.UpTcp += v
+			km.UpTcp += v
 		} else if r.Metric.Dir == "c>p" && r.Metric.Proto == "udp" {
-			sms[r.Metric.Service].UpUdp += v
-			kms[r.Metric.AccessKey].UpUdp += v
+			sm.UpUdp += v
+			km.UpUdp += v
 		}
 
-		sms[r.Metric.Service].Total += v
-		kms[r.Metric.AccessKey].Total += v
+		sm.Total += v
+		km.Total += v
 	}
+}
 
-	c.ServerMetrics = sms
-	c.KeyMetrics = kms
+// ResetKeyUsage resets the usage of the given key while keeping its ID, and records the reset in its history.
+// It returns nil if the key does not exist.
+// The statuses are not checked, so the callers can reset many keys and call CheckStatuses (and sync) once.
+func (c *Coordinator) ResetKeyUsage(id string) (*database.Key, error) {
+	var used int64
+	if m := c.FindKeyMetric(id); m != nil {
+		used = m.Total
+	}
+
+	key, err := c.Database.KeyTable.Modify(id, func(k *database.Key) {
+		k.ResetUsage(used)
+	})
+	if err != nil || key == nil {
+		return key, err
+	}
+
+	// Until the next metrics sync, the key is considered unused since the reset.
+	c.mutex.Lock()
+	c.keyMetrics[id] = &KeyMetric{Id: id}
+	c.capMetrics[id] = &KeyMetric{Id: id}
+	c.mutex.Unlock()
+
+	c.Logger.Info("key usage reset", zap.String("id", id), zap.Int64("used", used))
+
+	return key, nil
+}
+
+// FindServerMetric returns a copy of the metric of the given server or nil if there is no metric.
+func (c *Coordinator) FindServerMetric(id string) *ServerMetric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if m, found := c.serverMetrics[id]; found {
+		metric := *m
+		return &metric
+	}
+	return nil
+}
+
+// FindKeyMetric returns a copy of the metric of the given key or nil if there is no metric.
+func (c *Coordinator) FindKeyMetric(id string) *KeyMetric {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 
-	c.checkQuotas()
+	if m, found := c.keyMetrics[id]; found {
+		metric := *m
+		return &metric
+	}
+	return nil
 }
 
-func (c *Coordinator) checkQuotas() {
-	dirty := false
-	for _, k := range c.Database.KeyTable.Keys {
-		if !k.Enabled {
+// checkQuotas moves the active keys that exceeded any of their quotas in their current billing cycles
+// to the quota_exceeded status, and re-activates the ones that no longer exceed their quotas
+// (e.g., the quota raised, the usage reset, or a new cycle started).
+// It returns true if any key changed.
+// Nodes never change the statuses pushed by the master, since they have only their own traffic.
+func (c *Coordinator) checkQuotas() (dirty bool) {
+	if c.IsNode() {
+		return false
+	}
+	for _, k := range c.Database.KeyTable.All() {
+		if k.Status != database.KeyStatusActive && k.Status != database.KeyStatusQuotaExceeded {
 			continue
 		}
 
-		if m, found := c.KeyMetrics[k.Id]; found {
-			if k.Quota != 0 && m.Total/1000000 > k.Quota {
-				k.Enabled = false
-				if _, err := c.Database.KeyTable.Update(*k); err != nil {
-					c.Logger.Error("cannot update the key", zap.Error(err))
-				} else {
-					dirty = true
-				}
-			}
+		m := KeyMetric{Id: k.Id}
+		if km := c.FindKeyMetric(k.Id); km != nil {
+			m = *km
+		}
+		exceeded := exceededQuota(k, m)
+
+		if exceeded != "" && k.Status == database.KeyStatusActive {
+			dirty = c.updateKeyStatus(k.Id, k.Status, database.KeyStatusQuotaExceeded, exceeded) || dirty
+		} else if exceeded == "" && k.Status == database.KeyStatusQuotaExceeded {
+			dirty = c.updateKeyStatus(k.Id, k.Status, database.KeyStatusActive, "The usage is within the quota again.") || dirty
 		}
 	}
+	return dirty
+}
 
-	if dirty {
-		c.Sync()
+// exceededQuota describes the first quota of the key that the given usage exceeds,
+// or returns an empty string if the usage is within all the quotas.
+func exceededQuota(k database.Key, m KeyMetric) string {
+	limits := []struct {
+		name  string
+		quota utils.Bytes
+		used  int64
+	}{
+		{"total", k.Quotas.Total, m.Total},
+		{"download", k.Quotas.Download, m.DownTcp + m.DownUdp},
+		{"upload", k.Quotas.Upload, m.UpTcp + m.UpUdp},
+		{"TCP", k.Quotas.Tcp, m.DownTcp + m.UpTcp},
+		{"UDP", k.Quotas.Udp, m.DownUdp + m.UpUdp},
+	}
+	for _, l := range limits {
+		if l.quota != 0 && l.used > int64(l.quota) {
+			return fmt.Sprintf(
+				"Used %s of the %s %s quota in the %s billing cycle.", utils.Bytes(l.used), l.quota, l.name, k.BillingCycle,
+			)
+		}
 	}
+	return ""
 }
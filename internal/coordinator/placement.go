@@ -0,0 +1,253 @@
+package coordinator
+
+import (
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+	"sort"
+)
+
+// placementServer is a server that keys can be placed onto, with its current load.
+type placementServer struct {
+	server  database.Server
+	keys    int64
+	traffic int64
+}
+
+// placement is the state of a placement run.
+type placement struct {
+	servers []*placementServer
+}
+
+// less checks if the first server is less loaded than the second one.
+// The loads are the key counts; the traffic, which changes all the time, only breaks the ties,
+// so the keys are not moved around as the traffic changes.
+func less(a, b *placementServer) bool {
+	if a.keys != b.keys {
+		return a.keys < b.keys
+	}
+	return a.traffic < b.traffic
+}
+
+// placementInput is the input of a rebalance; the keys are rebalanced only when it changes.
+type placementInput struct {
+	servers  []string
+	keys     []string
+	replicas int
+}
+
+func (i placementInput) equal(o placementInput) bool {
+	return i.replicas == o.replicas && slices.Equal(i.servers, o.servers) && slices.Equal(i.keys, o.keys)
+}
+
+// find returns the placement server with the given ID or nil if it is not eligible.
+func (p *placement) find(id string) *placementServer {
+	for _, s := range p.servers {
+		if s.server.Id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// eligible checks if the key can be placed onto the server (in its regions, if it has any).
+func eligible(k *database.Key, s *placementServer) bool {
+	return len(k.Regions) == 0 || slices.Contains(k.Regions, s.server.Region)
+}
+
+// candidates returns the eligible servers of the key, from the least loaded.
+func (p *placement) candidates(k *database.Key) []*placementServer {
+	var candidates []*placementServer
+	for _, s := range p.servers {
+		if eligible(k, s) {
+			candidates = append(candidates, s)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return less(candidates[i], candidates[j])
+	})
+	return candidates
+}
+
+// assign adds the key to the server, or removes it if count is negative.
+func (p *placement) assign(s *placementServer, count int64) {
+	s.keys += count
+}
+
+// place chooses the servers of the key; it keeps its current eligible servers,
+// fills up the missing replicas with the least loaded servers, and drops the most loaded extra ones.
+func (p *placement) place(k *database.Key, replicas int) []string {
+	candidates := p.candidates(k)
+	if replicas > len(candidates) {
+		replicas = len(candidates)
+	}
+
+	var kept []*placementServer
+	for _, id := range k.Servers {
+		if s := p.find(id); s != nil && slices.Contains(candidates, s) {
+			kept = append(kept, s)
+		}
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		return less(kept[i], kept[j])
+	})
+	if len(kept) > replicas {
+		kept = kept[:replicas]
+	}
+	for _, s := range candidates {
+		if len(kept) >= replicas {
+			break
+		}
+		if !slices.Contains(kept, s) {
+			kept = append(kept, s)
+		}
+	}
+
+	servers := make([]string, 0, len(kept))
+	for _, s := range kept {
+		p.assign(s, 1)
+		servers = append(servers, s.server.Id)
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// rebalance moves keys from the most loaded servers to the least loaded ones (within the regions of the keys),
+// until moving another key would not make the key counts any closer.
+func (p *placement) rebalance(keys []database.Key, assigned map[string][]string) {
+	for moves := 0; moves < len(keys)*len(p.servers); moves++ {
+		sort.SliceStable(p.servers, func(i, j int) bool {
+			return less(p.servers[i], p.servers[j])
+		})
+		least, most := p.servers[0], p.servers[len(p.servers)-1]
+		// A move lowers the gap between the two servers by two keys; it helps only if the gap is over one key.
+		if most.keys-least.keys <= 1 {
+			return
+		}
+
+		moved := false
+		for _, k := range keys {
+			servers := assigned[k.Id]
+			if !slices.Contains(servers, most.server.Id) || slices.Contains(servers, least.server.Id) {
+				continue
+			}
+			if !eligible(&k, least) {
+				continue
+			}
+
+			i := slices.Index(servers, most.server.Id)
+			servers = append(append([]string{}, servers[:i]...), servers[i+1:]...)
+			servers = append(servers, least.server.Id)
+			sort.Strings(servers)
+			assigned[k.Id] = servers
+
+			p.assign(most, -1)
+			p.assign(least, 1)
+			moved = true
+			break
+		}
+		if !moved {
+			return
+		}
+	}
+}
+
+// placeKeys assigns the keys with automatic placement to the configured number of the least loaded servers,
+// based on their key counts (and traffic for the ties), and rebalances them only when the eligible servers,
+// the keys with automatic placement, or the replicas change since the last rebalance.
+// Eligible servers are the active servers with enabled shadowsocks (including the current one).
+// Without configured replicas, the keys with automatic placement are served by all the servers (of their regions).
+// It returns true if any key changed.
+func (c *Coordinator) placeKeys() bool {
+	c.placementMutex.Lock()
+	defer c.placementMutex.Unlock()
+
+	replicas := c.Database.SettingTable.Get().PlacementReplicas
+
+	var keys []database.Key
+	for _, k := range c.Database.KeyTable.All() {
+		if k.Placement == database.KeyPlacementAuto {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return false
+	}
+
+	p := &placement{}
+	for _, s := range append([]database.Server{*c.CurrentServer()}, c.Database.ServerTable.All()...) {
+		if s.ShadowsocksEnabled && s.Status == database.ServerStatusActive {
+			ps := &placementServer{server: s}
+			if m := c.FindServerMetric(s.Id); m != nil {
+				ps.traffic = m.Total
+			}
+			p.servers = append(p.servers, ps)
+		}
+	}
+	// The servers of the keys with manual placement (or with all the servers) count as their load too.
+	for _, k := range c.Database.KeyTable.All() {
+		if k.Placement == database.KeyPlacementAuto {
+			continue
+		}
+		for _, s := range p.servers {
+			if k.AllowsServer(&s.server) {
+				p.assign(s, 1)
+			}
+		}
+	}
+
+	input := placementInput{replicas: replicas}
+	for _, s := range p.servers {
+		input.servers = append(input.servers, s.server.Id)
+	}
+	for _, k := range keys {
+		input.keys = append(input.keys, k.Id)
+	}
+	sort.Strings(input.servers)
+	sort.Strings(input.keys)
+
+	assigned := map[string][]string{}
+	if replicas > 0 && len(p.servers) > 0 {
+		for i := range keys {
+			assigned[keys[i].Id] = p.place(&keys[i], replicas)
+		}
+		if !input.equal(c.placed) {
+			p.rebalance(keys, assigned)
+		}
+	} else {
+		// Without replicas, the keys in regions are placed onto all the eligible servers of their regions.
+		for i := range keys {
+			if len(keys[i].Regions) > 0 {
+				assigned[keys[i].Id] = p.place(&keys[i], len(p.servers))
+			}
+		}
+	}
+
+	c.placed = input
+
+	changed := 0
+	for _, k := range keys {
+		servers := assigned[k.Id]
+		if slices.Equal(servers, k.Servers) {
+			continue
+		}
+		updated, err := c.Database.KeyTable.Modify(k.Id, func(k *database.Key) {
+			if k.Placement == database.KeyPlacementAuto {
+				k.Servers = servers
+			}
+		})
+		if err != nil {
+			c.Logger.Error("cannot place key", zap.String("key", k.Id), zap.Error(err))
+			continue
+		}
+		if updated != nil {
+			c.auditSystem("keys.place", k.Id, k, updated)
+		}
+		changed++
+	}
+
+	if changed > 0 {
+		c.Logger.Info("keys placed", zap.Int("changed", changed), zap.Int("replicas", replicas))
+	}
+	return changed > 0
+}
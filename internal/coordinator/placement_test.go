@@ -0,0 +1,84 @@
+package coordinator
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"golang.org/x/exp/slices"
+)
+
+// newTestPlacement creates a placement run over the servers with the given traffic (by server ID).
+func newTestPlacement(traffic map[string]int64) *placement {
+	p := &placement{}
+	for _, id := range []string{"s-0", "s-1", "s-2"} {
+		region := ""
+		if id == "s-0" {
+			region = "eu"
+		}
+		p.servers = append(p.servers, &placementServer{
+			server:  database.Server{Id: id, Region: region},
+			traffic: traffic[id],
+		})
+	}
+	return p
+}
+
+// placeAll places the keys as a placement run does and returns the servers of the keys.
+func placeAll(p *placement, keys []database.Key, rebalance bool) map[string][]string {
+	assigned := map[string][]string{}
+	for i := range keys {
+		assigned[keys[i].Id] = p.place(&keys[i], 1)
+	}
+	if rebalance {
+		p.rebalance(keys, assigned)
+	}
+	return assigned
+}
+
+func TestPlacementRebalance(t *testing.T) {
+	var keys []database.Key
+	for i := 1; i <= 7; i++ {
+		keys = append(keys, database.Key{Id: fmt.Sprintf("k-%d", i), Servers: []string{"s-0"}})
+	}
+	keys[0].Regions = []string{"eu"}
+
+	p := newTestPlacement(map[string]int64{"s-0": 0, "s-1": 100, "s-2": 1000})
+	assigned := placeAll(p, keys, true)
+
+	counts := map[string]int{}
+	for _, servers := range assigned {
+		if len(servers) != 1 {
+			t.Fatalf("placed onto %v, want a single server", servers)
+		}
+		counts[servers[0]]++
+	}
+	if counts["s-0"] != 3 || counts["s-1"] != 2 || counts["s-2"] != 2 {
+		t.Errorf("key counts = %v, want 3, 2, and 2", counts)
+	}
+	if !slices.Equal(assigned["k-1"], []string{"s-0"}) {
+		t.Errorf("the key in eu moved to %v", assigned["k-1"])
+	}
+
+	// The next runs see other traffic; the balanced keys must stay where they are.
+	for i := range keys {
+		keys[i].Servers = assigned[keys[i].Id]
+	}
+	for _, traffic := range []map[string]int64{
+		{"s-0": 5000, "s-1": 0, "s-2": 10},
+		{"s-0": 0, "s-1": 9000, "s-2": 1},
+	} {
+		next := placeAll(newTestPlacement(traffic), keys, true)
+		for _, k := range keys {
+			if !slices.Equal(next[k.Id], k.Servers) {
+				t.Errorf("traffic %v moved %s from %v to %v", traffic, k.Id, k.Servers, next[k.Id])
+			}
+		}
+	}
+
+	// Traffic only breaks the ties of new keys.
+	p = newTestPlacement(map[string]int64{"s-0": 5000, "s-1": 10, "s-2": 0})
+	if servers := placeAll(p, []database.Key{{Id: "k-8"}}, false)["k-8"]; !slices.Equal(servers, []string{"s-2"}) {
+		t.Errorf("placed a new key onto %v, want the server with the least traffic", servers)
+	}
+}
@@ -15,10 +15,11 @@ import (
 func (c *Coordinator) syncServers(reconfigure bool) {
 	c.Logger.Debug("syncing server list in the prometheus service")
 
+	current := c.CurrentServer()
 	servers := map[string]string{
-		c.CurrentServer().Id: fmt.Sprintf("%s:%d", c.CurrentServer().HttpHost, c.CurrentServer().HttpPort),
+		current.Id: fmt.Sprintf("%s:%d", current.HttpHost, current.HttpPort),
 	}
-	for _, s := range c.Database.ServerTable.Servers {
+	for _, s := range c.Database.ServerTable.All() {
 		servers[s.Id] = fmt.Sprintf("%s:%d", s.HttpHost, s.HttpPort)
 	}
 
@@ -33,20 +34,32 @@ func (c *Coordinator) syncServers(reconfigure bool) {
 	go c.pushServers()
 }
 
-func (c *Coordinator) updateServerStatus(s *database.Server, newStatus string) {
-	s.Status = newStatus
-	if _, err := c.Database.ServerTable.Update(*s); err != nil {
+// updateServerStatus sets the status of a failed server and marks it as not synced.
+func (c *Coordinator) updateServerStatus(s database.Server, newStatus string) {
+	updated, err := c.Database.ServerTable.Modify(s.Id, func(s *database.Server) {
+		s.Status = newStatus
+		s.SyncedAt = 0
+	})
+	if err != nil {
 		c.Logger.Error("cannot update server status", zap.String("server", s.Id), zap.Error(err))
+	} else if updated != nil && s.Status != newStatus {
+		c.auditSystem("servers.status", s.Id, s, updated)
 	}
 }
 
+// pullServers pulls the servers and re-places the keys, since the servers might have become (un)available.
 func (c *Coordinator) pullServers() {
-	for _, s := range c.Database.ServerTable.Servers {
+	for _, s := range c.Database.ServerTable.All() {
 		c.pullServer(s)
 	}
+
+	if c.placeKeys() {
+		c.syncShadowsocks(true)
+		go c.pushServers()
+	}
 }
 
-func (c *Coordinator) pullServer(s *database.Server) {
+func (c *Coordinator) pullServer(s database.Server) {
 	url := fmt.Sprintf("http://%s:%d/v1/settings", s.HttpHost, s.HttpPort)
 
 	request, err := http.NewRequest("GET", url, nil)
@@ -85,7 +98,7 @@ func (c *Coordinator) pullServer(s *database.Server) {
 		return
 	}
 
-	var settings database.SettingTable
+	var settings database.Settings
 	if err = json.Unmarshal(body, &settings); err != nil {
 		c.Logger.Error(
 			"cannot unmarshall pulled server", zap.String("url", url),
@@ -95,29 +108,34 @@ func (c *Coordinator) pullServer(s *database.Server) {
 		return
 	}
 
-	s.Status = database.ServerStatusActive
-	s.ShadowsocksEnabled = settings.ShadowsocksEnabled
-	s.ShadowsocksHost = settings.ShadowsocksHost
-	s.ShadowsocksPort = settings.ShadowsocksPort
-
-	if _, err = c.Database.ServerTable.Update(*s); err != nil {
+	updated, err := c.Database.ServerTable.Modify(s.Id, func(s *database.Server) {
+		s.Status = database.ServerStatusActive
+		s.ShadowsocksEnabled = settings.ShadowsocksEnabled
+		s.ShadowsocksHost = settings.ShadowsocksHost
+		s.ShadowsocksPort = settings.ShadowsocksPort
+	})
+	if err != nil {
 		c.Logger.Error("cannot update server", zap.String("server", s.Id), zap.Error(err))
+	} else if updated != nil {
+		c.auditSystem("servers.pull", s.Id, s, updated)
 	}
 }
 
 func (c *Coordinator) pushServers() {
-	for _, s := range c.Database.ServerTable.Servers {
-		if s.SyncedAt < c.Database.KeyTable.UpdatedAt {
+	updatedAt := c.Database.KeyTable.UpdatedAt()
+	for _, s := range c.Database.ServerTable.All() {
+		if s.SyncedAt <= updatedAt {
 			go c.pushServer(s)
 		}
 	}
 }
 
-func (c *Coordinator) pushServer(s *database.Server) {
+func (c *Coordinator) pushServer(s database.Server) {
 	url := fmt.Sprintf("http://%s:%d/v1/keys/fill", s.HttpHost, s.HttpPort)
 	c.Logger.Debug("pushing keys to server...", zap.String("url", url))
 
-	body, err := json.Marshal(c.Database.KeyTable.Keys)
+	syncedAt := time.Now().Unix()
+	body, err := json.Marshal(c.serverKeys(&s))
 	if err != nil {
 		c.Logger.Fatal("cannot marshal database.keys", zap.Error(err))
 	}
@@ -152,10 +170,26 @@ func (c *Coordinator) pushServer(s *database.Server) {
 		return
 	}
 
-	s.Status = database.ServerStatusActive
-	s.SyncedAt = time.Now().Unix()
-
-	if _, err = c.Database.ServerTable.Update(*s); err != nil {
+	updated, err := c.Database.ServerTable.Modify(s.Id, func(s *database.Server) {
+		s.Status = database.ServerStatusActive
+		s.SyncedAt = syncedAt
+	})
+	if err != nil {
 		c.Logger.Error("cannot update server", zap.String("server", s.Id), zap.Error(err))
+	} else if updated != nil && s.Status != database.ServerStatusActive {
+		c.auditSystem("servers.status", s.Id, s, updated)
+	}
+}
+
+// serverKeys returns the keys that the given server serves.
+// The servers do not know their IDs here, so the restrictions are dropped from the keys they receive.
+func (c *Coordinator) serverKeys(s *database.Server) []database.Key {
+	keys := []database.Key{}
+	for _, k := range c.Database.KeyTable.All() {
+		if k.AllowsServer(s) {
+			k.Servers, k.Regions = nil, nil
+			keys = append(keys, k)
+		}
 	}
+	return keys
 }
@@ -7,22 +7,32 @@ import (
 )
 
 func (c *Coordinator) syncShadowsocks(reconfigure bool) {
-	if c.SyncedAt != 0 && c.SyncedAt > c.Database.KeyTable.UpdatedAt {
+	c.syncMutex.Lock()
+	defer c.syncMutex.Unlock()
+
+	current := c.CurrentServer()
+	updatedAt := c.Database.KeyTable.UpdatedAt()
+	if t := c.Database.SettingTable.UpdatedAt(); t > updatedAt {
+		updatedAt = t
+	}
+	if current.SyncedAt != 0 && current.SyncedAt > updatedAt {
 		return
 	}
 
 	c.Logger.Debug("syncing keys with the local shadowsocks server...")
 
-	keys := make([]shadowsocks.Key, 0, len(c.Database.KeyTable.Keys))
-	for _, k := range c.Database.KeyTable.Keys {
-		if !k.Enabled {
+	port := c.Database.SettingTable.Get().ShadowsocksPort
+	all := c.Database.KeyTable.All()
+	keys := make([]shadowsocks.Key, 0, len(all))
+	for _, k := range all {
+		if !k.Enabled || !k.AllowsServer(current) {
 			continue
 		}
 		keys = append(keys, shadowsocks.Key{
 			Id:     k.Id,
 			Secret: k.Secret,
 			Cipher: k.Cipher,
-			Port:   c.Database.SettingTable.ShadowsocksPort,
+			Port:   port,
 		})
 	}
 
@@ -34,5 +44,7 @@ func (c *Coordinator) syncShadowsocks(reconfigure bool) {
 		c.Shadowsocks.Reconfigure()
 	}
 
-	c.SyncedAt = time.Now().Unix()
+	c.mutex.Lock()
+	c.syncedAt = time.Now().Unix()
+	c.mutex.Unlock()
 }
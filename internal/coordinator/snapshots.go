@@ -0,0 +1,41 @@
+package coordinator
+
+import (
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"go.uber.org/zap"
+	"time"
+)
+
+// snapshot writes a snapshot of the database once the newest one is older than the interval,
+// and then prunes the snapshots by the retention policy.
+func (c *Coordinator) snapshot() {
+	if c.Config.Snapshot.Interval <= 0 {
+		return
+	}
+	directory := c.Config.Snapshot.Directory
+
+	latest, err := database.FindSnapshot(directory, database.SnapshotLatest)
+	if err != nil {
+		c.Logger.Error("cannot find the latest snapshot", zap.Error(err))
+		return
+	}
+	interval := time.Duration(c.Config.Snapshot.Interval) * time.Hour
+	if latest != nil && time.Since(time.UnixMilli(latest.CreatedAt)) < interval {
+		return
+	}
+
+	s, err := c.Database.WriteSnapshot(directory, c.Config.Snapshot.Passphrase)
+	if err != nil {
+		c.Logger.Error("cannot write the snapshot", zap.Error(err))
+		return
+	}
+	c.Logger.Info("snapshot written", zap.String("id", s.Id), zap.Int64("size", s.Size))
+
+	removed, err := database.PruneSnapshots(directory, c.Config.Snapshot.Daily, c.Config.Snapshot.Weekly)
+	for _, r := range removed {
+		c.Logger.Info("snapshot pruned", zap.String("id", r.Id))
+	}
+	if err != nil {
+		c.Logger.Error("cannot prune the snapshots", zap.Error(err))
+	}
+}
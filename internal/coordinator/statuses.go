@@ -0,0 +1,51 @@
+package coordinator
+
+import (
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"go.uber.org/zap"
+)
+
+// CheckStatuses updates the automatic statuses (expired, cap_exceeded, and quota_exceeded) of the keys
+// and syncs the servers if any key changed. Suspended keys are left untouched.
+// Caps and quotas are checked only after the metrics have been synced at least once.
+// The statuses are changed only on the master; nodes keep the ones pushed by the master.
+func (c *Coordinator) CheckStatuses() {
+	dirty := c.checkExpirations()
+
+	c.mutex.RLock()
+	metricsSynced := c.metricsSyncedAt != 0
+	c.mutex.RUnlock()
+
+	if metricsSynced {
+		dirty = c.checkCaps() || dirty
+		dirty = c.checkQuotas() || dirty
+	}
+
+	if dirty {
+		c.Sync()
+	}
+}
+
+// updateKeyStatus changes the status of the key if it still has the given current status.
+// It returns true if the status has changed.
+func (c *Coordinator) updateKeyStatus(id, current, status, reason string) bool {
+	changed := false
+	var before database.Key
+	updated, err := c.Database.KeyTable.Modify(id, func(k *database.Key) {
+		if k.Status == current {
+			before = *k
+			k.SetStatus(status, reason)
+			changed = true
+		}
+	})
+	if err != nil {
+		c.Logger.Error("cannot update the key status", zap.String("key", id), zap.Error(err))
+		return false
+	}
+
+	if changed {
+		c.Logger.Info("key status changed", zap.String("key", id), zap.String("status", status))
+		c.auditSystem("keys.status", id, before, updated)
+	}
+	return changed
+}
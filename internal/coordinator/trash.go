@@ -0,0 +1,80 @@
+package coordinator
+
+import (
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"go.uber.org/zap"
+	"time"
+)
+
+// TrashPurgeAt returns the time (in milliseconds) that an item deleted at the given time is purged,
+// or zero if the items in the trash are kept until they are purged by hand.
+func (c *Coordinator) TrashPurgeAt(deletedAt int64) int64 {
+	if c.Config.Trash.Retention <= 0 {
+		return 0
+	}
+	return deletedAt + (time.Duration(c.Config.Trash.Retention) * 24 * time.Hour).Milliseconds()
+}
+
+// PurgeKey removes the key from the trash permanently, along with its usage data.
+// It returns nil if the key is not in the trash.
+func (c *Coordinator) PurgeKey(id string) (*database.Key, error) {
+	key, err := c.Database.KeyTable.Purge(id)
+	if err != nil || key == nil {
+		return key, err
+	}
+
+	c.mutex.Lock()
+	delete(c.keyMetrics, id)
+	delete(c.capMetrics, id)
+	c.mutex.Unlock()
+
+	c.Logger.Info("key purged", zap.String("id", id))
+	return key, c.Database.UsageTable.Delete(id)
+}
+
+// PurgeServer removes the server from the trash permanently, along with its usage data.
+// It returns nil if the server is not in the trash.
+func (c *Coordinator) PurgeServer(id string) (*database.Server, error) {
+	server, err := c.Database.ServerTable.Purge(id)
+	if err != nil || server == nil {
+		return server, err
+	}
+
+	c.mutex.Lock()
+	delete(c.serverMetrics, id)
+	c.mutex.Unlock()
+
+	c.Logger.Info("server purged", zap.String("id", id))
+	return server, c.Database.UsageTable.Delete(id)
+}
+
+// purgeTrash purges the keys and servers that have been in the trash longer than the retention.
+func (c *Coordinator) purgeTrash() {
+	now := time.Now().UnixMilli()
+
+	for _, k := range c.Database.KeyTable.Trash() {
+		if at := c.TrashPurgeAt(k.DeletedAt); at == 0 || at > now {
+			continue
+		}
+		key, err := c.PurgeKey(k.Id)
+		if err != nil {
+			c.Logger.Error("cannot purge the key", zap.String("key", k.Id), zap.Error(err))
+		}
+		if key != nil {
+			c.auditSystem("keys.purge", k.Id, key, nil)
+		}
+	}
+
+	for _, s := range c.Database.ServerTable.Trash() {
+		if at := c.TrashPurgeAt(s.DeletedAt); at == 0 || at > now {
+			continue
+		}
+		server, err := c.PurgeServer(s.Id)
+		if err != nil {
+			c.Logger.Error("cannot purge the server", zap.String("server", s.Id), zap.Error(err))
+		}
+		if server != nil {
+			c.auditSystem("servers.purge", s.Id, server, nil)
+		}
+	}
+}
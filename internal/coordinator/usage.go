@@ -0,0 +1,71 @@
+package coordinator
+
+import (
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"go.uber.org/zap"
+	"time"
+)
+
+// syncUsage rolls up the usage of the keys and servers in today and yesterday into the usage table.
+// Yesterday is rolled up again, so the traffic after the last sync of yesterday is recorded too.
+func (c *Coordinator) syncUsage() {
+	c.Logger.Debug("syncing usage...")
+
+	now := time.Now()
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+
+	// Prometheus still has the recent metrics of the purged keys and servers, but their usage must not come back.
+	known := map[string]bool{c.CurrentServer().Id: true}
+	for _, k := range append(c.Database.KeyTable.All(), c.Database.KeyTable.Trash()...) {
+		known[k.Id] = true
+	}
+	for _, s := range append(c.Database.ServerTable.All(), c.Database.ServerTable.Trash()...) {
+		known[s.Id] = true
+	}
+
+	var usages []database.Usage
+	for _, day := range []time.Time{today.AddDate(0, 0, -1), today} {
+		end := day.AddDate(0, 0, 1)
+		if end.After(now) {
+			end = now
+		}
+		if end.Sub(day) < time.Minute {
+			continue
+		}
+
+		metrics, err := c.Prometheus.MetricsBetween(day, end)
+		if err != nil {
+			c.Logger.Error("prometheus query failed", zap.Error(err))
+			return
+		}
+
+		sms := map[string]*ServerMetric{}
+		kms := map[string]*KeyMetric{}
+		c.collectMetrics(metrics, sms, kms)
+
+		date := day.Format(database.UsageDateLayout)
+		for id, sm := range sms {
+			if !known[id] {
+				continue
+			}
+			usages = append(usages, database.Usage{
+				Date: date, Subject: id,
+				DownTcp: sm.DownTcp, UpTcp: sm.UpTcp, DownUdp: sm.DownUdp, UpUdp: sm.UpUdp, Total: sm.Total,
+			})
+		}
+		for id, km := range kms {
+			if !known[id] {
+				continue
+			}
+			usages = append(usages, database.Usage{
+				Date: date, Subject: id,
+				DownTcp: km.DownTcp, UpTcp: km.UpTcp, DownUdp: km.DownUdp, UpUdp: km.UpUdp, Total: km.Total,
+			})
+		}
+	}
+
+	if err := c.Database.UsageTable.Record(usages); err != nil {
+		c.Logger.Error("cannot record usage", zap.Error(err))
+	}
+}
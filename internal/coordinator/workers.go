@@ -16,6 +16,13 @@ func (c *Coordinator) startWorker() {
 
 func (c *Coordinator) runJobs() {
 	go c.pullServers()
-	go c.syncMetrics()
+	// The metrics are calculated from the usage rollups, so they are synced after them.
+	go func() {
+		c.syncUsage()
+		c.syncMetrics()
+	}()
+	go c.CheckStatuses()
 	go c.pushServers()
+	go c.purgeTrash()
+	go c.snapshot()
 }
@@ -0,0 +1,429 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/validator"
+	"github.com/miladrahimi/shadowsocks/pkg/totp"
+	"github.com/miladrahimi/shadowsocks/pkg/utils"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/exp/slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AdminRoleOwner    = "owner"
+	AdminRoleOperator = "operator"
+	AdminRoleReadOnly = "read_only"
+)
+
+// recoveryCodeCount is the number of the recovery codes generated for the two-factor authentication.
+const recoveryCodeCount = 10
+
+// adminRoleRanks ranks the roles; each role has all the permissions of the lower ones.
+var adminRoleRanks = map[string]int{
+	AdminRoleReadOnly: 1,
+	AdminRoleOperator: 2,
+	AdminRoleOwner:    3,
+}
+
+// RoleAllows checks if the role has the permissions of the required role.
+func RoleAllows(role, required string) bool {
+	return adminRoleRanks[role] >= adminRoleRanks[required]
+}
+
+type Admin struct {
+	Id           string `json:"id" validate:"required"`
+	Username     string `json:"username" validate:"required,min=3,max=32,alphanum"`
+	PasswordHash string `json:"password_hash" validate:"required"`
+	Role         string `json:"role" validate:"required,oneof=owner operator read_only"`
+	CreatedAt    int64  `json:"created_at"`
+	// TotpSecret is the secret of the two-factor authentication; it is pending until TotpEnabled is set.
+	TotpSecret    string   `json:"totp_secret,omitempty"`
+	TotpEnabled   bool     `json:"totp_enabled"`
+	TotpLastStep  int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// SetPassword replaces the password hash of the admin.
+func (a *Admin) SetPassword(password string) error {
+	if len(password) < 8 || len(password) > 64 {
+		return DataError("The password must be between 8 and 64 characters.")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	a.PasswordHash = string(hash)
+	return nil
+}
+
+// CheckPassword checks if the given password matches the password hash of the admin.
+func (a *Admin) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte(password)) == nil
+}
+
+// normalizeCode removes the separators of the given TOTP or recovery code.
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// GenerateRecoveryCodes replaces the recovery codes of the admin and returns the new ones.
+// Only the hashes of the codes are kept.
+func (a *Admin) GenerateRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+	a.RecoveryCodes = make([]string, recoveryCodeCount)
+	for i := range codes {
+		code := utils.SecureString(10, "abcdefghjkmnpqrstuvwxyz23456789")
+		codes[i] = code[:5] + "-" + code[5:]
+		a.RecoveryCodes[i] = hashToken(code)
+	}
+	return codes
+}
+
+// DisableTotp removes the two-factor authentication of the admin.
+func (a *Admin) DisableTotp() {
+	a.TotpSecret = ""
+	a.TotpEnabled = false
+	a.TotpLastStep = 0
+	a.RecoveryCodes = nil
+}
+
+// useSecondFactor checks the TOTP code or a recovery code of the admin and marks it as used,
+// so neither can be used again.
+func (a *Admin) useSecondFactor(code string, now time.Time) bool {
+	code = normalizeCode(code)
+	if a.TotpSecret == "" || code == "" {
+		return false
+	}
+	if len(code) == totp.Digits {
+		if step := totp.Match(a.TotpSecret, code, now); step != -1 && step > a.TotpLastStep {
+			a.TotpLastStep = step
+			return true
+		}
+		return false
+	}
+	if i := slices.Index(a.RecoveryCodes, hashToken(code)); i != -1 {
+		a.RecoveryCodes = slices.Delete(append([]string{}, a.RecoveryCodes...), i, i+1)
+		return true
+	}
+	return false
+}
+
+// AdminTable holds the admin accounts and guards them against concurrent access.
+// Its methods take and return copies of the admins, so callers never share its state.
+type AdminTable struct {
+	admins    []*Admin
+	nextId    int64
+	updatedAt int64
+	generated string
+	store     Store
+	mutex     sync.RWMutex
+}
+
+// SeedUsername is the username of the owner account that a new admins table is seeded with.
+const SeedUsername = "admin"
+
+// seedPasswordLength is the length of the random passwords of the seeded owner accounts.
+const seedPasswordLength = 16
+
+// dummyHash is compared with the passwords of the unknown usernames, so they take as long as the known ones.
+var dummyHash = struct {
+	once sync.Once
+	hash []byte
+}{}
+
+// adminTableMeta is the metadata record of the admins table.
+type adminTableMeta struct {
+	NextId    int64 `json:"next_id"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// Load loads the admins; if the table does not exist yet,
+// it creates the owner account `admin` with the given (legacy) password.
+func (at *AdminTable) Load(password string) error {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	var meta adminTableMeta
+	var admins []*Admin
+	err := at.store.Load(TableAdmins, &meta, func(_ string, row []byte) error {
+		var a Admin
+		if err := json.Unmarshal(row, &a); err != nil {
+			return err
+		}
+		admins = append(admins, &a)
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrTableNotFound) {
+			return at.seed(password)
+		}
+		return errors.New(fmt.Sprintf("cannot load %s, err: %v", TableAdmins, err))
+	}
+
+	if meta.NextId < 1 {
+		return errors.New(fmt.Sprintf("cannot validate %s, err: invalid next_id %d", TableAdmins, meta.NextId))
+	}
+
+	sort.SliceStable(admins, func(i, j int) bool {
+		return idNumber(admins[i].Id) < idNumber(admins[j].Id)
+	})
+
+	at.admins = append([]*Admin{}, admins...)
+	at.nextId = meta.NextId
+	at.updatedAt = meta.UpdatedAt
+
+	return nil
+}
+
+// seed creates the table with the owner account; the caller must hold the lock.
+// Without a (legacy) password, the owner gets a random one, which GeneratedPassword returns once.
+func (at *AdminTable) seed(password string) error {
+	if password == "" {
+		password = utils.SecureString(seedPasswordLength)
+		at.generated = password
+	}
+
+	owner := Admin{
+		Id:        fmt.Sprintf("a-%d", at.nextId),
+		Username:  SeedUsername,
+		Role:      AdminRoleOwner,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	owner.PasswordHash = string(hash)
+
+	if err = at.commit(at.nextId+1, func(tx Tx) error {
+		return tx.Put(TableAdmins, owner.Id, owner)
+	}); err != nil {
+		return err
+	}
+
+	at.admins = []*Admin{&owner}
+	return nil
+}
+
+// commit applies the row changes of fn and the table metadata in a single transaction.
+// The caller must hold the lock.
+func (at *AdminTable) commit(nextId int64, fn func(tx Tx) error) error {
+	meta := adminTableMeta{NextId: nextId, UpdatedAt: time.Now().Unix()}
+	err := at.store.Update(func(tx Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := tx.SetVersion(TableAdmins, LatestVersion(TableAdmins)); err != nil {
+			return err
+		}
+		return tx.PutMeta(TableAdmins, meta)
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot save %s, err: %v", TableAdmins, err))
+	}
+
+	at.nextId = meta.NextId
+	at.updatedAt = meta.UpdatedAt
+
+	return nil
+}
+
+// checkOwners ensures the admins (after a change) still have an owner; the caller must hold the lock.
+func checkOwners(admins []*Admin) error {
+	if slices.IndexFunc(admins, func(a *Admin) bool { return a.Role == AdminRoleOwner }) == -1 {
+		return DataError("At least one owner is required.")
+	}
+	return nil
+}
+
+// All returns copies of all the admins.
+func (at *AdminTable) All() []Admin {
+	at.mutex.RLock()
+	defer at.mutex.RUnlock()
+
+	admins := make([]Admin, 0, len(at.admins))
+	for _, a := range at.admins {
+		admins = append(admins, *a)
+	}
+	return admins
+}
+
+// Store creates an admin with the given password.
+func (at *AdminTable) Store(admin Admin, password string) (*Admin, error) {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	for _, a := range at.admins {
+		if a.Username == admin.Username {
+			return nil, DataError(fmt.Sprintf("The username `%s` already exists.", a.Username))
+		}
+	}
+
+	admin.Id = fmt.Sprintf("a-%d", at.nextId)
+	admin.CreatedAt = time.Now().UnixMilli()
+	if err := admin.SetPassword(password); err != nil {
+		return nil, err
+	}
+
+	if err := validator.New().Struct(admin); err != nil {
+		return nil, DataError(err.Error())
+	}
+
+	if err := at.commit(at.nextId+1, func(tx Tx) error {
+		return tx.Put(TableAdmins, admin.Id, admin)
+	}); err != nil {
+		return nil, err
+	}
+
+	stored := admin
+	at.admins = append(at.admins, &stored)
+
+	return &admin, nil
+}
+
+// Modify applies fn to a copy of the admin with the given ID and persists the result if it is valid.
+// It returns nil if the admin does not exist.
+func (at *AdminTable) Modify(id string, fn func(a *Admin) error) (*Admin, error) {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	i := slices.IndexFunc(at.admins, func(a *Admin) bool { return a.Id == id })
+	if i == -1 {
+		return nil, nil
+	}
+
+	updated := *at.admins[i]
+	if err := fn(&updated); err != nil {
+		return nil, err
+	}
+	updated.Id = id
+
+	for _, a := range at.admins {
+		if a.Id != updated.Id && a.Username == updated.Username {
+			return nil, DataError(fmt.Sprintf("The username `%s` already exists.", a.Username))
+		}
+	}
+
+	if err := validator.New().Struct(updated); err != nil {
+		return nil, DataError(err.Error())
+	}
+
+	admins := append([]*Admin{}, at.admins...)
+	admins[i] = &updated
+	if err := checkOwners(admins); err != nil {
+		return nil, err
+	}
+
+	if err := at.commit(at.nextId, func(tx Tx) error {
+		return tx.Put(TableAdmins, updated.Id, updated)
+	}); err != nil {
+		return nil, err
+	}
+
+	*at.admins[i] = updated
+	return &updated, nil
+}
+
+// Find returns a copy of the admin with the given ID or nil if it does not exist.
+func (at *AdminTable) Find(id string) *Admin {
+	at.mutex.RLock()
+	defer at.mutex.RUnlock()
+
+	for _, a := range at.admins {
+		if a.Id == id {
+			admin := *a
+			return &admin
+		}
+	}
+	return nil
+}
+
+// Authenticate returns a copy of the admin with the given username and password or nil if they do not match.
+func (at *AdminTable) Authenticate(username, password string) *Admin {
+	at.mutex.RLock()
+	var admin *Admin
+	for _, a := range at.admins {
+		if a.Username == username {
+			found := *a
+			admin = &found
+		}
+	}
+	at.mutex.RUnlock()
+
+	if admin == nil {
+		dummyHash.once.Do(func() {
+			dummyHash.hash, _ = bcrypt.GenerateFromPassword([]byte(utils.SecureString(seedPasswordLength)), bcrypt.DefaultCost)
+		})
+		_ = bcrypt.CompareHashAndPassword(dummyHash.hash, []byte(password))
+		return nil
+	}
+	if !admin.CheckPassword(password) {
+		return nil
+	}
+	return admin
+}
+
+// GeneratedPassword returns the random password of the seeded owner account (if any) and forgets it.
+func (at *AdminTable) GeneratedPassword() string {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	password := at.generated
+	at.generated = ""
+	return password
+}
+
+func (at *AdminTable) Delete(id string) error {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	for i, a := range at.admins {
+		if a.Id == id {
+			if err := checkOwners(slices.Delete(append([]*Admin{}, at.admins...), i, i+1)); err != nil {
+				return err
+			}
+
+			if err := at.commit(at.nextId, func(tx Tx) error {
+				return tx.Delete(TableAdmins, id)
+			}); err != nil {
+				return err
+			}
+
+			at.admins = slices.Delete(at.admins, i, i+1)
+			return nil
+		}
+	}
+	return nil
+}
+
+// VerifySecondFactor checks the TOTP code or a recovery code of the admin with the given ID.
+// The used codes are recorded, so they cannot be replayed.
+func (at *AdminTable) VerifySecondFactor(id, code string) (bool, error) {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	i := slices.IndexFunc(at.admins, func(a *Admin) bool { return a.Id == id })
+	if i == -1 {
+		return false, nil
+	}
+
+	updated := *at.admins[i]
+	if !updated.useSecondFactor(code, time.Now()) {
+		return false, nil
+	}
+
+	if err := at.commit(at.nextId, func(tx Tx) error {
+		return tx.Put(TableAdmins, updated.Id, updated)
+	}); err != nil {
+		return false, err
+	}
+
+	*at.admins[i] = updated
+	return true, nil
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miladrahimi/shadowsocks/pkg/totp"
+)
+
+func TestAdminUseSecondFactor(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Admin{TotpSecret: secret, TotpEnabled: true}
+	now := time.Now()
+	step := totp.Step(now)
+	code := func(offset int64) string {
+		c, err := totp.Code(secret, step+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// The steps must move forward, so a code can be used once and the earlier ones never again.
+	cases := []struct {
+		code string
+		want bool
+	}{
+		{code(-2), false},
+		{code(0), true},
+		{code(0), false},
+		{code(-1), false},
+		{code(1), true},
+		{code(2), false},
+		{"", false},
+	}
+	for i, c := range cases {
+		if got := a.useSecondFactor(c.code, now); got != c.want {
+			t.Errorf("case %d: used %s = %t, want %t", i, c.code, got, c.want)
+		}
+	}
+	if a.TotpLastStep != step+1 {
+		t.Errorf("last step = %d, want %d", a.TotpLastStep, step+1)
+	}
+
+	// The recovery codes work once each, with or without the separators and in any case.
+	codes := a.GenerateRecoveryCodes()
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("generated %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+	if !a.useSecondFactor(strings.ToUpper(codes[0]), now) {
+		t.Error("rejected a recovery code")
+	}
+	if a.useSecondFactor(strings.ReplaceAll(codes[0], "-", ""), now) {
+		t.Error("accepted a used recovery code")
+	}
+	if !a.useSecondFactor(strings.ReplaceAll(codes[1], "-", " "), now) {
+		t.Error("rejected a recovery code with spaces")
+	}
+	if len(a.RecoveryCodes) != recoveryCodeCount-2 {
+		t.Errorf("%d recovery codes left, want %d", len(a.RecoveryCodes), recoveryCodeCount-2)
+	}
+
+	// Without the secret, nothing is accepted.
+	a.DisableTotp()
+	if a.useSecondFactor(codes[2], now) {
+		t.Error("accepted a recovery code after disabling the two-factor authentication")
+	}
+}
+
+func TestAdminTableVerifySecondFactor(t *testing.T) {
+	d := newTestDatabase(t)
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codes []string
+	admin, err := d.AdminTable.Modify(d.AdminTable.All()[0].Id, func(a *Admin) error {
+		a.TotpSecret = secret
+		a.TotpEnabled = true
+		codes = a.GenerateRecoveryCodes()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range []struct {
+		code string
+		want bool
+	}{
+		{code, true},
+		{codes[0], true},
+		{"000000", false},
+	} {
+		if ok, err := d.AdminTable.VerifySecondFactor(admin.Id, c.code); err != nil || ok != c.want {
+			t.Errorf("case %d: verified %t (err: %v), want %t", i, ok, err, c.want)
+		}
+	}
+
+	// The used codes are saved, so they cannot be replayed after a restart either.
+	if err = d.AdminTable.Load(""); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{code, codes[0]} {
+		if ok, err := d.AdminTable.VerifySecondFactor(admin.Id, c); err != nil || ok {
+			t.Errorf("verified %t (err: %v) a used code after reloading", ok, err)
+		}
+	}
+	if ok, err := d.AdminTable.VerifySecondFactor(admin.Id, codes[1]); err != nil || !ok {
+		t.Errorf("verified %t (err: %v) an unused recovery code after reloading", ok, err)
+	}
+}
@@ -0,0 +1,248 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditActorSystem is the actor of the changes the coordinator makes on its own (e.g., quota disables).
+const AuditActorSystem = "system"
+
+// auditRedacted is the value of the changed secret fields in the audit diffs.
+const auditRedacted = `"[redacted]"`
+
+// auditSecretFields are the fields whose values are never written into the audit log.
+var auditSecretFields = map[string]bool{
+	"admin_password": true,
+	"api_token":      true,
+	"code":           true,
+	"hash":           true,
+	"password_hash":  true,
+	"recovery_codes": true,
+	"refresh_hash":   true,
+	"secret":         true,
+	"token_hash":     true,
+	"totp_secret":    true,
+}
+
+// AuditChange is the value of a field before and after a change (nil if the field did not exist).
+type AuditChange struct {
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditEntry records who changed what, from where, and how.
+// Actor is "admin:<username>", "token:<id>", "node" (the API token of the settings),
+// "key:<id>" (the owner of the key via its profile), or "system".
+type AuditEntry struct {
+	Id       string                 `json:"id"`
+	At       int64                  `json:"at"`
+	Actor    string                 `json:"actor"`
+	RemoteIp string                 `json:"remote_ip,omitempty"`
+	Action   string                 `json:"action"`
+	Target   string                 `json:"target"`
+	Changes  map[string]AuditChange `json:"changes,omitempty"`
+}
+
+// AuditFilter selects the audit entries; the zero values match everything.
+// Action matches the actions with the given prefix (e.g., "keys." matches all the key actions).
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	From   int64
+	To     int64
+	Limit  int
+}
+
+// Match checks if the entry satisfies all the criteria of the filter.
+func (f *AuditFilter) Match(e *AuditEntry) bool {
+	return (f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Action == "" || strings.HasPrefix(e.Action, f.Action)) &&
+		(f.Target == "" || e.Target == f.Target) &&
+		(f.From == 0 || e.At >= f.From) &&
+		(f.To == 0 || e.At <= f.To)
+}
+
+// Diff returns the top-level fields (by their JSON names) that differ between before and after.
+// Either can be nil, for creations and deletions. The values of the secret fields are redacted.
+func Diff(before, after interface{}) map[string]AuditChange {
+	b, a := auditFields(before), auditFields(after)
+
+	changes := map[string]AuditChange{}
+	for name, value := range b {
+		if other, found := a[name]; !found || !bytes.Equal(value, other) {
+			changes[name] = AuditChange{Before: value, After: other}
+		}
+	}
+	for name, value := range a {
+		if _, found := b[name]; !found {
+			changes[name] = AuditChange{After: value}
+		}
+	}
+
+	for name, change := range changes {
+		if auditSecretFields[name] {
+			if change.Before != nil {
+				change.Before = json.RawMessage(auditRedacted)
+			}
+			if change.After != nil {
+				change.After = json.RawMessage(auditRedacted)
+			}
+			changes[name] = change
+		}
+	}
+
+	return changes
+}
+
+// auditFields returns the top-level JSON fields of v; values that are not JSON objects have no fields.
+func auditFields(v interface{}) map[string]json.RawMessage {
+	fields := map[string]json.RawMessage{}
+	if v == nil {
+		return fields
+	}
+	content, err := json.Marshal(v)
+	if err != nil || json.Unmarshal(content, &fields) != nil {
+		return map[string]json.RawMessage{}
+	}
+	for name, value := range fields {
+		if string(value) == "null" {
+			delete(fields, name)
+		}
+	}
+	return fields
+}
+
+// AuditTable is the append-only audit log.
+// The entries older than the retention (if any) are dropped as new ones are appended.
+type AuditTable struct {
+	entries   []*AuditEntry
+	nextId    int64
+	updatedAt int64
+	retention time.Duration
+	store     Store
+	mutex     sync.RWMutex
+}
+
+// auditTableMeta is the metadata record of the audit table.
+type auditTableMeta struct {
+	NextId    int64 `json:"next_id"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+func (at *AuditTable) Load() error {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	var meta auditTableMeta
+	var entries []*AuditEntry
+	err := at.store.Load(TableAudit, &meta, func(_ string, row []byte) error {
+		var e AuditEntry
+		if err := json.Unmarshal(row, &e); err != nil {
+			return err
+		}
+		entries = append(entries, &e)
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrTableNotFound) {
+			return at.commit(at.nextId, func(tx Tx) error { return nil })
+		}
+		return errors.New(fmt.Sprintf("cannot load %s, err: %v", TableAudit, err))
+	}
+
+	if meta.NextId < 1 {
+		return errors.New(fmt.Sprintf("cannot validate %s, err: invalid next_id %d", TableAudit, meta.NextId))
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return idNumber(entries[i].Id) < idNumber(entries[j].Id)
+	})
+
+	at.entries = append([]*AuditEntry{}, entries...)
+	at.nextId = meta.NextId
+	at.updatedAt = meta.UpdatedAt
+
+	return nil
+}
+
+// commit applies the row changes of fn and the table metadata in a single transaction.
+// The caller must hold the lock.
+func (at *AuditTable) commit(nextId int64, fn func(tx Tx) error) error {
+	meta := auditTableMeta{NextId: nextId, UpdatedAt: time.Now().Unix()}
+	err := at.store.Update(func(tx Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := tx.SetVersion(TableAudit, LatestVersion(TableAudit)); err != nil {
+			return err
+		}
+		return tx.PutMeta(TableAudit, meta)
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot save %s, err: %v", TableAudit, err))
+	}
+
+	at.nextId = meta.NextId
+	at.updatedAt = meta.UpdatedAt
+
+	return nil
+}
+
+// Append records the entry with a new ID and the current time.
+func (at *AuditTable) Append(entry AuditEntry) (*AuditEntry, error) {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+
+	now := time.Now()
+	entry.Id = fmt.Sprintf("e-%d", at.nextId)
+	entry.At = now.UnixMilli()
+
+	expired := 0
+	if at.retention > 0 {
+		threshold := now.Add(-at.retention).UnixMilli()
+		for expired < len(at.entries) && at.entries[expired].At < threshold {
+			expired++
+		}
+	}
+
+	if err := at.commit(at.nextId+1, func(tx Tx) error {
+		for _, e := range at.entries[:expired] {
+			if err := tx.Delete(TableAudit, e.Id); err != nil {
+				return err
+			}
+		}
+		return tx.Put(TableAudit, entry.Id, entry)
+	}); err != nil {
+		return nil, err
+	}
+
+	stored := entry
+	at.entries = append(at.entries[expired:], &stored)
+
+	return &entry, nil
+}
+
+// Query returns copies of the entries that match the filter, the newest first.
+func (at *AuditTable) Query(filter AuditFilter) []AuditEntry {
+	at.mutex.RLock()
+	defer at.mutex.RUnlock()
+
+	entries := make([]AuditEntry, 0)
+	for i := len(at.entries) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			break
+		}
+		if filter.Match(at.entries[i]) {
+			entries = append(entries, *at.entries[i])
+		}
+	}
+	return entries
+}
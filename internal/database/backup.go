@@ -0,0 +1,408 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/validator"
+	"github.com/miladrahimi/shadowsocks/internal/config"
+	"github.com/miladrahimi/shadowsocks/pkg/seal"
+	"sort"
+	"time"
+)
+
+const (
+	// BackupFormat identifies the backup files.
+	BackupFormat = "shadowsocks-backup"
+	// BackupVersion is the version of the backup format; tables keep their own schema versions.
+	BackupVersion = 1
+	// SealedBackupFormat identifies the backup files encrypted with a passphrase.
+	SealedBackupFormat = "shadowsocks-backup-sealed"
+	// backupTimeLayout is the layout of the creation times (in UTC) in the backup file names.
+	backupTimeLayout = "20060102-150405"
+)
+
+// BackupTables are the tables in the backups.
+// Sessions are short-lived, and the audit log belongs to the panel that has recorded it, so they are left out.
+var BackupTables = []string{TableSettings, TableKeys, TableServers, TableUsage, TableAdmins, TableTokens}
+
+// Backup is a versioned archive of the database tables.
+type Backup struct {
+	Format     string                  `json:"format"`
+	Version    int                     `json:"version"`
+	AppVersion string                  `json:"app_version"`
+	CreatedAt  int64                   `json:"created_at"`
+	Tables     map[string]*BackupTable `json:"tables"`
+}
+
+// BackupTable is a table in a backup with its schema version, metadata record, and rows (by their IDs).
+type BackupTable struct {
+	Version int                        `json:"version"`
+	Meta    json.RawMessage            `json:"meta"`
+	Rows    map[string]json.RawMessage `json:"rows"`
+}
+
+// RestoreSummary describes a (dry-run) restore; the rows of each table and the applied migrations.
+type RestoreSummary struct {
+	AppVersion string         `json:"app_version"`
+	CreatedAt  int64          `json:"created_at"`
+	Rows       map[string]int `json:"rows"`
+	Migrated   []string       `json:"migrated"`
+	DryRun     bool           `json:"dry_run"`
+}
+
+// sealedBackup is a backup encrypted with the master key or with a key derived from a passphrase and the salt.
+type sealedBackup struct {
+	Format    string `json:"format"`
+	Version   int    `json:"version"`
+	CreatedAt int64  `json:"created_at"`
+	Key       string `json:"key"`
+	Salt      []byte `json:"salt,omitempty"`
+	Data      []byte `json:"data"`
+}
+
+const (
+	// sealedKeyPassphrase marks the backups encrypted with a passphrase.
+	sealedKeyPassphrase = "passphrase"
+	// sealedKeyMaster marks the backups encrypted with the master key.
+	sealedKeyMaster = "master"
+)
+
+// BackupFileName returns the name of the backup file created at the given time.
+func BackupFileName(t time.Time) string {
+	return BackupFormat + "-" + t.UTC().Format(backupTimeLayout) + ".json"
+}
+
+// EncodeBackup returns the content of the backup file. It is encrypted with the passphrase if it is not empty,
+// or else with the master key if there is one, so the backups never expose the secrets encrypted at rest.
+func (d *Database) EncodeBackup(b *Backup, passphrase string) ([]byte, error) {
+	content, err := json.Marshal(b)
+	if err != nil || (passphrase == "" && d.masterKey == nil) {
+		return content, err
+	}
+
+	sealed := sealedBackup{Format: SealedBackupFormat, Version: BackupVersion, CreatedAt: b.CreatedAt}
+	key := d.masterKey
+	if passphrase != "" {
+		sealed.Key = sealedKeyPassphrase
+		if sealed.Salt, err = seal.NewSalt(); err != nil {
+			return nil, err
+		}
+		if key, err = seal.DeriveKey(passphrase, sealed.Salt); err != nil {
+			return nil, err
+		}
+	} else {
+		sealed.Key = sealedKeyMaster
+	}
+
+	if sealed.Data, err = seal.Seal(key, content); err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealed)
+}
+
+// DecodeBackup decodes the content of a backup file, decrypting it with the passphrase or the master key
+// if it is encrypted.
+func (d *Database) DecodeBackup(content []byte, passphrase string) (*Backup, error) {
+	var sealed sealedBackup
+	if err := json.Unmarshal(content, &sealed); err != nil || sealed.Format != SealedBackupFormat {
+		return ParseBackup(content)
+	}
+
+	key := d.masterKey
+	if sealed.Key == sealedKeyMaster {
+		if key == nil {
+			return nil, DataError("The backup is encrypted with a master key, but the panel has none.")
+		}
+	} else {
+		if passphrase == "" {
+			return nil, DataError("The backup is encrypted; a passphrase is required.")
+		}
+		var err error
+		if key, err = seal.DeriveKey(passphrase, sealed.Salt); err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := seal.Open(key, sealed.Data)
+	if err != nil {
+		return nil, DataError("The backup cannot be decrypted; the key is wrong or the file is corrupted.")
+	}
+	return ParseBackup(content)
+}
+
+// ParseBackup decodes the content of a backup file.
+func ParseBackup(content []byte) (*Backup, error) {
+	var b Backup
+	if err := json.Unmarshal(content, &b); err != nil {
+		return nil, DataError(fmt.Sprintf("The backup cannot be parsed: %v", err))
+	}
+	return &b, nil
+}
+
+// clone returns a deep copy of the backup, so it can be migrated without touching the original.
+func (b *Backup) clone() (*Backup, error) {
+	content, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBackup(content)
+}
+
+// check validates the format of the backup and the versions of its tables.
+func (b *Backup) check() error {
+	if b.Format != BackupFormat {
+		return DataError("The file is not a backup.")
+	}
+	if b.Version < 1 || b.Version > BackupVersion {
+		return DataError(fmt.Sprintf("The backup version %d is not supported.", b.Version))
+	}
+	if _, found := b.Tables[TableSettings]; !found {
+		return DataError("The backup has no settings.")
+	}
+	// Without admins, the restored panel would be seeded with an owner whose password nobody knows.
+	if _, found := b.Tables[TableAdmins]; !found {
+		return DataError("The backup has no admins.")
+	}
+	for name, t := range b.Tables {
+		known := false
+		for _, table := range BackupTables {
+			known = known || table == name
+		}
+		if !known || t == nil {
+			return DataError(fmt.Sprintf("The backup has an unknown table %s.", name))
+		}
+		if t.Version > LatestVersion(name) {
+			return DataError(fmt.Sprintf(
+				"The %s table (version %d) is newer than this version supports (%d).", name, t.Version, LatestVersion(name),
+			))
+		}
+	}
+	return nil
+}
+
+// Backup copies the backup tables into a new backup.
+// The secrets are decrypted (see SealedStore); EncodeBackup encrypts the backup as a whole.
+func (d *Database) Backup() (*Backup, error) {
+	b := &Backup{
+		Format:     BackupFormat,
+		Version:    BackupVersion,
+		AppVersion: config.AppVersion,
+		CreatedAt:  time.Now().UnixMilli(),
+		Tables:     map[string]*BackupTable{},
+	}
+	if err := Copy(&backupStore{backup: b}, d.Store, BackupTables...); err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot back up the database, err: %v", err))
+	}
+	return b, nil
+}
+
+// Restore validates the backup and, unless it is a dry run, replaces the backup tables with it and reloads them.
+// The backup is migrated to the current schema versions and loaded into a separate database first,
+// so an invalid backup never touches the current data.
+// All the sessions are revoked, since the restored admins may differ from the current ones.
+func (d *Database) Restore(backup *Backup, dryRun bool) (*RestoreSummary, error) {
+	if err := backup.check(); err != nil {
+		return nil, err
+	}
+	b, err := backup.clone()
+	if err != nil {
+		return nil, err
+	}
+
+	store := &backupStore{backup: b}
+	summary := &RestoreSummary{AppVersion: b.AppVersion, CreatedAt: b.CreatedAt, Rows: map[string]int{}, DryRun: dryRun}
+	if summary.Migrated, err = Migrate(store); err != nil {
+		return nil, DataError(fmt.Sprintf("The backup cannot be migrated: %v", err))
+	}
+
+	restored := newDatabase(store, 0, 0)
+	if err = restored.load(); err != nil {
+		return nil, DataError(fmt.Sprintf("The backup cannot be loaded: %v", err))
+	}
+	if err = restored.check(); err != nil {
+		return nil, err
+	}
+	for _, table := range BackupTables {
+		if t, found := b.Tables[table]; found {
+			summary.Rows[table] = len(t.Rows)
+		}
+	}
+
+	if dryRun {
+		return summary, nil
+	}
+
+	if err = Copy(d.Store, store, BackupTables...); err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot restore the backup, err: %v", err))
+	}
+	if err = d.load(); err != nil {
+		return nil, err
+	}
+	if err = d.SessionTable.Revoke(func(_ Session) bool { return true }); err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+// check validates all the rows of the tables, which the loaders take as they are.
+func (d *Database) check() error {
+	v := validator.New()
+	invalid := func(id string, err error) error {
+		return DataError(fmt.Sprintf("The backup has an invalid row %s: %v", id, err))
+	}
+
+	if err := v.Struct(d.SettingTable.Get()); err != nil {
+		return invalid(TableSettings, err)
+	}
+
+	secrets := map[string]string{}
+	for _, k := range append(d.KeyTable.All(), d.KeyTable.Trash()...) {
+		if err := v.Struct(k); err != nil {
+			return invalid(k.Id, err)
+		}
+		if id, found := secrets[k.Secret]; found {
+			return DataError(fmt.Sprintf("The backup has keys %s and %s with the same secret.", id, k.Id))
+		}
+		secrets[k.Secret] = k.Id
+	}
+	for _, s := range append(d.ServerTable.All(), d.ServerTable.Trash()...) {
+		if err := v.Struct(s); err != nil {
+			return invalid(s.Id, err)
+		}
+	}
+
+	admins := d.AdminTable.All()
+	owners := make([]*Admin, 0, len(admins))
+	for i := range admins {
+		if err := v.Struct(admins[i]); err != nil {
+			return invalid(admins[i].Id, err)
+		}
+		owners = append(owners, &admins[i])
+	}
+	if err := checkOwners(owners); err != nil {
+		return err
+	}
+
+	for _, t := range d.TokenTable.All() {
+		if err := v.Struct(t); err != nil {
+			return invalid(t.Id, err)
+		}
+	}
+
+	return nil
+}
+
+// backupStore is a Store that keeps the tables in a backup (in memory).
+type backupStore struct {
+	backup *Backup
+}
+
+func (s *backupStore) Load(table string, meta interface{}, fn func(id string, row []byte) error) error {
+	t, found := s.backup.Tables[table]
+	if !found {
+		return ErrTableNotFound
+	}
+
+	if len(t.Meta) > 0 {
+		if err := json.Unmarshal(t.Meta, meta); err != nil {
+			return err
+		}
+	}
+
+	if fn != nil {
+		ids := make([]string, 0, len(t.Rows))
+		for id := range t.Rows {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			if err := fn(id, t.Rows[id]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *backupStore) Version(table string) (int, error) {
+	t, found := s.backup.Tables[table]
+	if !found {
+		return 0, ErrTableNotFound
+	}
+	return t.Version, nil
+}
+
+func (s *backupStore) Update(fn func(tx Tx) error) error {
+	tx := &backupTx{store: s, tables: map[string]*BackupTable{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for name, t := range tx.tables {
+		s.backup.Tables[name] = t
+	}
+	return nil
+}
+
+func (s *backupStore) Close() error {
+	return nil
+}
+
+// backupTx is a transaction of backupStore that works on copies of the touched tables.
+type backupTx struct {
+	store  *backupStore
+	tables map[string]*BackupTable
+}
+
+func (tx *backupTx) table(name string) *BackupTable {
+	if t, found := tx.tables[name]; found {
+		return t
+	}
+
+	t := &BackupTable{Rows: map[string]json.RawMessage{}}
+	if current, found := tx.store.backup.Tables[name]; found {
+		t.Version = current.Version
+		t.Meta = current.Meta
+		for id, row := range current.Rows {
+			t.Rows[id] = row
+		}
+	}
+
+	tx.tables[name] = t
+	return t
+}
+
+func (tx *backupTx) PutMeta(table string, meta interface{}) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tx.table(table).Meta = content
+	return nil
+}
+
+func (tx *backupTx) Put(table, id string, row interface{}) error {
+	content, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	tx.table(table).Rows[id] = content
+	return nil
+}
+
+func (tx *backupTx) Delete(table, id string) error {
+	delete(tx.table(table).Rows, id)
+	return nil
+}
+
+func (tx *backupTx) Truncate(table string) error {
+	tx.table(table).Rows = map[string]json.RawMessage{}
+	return nil
+}
+
+func (tx *backupTx) SetVersion(table string, version int) error {
+	tx.table(table).Version = version
+	return nil
+}
@@ -0,0 +1,114 @@
+package database
+
+import "time"
+
+const (
+	BillingCycleMonthly  = "monthly"
+	BillingCycleWeekly   = "weekly"
+	BillingCycleLifetime = "lifetime"
+)
+
+// DefaultBillingAnchor returns the start of the day of the given time (in milliseconds), in the local time zone.
+// Keys created on the same day share their cycles, so their usage is calculated together.
+func DefaultBillingAnchor(t int64) int64 {
+	y, m, d := time.UnixMilli(t).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local).UnixMilli()
+}
+
+// CycleStart returns the start of the billing cycle of the key that contains the given time.
+// Monthly cycles start on the day of the month of the anchor (or the last day of shorter months),
+// weekly cycles start every seven days since the anchor, and lifetime cycles start at the anchor and never end.
+func (k *Key) CycleStart(now time.Time) time.Time {
+	anchor := time.UnixMilli(k.BillingAnchor).In(now.Location())
+
+	switch k.BillingCycle {
+	case BillingCycleMonthly:
+		start := monthlyCycleStart(anchor, now.Year(), now.Month())
+		if start.After(now) {
+			start = monthlyCycleStart(anchor, now.Year(), now.Month()-1)
+		}
+		return start
+	case BillingCycleWeekly:
+		weeks := int(now.Sub(anchor) / (7 * 24 * time.Hour))
+		start := anchor.AddDate(0, 0, 7*weeks)
+		// Daylight saving changes might move the start by an hour around the week boundaries.
+		for start.After(now) {
+			start = start.AddDate(0, 0, -7)
+		}
+		for !start.AddDate(0, 0, 7).After(now) {
+			start = start.AddDate(0, 0, 7)
+		}
+		return start
+	default:
+		return anchor
+	}
+}
+
+// CycleEnd returns the end of the billing cycle of the key that contains the given time,
+// or the zero time if the cycle never ends.
+func (k *Key) CycleEnd(now time.Time) time.Time {
+	start := k.CycleStart(now)
+
+	switch k.BillingCycle {
+	case BillingCycleMonthly:
+		anchor := time.UnixMilli(k.BillingAnchor).In(now.Location())
+		return monthlyCycleStart(anchor, start.Year(), start.Month()+1)
+	case BillingCycleWeekly:
+		return start.AddDate(0, 0, 7)
+	default:
+		return time.Time{}
+	}
+}
+
+// UsageStart returns the time that the usage of the key is calculated since;
+// the start of the current billing cycle or the last usage reset, whichever is later.
+func (k *Key) UsageStart(now time.Time) time.Time {
+	start := k.CycleStart(now)
+	if reset := time.UnixMilli(k.UsageResetAt); k.UsageResetAt != 0 && reset.After(start) {
+		return reset
+	}
+	return start
+}
+
+// monthlyCycleStart returns the start of the monthly cycle with the given anchor in the given month.
+func monthlyCycleStart(anchor time.Time, year int, month time.Month) time.Time {
+	day := anchor.Day()
+	// The zeroth day of the next month is the last day of this month.
+	if last := time.Date(year, month+1, 0, 0, 0, 0, 0, anchor.Location()).Day(); day > last {
+		day = last
+	}
+	return time.Date(year, month, day, anchor.Hour(), anchor.Minute(), anchor.Second(), 0, anchor.Location())
+}
+
+const (
+	CapWindowDaily  = "daily"
+	CapWindowHourly = "hourly"
+)
+
+// CapWindowStart returns the start of the traffic cap window of the key that contains the given time;
+// the start of the day or hour (in the time zone of the given time).
+func (k *Key) CapWindowStart(now time.Time) time.Time {
+	y, m, d := now.Date()
+	if k.CapWindow == CapWindowHourly {
+		return time.Date(y, m, d, now.Hour(), 0, 0, 0, now.Location())
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+}
+
+// CapWindowEnd returns the end of the traffic cap window of the key that contains the given time.
+func (k *Key) CapWindowEnd(now time.Time) time.Time {
+	if k.CapWindow == CapWindowHourly {
+		return k.CapWindowStart(now).Add(time.Hour)
+	}
+	return k.CapWindowStart(now).AddDate(0, 0, 1)
+}
+
+// CapUsageStart returns the time that the usage of the key is calculated since for its traffic cap;
+// the start of the current cap window or the last usage reset, whichever is later.
+func (k *Key) CapUsageStart(now time.Time) time.Time {
+	start := k.CapWindowStart(now)
+	if reset := time.UnixMilli(k.UsageResetAt); k.UsageResetAt != 0 && reset.After(start) {
+		return reset
+	}
+	return start
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"strconv"
+	"time"
+)
+
+// boltMetaBucket is the bucket that holds the metadata records of all the tables.
+var boltMetaBucket = []byte("_meta")
+
+// boltVersionBucket is the bucket that holds the schema versions of all the tables.
+var boltVersionBucket = []byte("_versions")
+
+// BoltStore is a Store that keeps the tables in an embedded bbolt database.
+// Each table has its own bucket and rows are read and written individually.
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+func (s *BoltStore) Load(table string, meta interface{}, fn func(id string, row []byte) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		mb := tx.Bucket(boltMetaBucket)
+		if mb == nil {
+			return ErrTableNotFound
+		}
+		content := mb.Get([]byte(table))
+		if content == nil {
+			return ErrTableNotFound
+		}
+		if err := json.Unmarshal(content, meta); err != nil {
+			return err
+		}
+
+		b := tx.Bucket([]byte(table))
+		if b == nil || fn == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			row := make([]byte, len(v))
+			copy(row, v)
+			return fn(string(k), row)
+		})
+	})
+}
+
+func (s *BoltStore) Version(table string) (version int, err error) {
+	err = s.db.View(func(tx *bbolt.Tx) error {
+		if mb := tx.Bucket(boltMetaBucket); mb == nil || mb.Get([]byte(table)) == nil {
+			return ErrTableNotFound
+		}
+		if vb := tx.Bucket(boltVersionBucket); vb != nil {
+			if v := vb.Get([]byte(table)); v != nil {
+				version, err = strconv.Atoi(string(v))
+				return err
+			}
+		}
+		return nil
+	})
+	return version, err
+}
+
+func (s *BoltStore) Update(fn func(tx Tx) error) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// boltTx is a transaction of BoltStore.
+type boltTx struct {
+	tx *bbolt.Tx
+}
+
+func (t *boltTx) PutMeta(table string, meta interface{}) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	b, err := t.tx.CreateBucketIfNotExists(boltMetaBucket)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(table), content)
+}
+
+func (t *boltTx) Put(table, id string, row interface{}) error {
+	content, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	b, err := t.tx.CreateBucketIfNotExists([]byte(table))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(id), content)
+}
+
+func (t *boltTx) Delete(table, id string) error {
+	if b := t.tx.Bucket([]byte(table)); b != nil {
+		return b.Delete([]byte(id))
+	}
+	return nil
+}
+
+func (t *boltTx) SetVersion(table string, version int) error {
+	b, err := t.tx.CreateBucketIfNotExists(boltVersionBucket)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(table), []byte(strconv.Itoa(version)))
+}
+
+func (t *boltTx) Truncate(table string) error {
+	if err := t.tx.DeleteBucket([]byte(table)); err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+		return err
+	}
+	return nil
+}
+
+// NewBoltStore opens (or creates) the bbolt database file at the given path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot open %s, err: %v", path, err))
+	}
+	return &BoltStore{db: db}, nil
+}
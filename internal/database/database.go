@@ -1,42 +1,206 @@
 package database
 
+import (
+	"errors"
+	"fmt"
+	"github.com/miladrahimi/shadowsocks/internal/config"
+	"path/filepath"
+	"time"
+)
+
+const Directory = "storage/database"
+
+const (
+	DriverJson = "json"
+	DriverBolt = "bolt"
+)
+
 type Database struct {
+	Store        Store
+	Recovered    []string
+	Migrated     []string
+	Sealed       []string
+	Archived     []string
 	SettingTable *SettingTable
 	KeyTable     *KeyTable
 	ServerTable  *ServerTable
+	UsageTable   *UsageTable
+	AdminTable   *AdminTable
+	SessionTable *SessionTable
+	TokenTable   *TokenTable
+	AuditTable   *AuditTable
+	masterKey    []byte
+}
+
+// Close closes the underlying store.
+func (d *Database) Close() error {
+	return d.Store.Close()
+}
+
+// newStore opens the store of the configured driver.
+// A new bolt store is seeded with the existing JSON tables, if there are any.
+// The imported JSON files are archived (see JsonStore.Archive) and their new paths are returned;
+// they are outdated copies that may hold the secrets in plaintext, so they are kept only for rollbacks.
+func newStore(driver string) (Store, []string, error) {
+	switch driver {
+	case "", DriverJson:
+		store, err := NewJsonStore(Directory)
+		return store, nil, err
+	case DriverBolt:
+		legacy, err := NewJsonStore(Directory)
+		if err != nil {
+			return nil, nil, err
+		}
+		store, err := NewBoltStore(filepath.Join(Directory, "database.db"))
+		if err != nil {
+			return nil, nil, err
+		}
+		var archived []string
+		tables := []string{TableSettings, TableKeys, TableServers, TableUsage, TableAdmins, TableSessions, TableTokens, TableAudit}
+		var meta struct{}
+		if err = store.Load(TableSettings, &meta, nil); errors.Is(err, ErrTableNotFound) {
+			if err = Copy(store, legacy, tables...); err == nil {
+				archived, err = legacy.Archive(tables...)
+			}
+		}
+		if err != nil {
+			_ = store.Close()
+			return nil, nil, errors.New(fmt.Sprintf("cannot import json tables, err: %v", err))
+		}
+		return store, archived, nil
+	default:
+		return nil, nil, errors.New(fmt.Sprintf("unknown database driver %s", driver))
+	}
 }
 
-func New() (*Database, error) {
-	db := &Database{
+// newDatabase creates the tables on the given store without loading them.
+func newDatabase(store Store, auditRetention, usageRetention time.Duration) *Database {
+	return &Database{
+		Store: store,
 		SettingTable: &SettingTable{
-			AdminPassword:      "password",
-			ApiToken:           "api-token-secret",
-			ShadowsocksHost:    "127.0.0.1",
-			ShadowsocksPort:    1,
-			ShadowsocksEnabled: true,
-			ExternalHttps:      "",
-			ExternalHttp:       "http://localhost",
-			TrafficRatio:       1,
+			settings: Settings{
+				AdminPassword:      "password",
+				ApiToken:           "api-token-secret",
+				ShadowsocksHost:    "127.0.0.1",
+				ShadowsocksPort:    1,
+				ShadowsocksEnabled: true,
+				ExternalHttps:      "",
+				ExternalHttp:       "http://localhost",
+				TrafficRatio:       1,
+			},
+			store: store,
 		},
 		KeyTable: &KeyTable{
-			Keys:   []*Key{},
-			NextId: 1,
+			keys:   []*Key{},
+			nextId: 1,
+			store:  store,
 		},
 		ServerTable: &ServerTable{
-			Servers: []*Server{},
-			NextId:  1,
+			servers: []*Server{},
+			nextId:  1,
+			store:   store,
+		},
+		UsageTable: &UsageTable{
+			usages:    map[string]*Usage{},
+			subjects:  map[string][]*Usage{},
+			totals:    map[string]*Usage{},
+			retention: usageRetention,
+			store:     store,
+		},
+		AdminTable: &AdminTable{
+			admins: []*Admin{},
+			nextId: 1,
+			store:  store,
+		},
+		SessionTable: &SessionTable{
+			sessions: []*Session{},
+			store:    store,
+		},
+		TokenTable: &TokenTable{
+			tokens: []*Token{},
+			nextId: 1,
+			store:  store,
+		},
+		AuditTable: &AuditTable{
+			entries:   []*AuditEntry{},
+			nextId:    1,
+			retention: auditRetention,
+			store:     store,
 		},
 	}
+}
 
-	if err := db.SettingTable.Load(); err != nil {
+func New(c *config.Config) (*Database, error) {
+	key, err := MasterKey(c.Database.MasterKeyFile)
+	if err != nil {
 		return nil, err
 	}
-	if err := db.KeyTable.Load(); err != nil {
+	raw, archived, err := newStore(c.Database.Driver)
+	if err != nil {
 		return nil, err
 	}
-	if err := db.ServerTable.Load(); err != nil {
+	store := NewSealedStore(raw, key)
+
+	db := newDatabase(
+		store,
+		time.Duration(c.Audit.Retention)*24*time.Hour,
+		time.Duration(c.Usage.Retention)*24*time.Hour,
+	)
+	db.masterKey = key
+	db.Archived = archived
+
+	if db.Migrated, err = Migrate(store); err == nil {
+		err = db.load()
+	}
+	if err == nil {
+		if db.Sealed = store.Plain(); len(db.Sealed) > 0 {
+			err = store.reseal(db.Sealed...)
+		}
+	}
+	if err != nil {
+		_ = store.Close()
 		return nil, err
 	}
 
+	if js, ok := raw.(*JsonStore); ok {
+		db.Recovered = js.Recovered()
+	}
+
 	return db, nil
 }
+
+// load loads all the tables from the store.
+func (d *Database) load() error {
+	loaders := []func() error{
+		d.SettingTable.Load,
+		d.KeyTable.Load,
+		d.ServerTable.Load,
+		d.UsageTable.Load,
+		d.loadAdmins,
+		d.SessionTable.Load,
+		d.TokenTable.Load,
+		d.AuditTable.Load,
+	}
+	for _, load := range loaders {
+		if err := load(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadAdmins loads the admins; the first owner account is created with the legacy admin password,
+// which is then removed from the settings, so no plaintext password is kept.
+func (d *Database) loadAdmins() error {
+	password := d.SettingTable.Get().AdminPassword
+	if err := d.AdminTable.Load(password); err != nil {
+		return err
+	}
+	if password != "" {
+		_, err := d.SettingTable.Modify(func(s *Settings) {
+			s.AdminPassword = ""
+		})
+		return err
+	}
+	return nil
+}
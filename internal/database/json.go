@@ -0,0 +1,585 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/miladrahimi/shadowsocks/pkg/utils"
+	"golang.org/x/exp/slices"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// jsonFileMode is the permissions of the table files, which only the owner can read since they hold secrets.
+const jsonFileMode = 0600
+
+// jsonVersionField is the field of the JSON files that holds the schema version of the table.
+const jsonVersionField = "schema_version"
+
+// jsonGenerationField is the field of the JSON files that holds the generation of the journal of the table.
+const jsonGenerationField = "journal_generation"
+
+// jsonJournalLimit is the number of the journaled changes of a table that trigger rewriting its file.
+const jsonJournalLimit = 1000
+
+// jsonJournalTables are the tables that mostly grow or change a few rows at a time (like the audit log and
+// the usage rollups), so their changes are appended to journal files instead of rewriting the table files each time.
+// The journals are compacted into the table files every jsonJournalLimit changes.
+var jsonJournalTables = map[string]bool{
+	TableAudit: true,
+	TableUsage: true,
+}
+
+// jsonRowFields maps the tables to the fields of their JSON files that hold the rows.
+// Tables without rows (like settings) are stored as a single object.
+var jsonRowFields = map[string]string{
+	TableSettings: "",
+	TableKeys:     "keys",
+	TableServers:  "servers",
+}
+
+// jsonLegacyRowFields maps the tables to the fields that held their rows before the given schema versions.
+// Their migrations rewrite the tables, so the rows are moved to the current fields.
+var jsonLegacyRowFields = map[string]struct {
+	Field   string
+	Version int
+}{
+	TableServers: {Field: "keys", Version: 1},
+}
+
+// JsonStore is a Store that keeps each table in a JSON file.
+// Changes are atomic per table only; a transaction touching several tables writes several files one by one,
+// so a crash (or a failed write) in the middle of it leaves the tables written before it committed.
+// Changes that must be atomic across tables need the bolt driver.
+// Each file is replaced via a temporary file and its previous generation is kept as a backup.
+// The changes of the journal tables are appended to their journal files (see jsonJournalTables).
+type JsonStore struct {
+	directory string
+	documents map[string]*jsonDocument
+	recovered []string
+	mutex     sync.Mutex
+}
+
+// jsonDocument is the in-memory representation of a table file (and its journal).
+// The generation of a journal table changes each time its file is rewritten,
+// so the journaled changes that are already in the file are never applied again.
+type jsonDocument struct {
+	version    int
+	generation int64
+	journaled  int
+	meta       map[string]json.RawMessage
+	ids        []string
+	rows       map[string]json.RawMessage
+}
+
+func (d *jsonDocument) clone() *jsonDocument {
+	c := &jsonDocument{
+		version:    d.version,
+		generation: d.generation,
+		journaled:  d.journaled,
+		meta:       make(map[string]json.RawMessage, len(d.meta)),
+		ids:        slices.Clone(d.ids),
+		rows:       make(map[string]json.RawMessage, len(d.rows)),
+	}
+	for k, v := range d.meta {
+		c.meta[k] = v
+	}
+	for k, v := range d.rows {
+		c.rows[k] = v
+	}
+	return c
+}
+
+// put adds or replaces the row with the given ID.
+func (d *jsonDocument) put(id string, row json.RawMessage) {
+	if _, found := d.rows[id]; !found {
+		d.ids = append(d.ids, id)
+	}
+	d.rows[id] = row
+}
+
+// delete removes the row with the given ID.
+func (d *jsonDocument) delete(id string) {
+	if i := slices.Index(d.ids, id); i != -1 {
+		d.ids = slices.Delete(d.ids, i, i+1)
+	}
+	delete(d.rows, id)
+}
+
+// jsonJournalEntry is a line of a journal file; the changes of a transaction on the table, in order.
+type jsonJournalEntry struct {
+	Generation int64                      `json:"generation"`
+	Version    int                        `json:"version"`
+	Meta       map[string]json.RawMessage `json:"meta"`
+	Rows       []jsonJournalRow           `json:"rows"`
+}
+
+// jsonJournalRow is a put row, or a deleted one if it has no content.
+type jsonJournalRow struct {
+	Id      string          `json:"id"`
+	Content json.RawMessage `json:"content,omitempty"`
+}
+
+func (s *JsonStore) path(table string) string {
+	return filepath.Join(s.directory, table+".json")
+}
+
+func (s *JsonStore) journalPath(table string) string {
+	return s.path(table) + ".journal"
+}
+
+// rowField returns the field of the table file in the given schema version that holds the rows.
+func (s *JsonStore) rowField(table string, version int) string {
+	if legacy, found := jsonLegacyRowFields[table]; found && version < legacy.Version {
+		return legacy.Field
+	}
+	if field, found := jsonRowFields[table]; found {
+		return field
+	}
+	return table
+}
+
+// document returns the cached document of the table or reads it from the disk.
+// A corrupted table file is replaced by its last good generation.
+func (s *JsonStore) document(table string) (*jsonDocument, error) {
+	if d, found := s.documents[table]; found {
+		return d, nil
+	}
+
+	content, err := os.ReadFile(s.path(table))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrTableNotFound
+		}
+		return nil, err
+	}
+
+	d, err := s.decode(table, content)
+	if err != nil {
+		backup, bErr := os.ReadFile(utils.BackupPath(s.path(table)))
+		if bErr != nil {
+			return nil, err
+		}
+		if d, bErr = s.decode(table, backup); bErr != nil {
+			return nil, err
+		}
+		if bErr = utils.AtomicWriteFile(s.path(table), backup, jsonFileMode); bErr != nil {
+			return nil, errors.New(fmt.Sprintf("cannot restore %s, err: %v", s.path(table), bErr))
+		}
+		s.recovered = append(s.recovered, table)
+	}
+
+	if jsonJournalTables[table] {
+		if err = s.replay(table, d); err != nil {
+			return nil, err
+		}
+	}
+
+	s.documents[table] = d
+	return d, nil
+}
+
+// replay applies the changes in the journal of the table to its document.
+// The lines of the other generations are skipped, and so are the torn ones (e.g., by a crash while writing),
+// in which case the next change rewrites the table file and starts a new journal.
+func (s *JsonStore) replay(table string, d *jsonDocument) error {
+	content, err := os.ReadFile(s.journalPath(table))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry jsonJournalEntry
+		if err = json.Unmarshal(line, &entry); err != nil {
+			d.journaled = jsonJournalLimit
+			continue
+		}
+		if entry.Generation != d.generation {
+			continue
+		}
+		d.version = entry.Version
+		d.meta = entry.Meta
+		for _, r := range entry.Rows {
+			if r.Content == nil {
+				d.delete(r.Id)
+			} else {
+				d.put(r.Id, r.Content)
+			}
+		}
+		if d.journaled < jsonJournalLimit {
+			d.journaled++
+		}
+	}
+	return nil
+}
+
+// journal appends the entry to the journal of the table and flushes it to the disk.
+func (s *JsonStore) journal(table string, entry *jsonJournalEntry) (err error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.journalPath(table), os.O_WRONLY|os.O_CREATE|os.O_APPEND, jsonFileMode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cErr := file.Close(); err == nil {
+			err = cErr
+		}
+	}()
+
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// decode parses the content of a table file.
+func (s *JsonStore) decode(table string, content []byte) (*jsonDocument, error) {
+	d := &jsonDocument{meta: map[string]json.RawMessage{}, rows: map[string]json.RawMessage{}}
+	if err := json.Unmarshal(content, &d.meta); err != nil {
+		return nil, err
+	}
+
+	if raw, found := d.meta[jsonVersionField]; found {
+		if err := json.Unmarshal(raw, &d.version); err != nil {
+			return nil, err
+		}
+		delete(d.meta, jsonVersionField)
+	}
+
+	if raw, found := d.meta[jsonGenerationField]; found {
+		if err := json.Unmarshal(raw, &d.generation); err != nil {
+			return nil, err
+		}
+		delete(d.meta, jsonGenerationField)
+	}
+
+	if field := s.rowField(table, d.version); field != "" {
+		var rows []json.RawMessage
+		if raw, found := d.meta[field]; found {
+			if err := json.Unmarshal(raw, &rows); err != nil {
+				return nil, err
+			}
+			delete(d.meta, field)
+		}
+		for _, row := range rows {
+			var r struct {
+				Id string `json:"id"`
+			}
+			if err := json.Unmarshal(row, &r); err != nil {
+				return nil, err
+			}
+			d.put(r.Id, row)
+		}
+	}
+
+	return d, nil
+}
+
+// Recovered returns the tables that were corrupted and restored from their last good generations.
+func (s *JsonStore) Recovered() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return slices.Clone(s.recovered)
+}
+
+func (s *JsonStore) Load(table string, meta interface{}, fn func(id string, row []byte) error) error {
+	s.mutex.Lock()
+	d, err := s.document(table)
+	if err == nil {
+		d = d.clone()
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(d.meta)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(content, meta); err != nil {
+		return err
+	}
+
+	if fn != nil {
+		for _, id := range d.ids {
+			if err = fn(id, d.rows[id]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *JsonStore) Version(table string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	d, err := s.document(table)
+	if err != nil {
+		return 0, err
+	}
+	return d.version, nil
+}
+
+func (s *JsonStore) Update(fn func(tx Tx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx := &jsonTx{
+		store:     s,
+		documents: map[string]*jsonDocument{},
+		journals:  map[string]*jsonJournalEntry{},
+		rewrites:  map[string]bool{},
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	for table, d := range tx.documents {
+		if entry, found := tx.journals[table]; found && !tx.rewrites[table] && d.journaled < jsonJournalLimit {
+			entry.Generation, entry.Version, entry.Meta = d.generation, d.version, d.meta
+			if err := s.journal(table, entry); err != nil {
+				return errors.New(fmt.Sprintf("cannot save %s, err: %v", s.journalPath(table), err))
+			}
+			d.journaled++
+			s.documents[table] = d
+			continue
+		}
+
+		if jsonJournalTables[table] {
+			d.generation++
+			d.journaled = 0
+		}
+		content, err := s.encode(table, d)
+		if err != nil {
+			return err
+		}
+		if err = utils.SafeWriteFile(s.path(table), content, jsonFileMode); err != nil {
+			return errors.New(fmt.Sprintf("cannot save %s, err: %v", s.path(table), err))
+		}
+		// The journal is in the table file now; it is skipped anyway if the removal fails.
+		if jsonJournalTables[table] {
+			_ = os.Remove(s.journalPath(table))
+		}
+		s.documents[table] = d
+	}
+
+	return nil
+}
+
+// encode builds the content of the table file from the document.
+func (s *JsonStore) encode(table string, d *jsonDocument) ([]byte, error) {
+	content := make(map[string]json.RawMessage, len(d.meta)+2)
+	for k, v := range d.meta {
+		content[k] = v
+	}
+
+	if d.version > 0 {
+		content[jsonVersionField] = json.RawMessage(strconv.Itoa(d.version))
+	}
+	if d.generation > 0 {
+		content[jsonGenerationField] = json.RawMessage(strconv.FormatInt(d.generation, 10))
+	}
+
+	if field := s.rowField(table, d.version); field != "" {
+		rows := make([]json.RawMessage, 0, len(d.ids))
+		for _, id := range d.ids {
+			rows = append(rows, d.rows[id])
+		}
+		raw, err := json.Marshal(rows)
+		if err != nil {
+			return nil, err
+		}
+		content[field] = raw
+	}
+
+	return json.Marshal(content)
+}
+
+// Archive renames the files of the tables, along with their last good generations and journals,
+// to MigratedPath, so the store no longer finds them but they can be restored by hand.
+// It returns the new paths of the files.
+func (s *JsonStore) Archive(tables ...string) (paths []string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, table := range tables {
+		for _, path := range []string{s.path(table), utils.BackupPath(s.path(table)), s.journalPath(table)} {
+			if err = os.Rename(path, MigratedPath(path)); err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				return paths, err
+			}
+			paths = append(paths, MigratedPath(path))
+		}
+		delete(s.documents, table)
+	}
+	return paths, nil
+}
+
+// MigratedPath returns the path that a file of a table imported into another store is archived at.
+func MigratedPath(path string) string {
+	return path + ".migrated"
+}
+
+// PurgeMigrated deletes the archived files of the tables imported into another store from the directory.
+// It returns the paths of the deleted files.
+func PurgeMigrated(directory string) ([]string, error) {
+	paths, err := filepath.Glob(MigratedPath(filepath.Join(directory, "*")))
+	if err != nil {
+		return nil, err
+	}
+	for i, path := range paths {
+		if err = os.Remove(path); err != nil {
+			return paths[:i], err
+		}
+	}
+	return paths, nil
+}
+
+func (s *JsonStore) Close() error {
+	return nil
+}
+
+// jsonTx is a transaction of JsonStore that works on copies of the touched documents.
+// It also collects the row changes of the journal tables, unless their files must be rewritten
+// (they are new or truncated).
+type jsonTx struct {
+	store     *JsonStore
+	documents map[string]*jsonDocument
+	journals  map[string]*jsonJournalEntry
+	rewrites  map[string]bool
+}
+
+func (tx *jsonTx) document(table string) (*jsonDocument, error) {
+	if d, found := tx.documents[table]; found {
+		return d, nil
+	}
+
+	d, err := tx.store.document(table)
+	if errors.Is(err, ErrTableNotFound) {
+		d = &jsonDocument{meta: map[string]json.RawMessage{}, rows: map[string]json.RawMessage{}}
+		tx.rewrites[table] = true
+	} else if err != nil {
+		return nil, err
+	} else {
+		d = d.clone()
+	}
+
+	tx.documents[table] = d
+	if jsonJournalTables[table] {
+		tx.journals[table] = &jsonJournalEntry{}
+	}
+	return d, nil
+}
+
+// record adds the row change to the journal entry of the table, if it is a journal table.
+func (tx *jsonTx) record(table, id string, content json.RawMessage) {
+	if entry, found := tx.journals[table]; found {
+		entry.Rows = append(entry.Rows, jsonJournalRow{Id: id, Content: content})
+	}
+}
+
+func (tx *jsonTx) PutMeta(table string, meta interface{}) error {
+	d, err := tx.document(table)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	d.meta = map[string]json.RawMessage{}
+	return json.Unmarshal(content, &d.meta)
+}
+
+func (tx *jsonTx) Put(table, id string, row interface{}) error {
+	d, err := tx.document(table)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+
+	d.put(id, content)
+	tx.record(table, id, content)
+
+	return nil
+}
+
+func (tx *jsonTx) Delete(table, id string) error {
+	d, err := tx.document(table)
+	if err != nil {
+		return err
+	}
+
+	d.delete(id)
+	tx.record(table, id, nil)
+
+	return nil
+}
+
+func (tx *jsonTx) Truncate(table string) error {
+	d, err := tx.document(table)
+	if err != nil {
+		return err
+	}
+
+	d.ids = nil
+	d.rows = map[string]json.RawMessage{}
+	tx.rewrites[table] = true
+
+	return nil
+}
+
+func (tx *jsonTx) SetVersion(table string, version int) error {
+	d, err := tx.document(table)
+	if err != nil {
+		return err
+	}
+
+	d.version = version
+
+	return nil
+}
+
+// NewJsonStore creates an instance of JsonStore that keeps the tables in the given directory.
+func NewJsonStore(directory string) (*JsonStore, error) {
+	if !utils.DirectoryExist(directory) {
+		return nil, errors.New(fmt.Sprintf("directory %s not found", directory))
+	}
+
+	// The files written by the older versions are readable by everyone.
+	paths, err := filepath.Glob(filepath.Join(directory, "*.json*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		if err = os.Chmod(path, jsonFileMode); err != nil {
+			return nil, errors.New(fmt.Sprintf("cannot restrict the permissions of %s, err: %v", path, err))
+		}
+	}
+
+	return &JsonStore{directory: directory, documents: map[string]*jsonDocument{}}, nil
+}
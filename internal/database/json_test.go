@@ -0,0 +1,154 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func appendAuditRows(t *testing.T, store *JsonStore, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		err := store.Update(func(tx Tx) error {
+			if i > 0 {
+				if err := tx.Delete(TableAudit, fmt.Sprintf("e-%d", i-1)); err != nil {
+					return err
+				}
+			}
+			if err := tx.Put(TableAudit, fmt.Sprintf("e-%d", i), AuditEntry{Id: fmt.Sprintf("e-%d", i)}); err != nil {
+				return err
+			}
+			return tx.PutMeta(TableAudit, auditTableMeta{NextId: int64(i + 1)})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func loadAuditRows(t *testing.T, directory string) (auditTableMeta, []string) {
+	t.Helper()
+	store, err := NewJsonStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta auditTableMeta
+	var ids []string
+	err = store.Load(TableAudit, &meta, func(id string, _ []byte) error {
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta, ids
+}
+
+func TestJsonStoreJournal(t *testing.T) {
+	directory := t.TempDir()
+	store, err := NewJsonStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first change creates the table file; the next ones only append to the journal.
+	appendAuditRows(t, store, 0, 1)
+	created, err := os.ReadFile(store.path(TableAudit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAuditRows(t, store, 1, 10)
+	if content, _ := os.ReadFile(store.path(TableAudit)); string(content) != string(created) {
+		t.Errorf("the table file was rewritten for journaled changes")
+	}
+
+	meta, ids := loadAuditRows(t, directory)
+	if meta.NextId != 10 || len(ids) != 1 || ids[0] != "e-9" {
+		t.Fatalf("replayed next ID %d and rows %v, want 10 and [e-9]", meta.NextId, ids)
+	}
+
+	// A torn line is skipped, and the next change compacts the journal into the table file.
+	file, err := os.OpenFile(store.journalPath(TableAudit), os.O_WRONLY|os.O_APPEND, jsonFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.WriteString(`{"generation": 1, "rows": [{"id": "e-`); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	store, err = NewJsonStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAuditRows(t, store, 10, 11)
+	if _, err = os.Stat(store.journalPath(TableAudit)); !os.IsNotExist(err) {
+		t.Errorf("the journal with a torn line was kept, err: %v", err)
+	}
+	meta, ids = loadAuditRows(t, directory)
+	if meta.NextId != 11 || len(ids) != 1 || ids[0] != "e-10" {
+		t.Fatalf("compacted next ID %d and rows %v, want 11 and [e-10]", meta.NextId, ids)
+	}
+
+	// The journal is compacted into the table file every jsonJournalLimit changes.
+	appendAuditRows(t, store, 11, 12+jsonJournalLimit)
+	meta, ids = loadAuditRows(t, directory)
+	if want := int64(12 + jsonJournalLimit); meta.NextId != want || len(ids) != 1 {
+		t.Fatalf("next ID %d and rows %v, want %d and a single row", meta.NextId, ids, want)
+	}
+	if d, _ := store.document(TableAudit); d.journaled >= jsonJournalLimit {
+		t.Errorf("%d journaled changes, want fewer than %d", d.journaled, jsonJournalLimit)
+	}
+}
+
+func TestJsonStoreArchive(t *testing.T) {
+	directory := t.TempDir()
+	store, err := NewJsonStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAuditRows(t, store, 0, 3)
+
+	paths, err := store.Archive(TableAudit, TableKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("archived %v, want the table file and its journal", paths)
+	}
+	for _, path := range paths {
+		if _, err = os.Stat(path); err != nil {
+			t.Errorf("the archived file is missing, err: %v", err)
+		}
+	}
+
+	// The store no longer finds the archived table, but renaming the files back restores it.
+	if err = store.Load(TableAudit, &auditTableMeta{}, nil); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("loading the archived table, err: %v, want %v", err, ErrTableNotFound)
+	}
+	for _, path := range paths {
+		if err = os.Rename(path, strings.TrimSuffix(path, ".migrated")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if meta, ids := loadAuditRows(t, directory); meta.NextId != 3 || len(ids) != 1 {
+		t.Errorf("restored next ID %d and rows %v, want 3 and a single row", meta.NextId, ids)
+	}
+
+	if paths, err = store.Archive(TableAudit); err != nil {
+		t.Fatal(err)
+	}
+	purged, err := PurgeMigrated(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != len(paths) {
+		t.Errorf("purged %v, want %v", purged, paths)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(directory, "*.migrated")); len(matches) != 0 {
+		t.Errorf("the archived files %v are left", matches)
+	}
+}
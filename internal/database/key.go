@@ -7,202 +7,699 @@ import (
 	"github.com/go-playground/validator"
 	"github.com/labstack/gommon/random"
 	"github.com/miladrahimi/shadowsocks/pkg/utils"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
-	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-const KeyPath = "storage/database/keys.json"
+const (
+	KeyStatusActive        = "active"
+	KeyStatusQuotaExceeded = "quota_exceeded"
+	KeyStatusCapExceeded   = "cap_exceeded"
+	KeyStatusExpired       = "expired"
+	KeyStatusSuspended     = "suspended"
+)
+
+const (
+	KeyPlacementAuto   = "auto"
+	KeyPlacementManual = "manual"
+)
 
 type Key struct {
-	Id        string `json:"id" validate:"required,hostname"`
-	Code      string `json:"code" validate:"required"`
-	Cipher    string `json:"cipher" validate:"required,oneof=chacha20-ietf-poly1305 aes-128-gcm aes-256-gcm"`
-	Secret    string `json:"secret" validate:"required,min=6,max=64"`
-	Name      string `json:"name" validate:"required,min=1,max=64"`
-	Quota     int64  `json:"quota" validate:"min=0"`
-	CreatedAt int64  `json:"created_at"`
-	Enabled   bool   `json:"enabled"`
+	Id              string            `json:"id" validate:"required,hostname"`
+	Code            string            `json:"code" validate:"required"`
+	Cipher          string            `json:"cipher" validate:"required,oneof=chacha20-ietf-poly1305 aes-128-gcm aes-256-gcm"`
+	Secret          string            `json:"secret" validate:"required,min=6,max=64"`
+	Name            string            `json:"name" validate:"required,min=1,max=64"`
+	Tags            []string          `json:"tags" validate:"max=32,dive,min=1,max=32"`
+	Group           string            `json:"group" validate:"max=64"`
+	Metadata        map[string]string `json:"metadata" validate:"max=32,dive,keys,min=1,max=64,endkeys,max=256"`
+	Placement       string            `json:"placement" validate:"omitempty,oneof=auto manual"`
+	Servers         []string          `json:"servers" validate:"max=64,dive,required"`
+	Regions         []string          `json:"regions" validate:"max=64,dive,required"`
+	Quotas          Quotas            `json:"quotas"`
+	Cap             utils.Bytes       `json:"cap" validate:"min=0"`
+	CapWindow       string            `json:"cap_window" validate:"omitempty,oneof=daily hourly"`
+	CreatedAt       int64             `json:"created_at"`
+	Enabled         bool              `json:"enabled"`
+	Status          string            `json:"status" validate:"required,oneof=active quota_exceeded cap_exceeded expired suspended"`
+	StatusReason    string            `json:"status_reason"`
+	StatusChangedAt int64             `json:"status_changed_at" validate:"min=0"`
+	ExpiresAt       int64             `json:"expires_at" validate:"min=0"`
+	ExpiresAfter    int64             `json:"expires_after" validate:"min=0"`
+	FirstUsedAt     int64             `json:"first_used_at" validate:"min=0"`
+	BillingCycle    string            `json:"billing_cycle" validate:"required,oneof=monthly weekly lifetime"`
+	BillingAnchor   int64             `json:"billing_anchor" validate:"required,min=1"`
+	UsageResetAt    int64             `json:"usage_reset_at" validate:"min=0"`
+	UsageResets     []UsageReset      `json:"usage_resets"`
+	DeletedAt       int64             `json:"deleted_at" validate:"min=0"`
 }
 
-type KeyTable struct {
-	Keys      []*Key `json:"keys" validate:"required"`
-	NextId    int64  `json:"next_id" validate:"required,min=1"`
-	UpdatedAt int64  `json:"updated_at" validate:"min=0"`
+// Quotas are the limits of the traffic of a key in each billing cycle; zero means unlimited.
+type Quotas struct {
+	Total    utils.Bytes `json:"total" validate:"min=0"`
+	Download utils.Bytes `json:"download" validate:"min=0"`
+	Upload   utils.Bytes `json:"upload" validate:"min=0"`
+	Tcp      utils.Bytes `json:"tcp" validate:"min=0"`
+	Udp      utils.Bytes `json:"udp" validate:"min=0"`
 }
 
-func (kt *KeyTable) Load() error {
-	content, err := os.ReadFile(KeyPath)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			if !utils.DirectoryExist(filepath.Dir(SettingPath)) {
-				return errors.New(fmt.Sprintf("directory %s not found", filepath.Base(KeyPath)))
-			}
-			return kt.Save()
+// setEnabled activates or suspends the key on behalf of the admin; otherwise, the status remains the same.
+func (k *Key) setEnabled(enabled bool) {
+	if enabled && !k.Enabled {
+		k.SetStatus(KeyStatusActive, "Enabled by the admin.")
+	} else if !enabled && k.Enabled {
+		k.SetStatus(KeyStatusSuspended, "Suspended by the admin.")
+	}
+}
+
+// AllowsServer checks if the key may be served by the given server;
+// keys without allowed servers and regions are served by all the servers.
+// The keys with automatic placement are served only by their placed servers,
+// their regions only narrow down the servers they can be placed onto.
+func (k *Key) AllowsServer(s *Server) bool {
+	if len(k.Servers) == 0 && len(k.Regions) == 0 {
+		return true
+	}
+	if k.Placement == KeyPlacementAuto {
+		return slices.Contains(k.Servers, s.Id)
+	}
+	return slices.Contains(k.Servers, s.Id) || (s.Region != "" && slices.Contains(k.Regions, s.Region))
+}
+
+// HasTag checks if the key has the given tag.
+func (k *Key) HasTag(tag string) bool {
+	return slices.Contains(k.Tags, tag)
+}
+
+// normalizeTags trims the tags and removes the empty and duplicate ones.
+func normalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t = strings.TrimSpace(t); t != "" && !slices.Contains(normalized, t) {
+			normalized = append(normalized, t)
 		}
-		return errors.New(fmt.Sprintf("cannot load %s, err: %v", KeyPath, err))
 	}
+	return normalized
+}
 
-	err = json.Unmarshal(content, kt)
-	if err != nil {
-		return err
+// KeyFilter selects keys by their tags, group, metadata, placement, servers, and regions;
+// empty criteria match all the keys.
+type KeyFilter struct {
+	Tags      []string          `json:"tags"`
+	Group     string            `json:"group"`
+	Metadata  map[string]string `json:"metadata"`
+	Placement string            `json:"placement" validate:"omitempty,oneof=auto manual"`
+	Servers   []string          `json:"servers" validate:"max=64,dive,required"`
+	Regions   []string          `json:"regions" validate:"max=64,dive,required"`
+}
+
+// IsEmpty checks if the filter has no criteria.
+func (f *KeyFilter) IsEmpty() bool {
+	return len(f.Tags) == 0 && f.Group == "" && len(f.Metadata) == 0 &&
+		f.Placement == "" && len(f.Servers) == 0 && len(f.Regions) == 0
+}
+
+// Match checks if the key has all the tags, the group, all the metadata, the placement,
+// all the servers, and all the regions of the filter. Keys without a placement are placed manually.
+func (f *KeyFilter) Match(k *Key) bool {
+	for _, t := range f.Tags {
+		if !k.HasTag(t) {
+			return false
+		}
+	}
+	if f.Group != "" && k.Group != f.Group {
+		return false
+	}
+	for name, value := range f.Metadata {
+		if v, found := k.Metadata[name]; !found || v != value {
+			return false
+		}
+	}
+	if f.Placement == KeyPlacementAuto && k.Placement != KeyPlacementAuto {
+		return false
+	}
+	if f.Placement == KeyPlacementManual && k.Placement == KeyPlacementAuto {
+		return false
+	}
+	for _, s := range f.Servers {
+		if !slices.Contains(k.Servers, s) {
+			return false
+		}
+	}
+	for _, r := range f.Regions {
+		if !slices.Contains(k.Regions, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// UsageReset is a record of resetting the usage of a key.
+type UsageReset struct {
+	At   int64 `json:"at"`
+	Used int64 `json:"used"`
+}
+
+// ResetUsage starts counting the usage of the key from now on and records the usage (in bytes) before the reset.
+func (k *Key) ResetUsage(used int64) {
+	k.UsageResetAt = time.Now().UnixMilli()
+	k.UsageResets = append(k.UsageResets, UsageReset{At: k.UsageResetAt, Used: used})
+}
+
+// clone returns a deep copy of the key, so the copies never share their slices and maps with the table.
+func (k *Key) clone() Key {
+	c := *k
+	c.Tags = slices.Clone(k.Tags)
+	c.Metadata = maps.Clone(k.Metadata)
+	c.Servers = slices.Clone(k.Servers)
+	c.Regions = slices.Clone(k.Regions)
+	c.UsageResets = slices.Clone(k.UsageResets)
+	return c
+}
+
+// SetStatus changes the status of the key and records the reason and time of the change.
+// Only active keys are enabled.
+func (k *Key) SetStatus(status, reason string) {
+	k.Status = status
+	k.StatusReason = reason
+	k.StatusChangedAt = time.Now().UnixMilli()
+	k.Enabled = status == KeyStatusActive
+}
+
+// ExpirationTime returns the time (in milliseconds) the key expires at, or zero if it never expires.
+// It is the earlier of ExpiresAt and the end of the ExpiresAfter days since the first use.
+func (k *Key) ExpirationTime() int64 {
+	expiresAt := k.ExpiresAt
+	if k.ExpiresAfter > 0 && k.FirstUsedAt > 0 {
+		t := k.FirstUsedAt + k.ExpiresAfter*(24*time.Hour).Milliseconds()
+		if expiresAt == 0 || t < expiresAt {
+			expiresAt = t
+		}
 	}
+	return expiresAt
+}
+
+// IsExpired checks if the key is expired at the given time (in milliseconds).
+func (k *Key) IsExpired(now int64) bool {
+	expiresAt := k.ExpirationTime()
+	return expiresAt != 0 && expiresAt <= now
+}
 
-	if err = validator.New().Struct(kt); err != nil {
-		return errors.New(fmt.Sprintf("cannot validate %s, err: %v", KeyPath, err))
+// RemainingDays returns the number of days (rounded up) before the key expires, or -1 if it never expires.
+func (k *Key) RemainingDays(now int64) int64 {
+	day := (24 * time.Hour).Milliseconds()
+	expiresAt := k.ExpirationTime()
+	if k.ExpiresAfter > 0 && k.FirstUsedAt == 0 {
+		// The countdown starts with the first use, so the whole period is remaining.
+		if t := now + k.ExpiresAfter*day; expiresAt == 0 || t < expiresAt {
+			expiresAt = t
+		}
+	}
+	if expiresAt == 0 {
+		return -1
 	}
+	if expiresAt <= now {
+		return 0
+	}
+	return (expiresAt - now + day - 1) / day
+}
+
+// KeyTable holds the keys and guards them against concurrent access.
+// Its methods take and return copies of the keys, so callers never share its state.
+// The keys are indexed by their IDs, codes, and secrets (the keys in the trash included),
+// so the lookups of the public endpoints and the uniqueness checks do not scan all the keys.
+type KeyTable struct {
+	keys      []*Key
+	byId      map[string]*Key
+	byCode    map[string]*Key
+	bySecret  map[string]*Key
+	nextId    int64
+	updatedAt int64
+	filledAt  int64
+	store     Store
+	mutex     sync.RWMutex
+}
 
-	// TODO: Remove this later...
-	isDirty := false
-	for _, k := range kt.Keys {
-		if k.CreatedAt == 0 {
-			isDirty = true
-			k.CreatedAt = time.Now().UnixMilli()
+// keyTableMeta is the metadata record of the keys table.
+type keyTableMeta struct {
+	NextId    int64 `json:"next_id"`
+	UpdatedAt int64 `json:"updated_at"`
+	FilledAt  int64 `json:"filled_at,omitempty"`
+}
+
+func (kt *KeyTable) Load() error {
+	kt.mutex.Lock()
+	defer kt.mutex.Unlock()
+
+	var meta keyTableMeta
+	var keys []*Key
+	err := kt.store.Load(TableKeys, &meta, func(_ string, row []byte) error {
+		var k Key
+		if err := json.Unmarshal(row, &k); err != nil {
+			return err
+		}
+		keys = append(keys, &k)
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrTableNotFound) {
+			kt.index()
+			return kt.save()
 		}
+		return errors.New(fmt.Sprintf("cannot load %s, err: %v", TableKeys, err))
 	}
-	if isDirty {
-		return kt.Save()
+
+	if meta.NextId < 1 {
+		return errors.New(fmt.Sprintf("cannot validate %s, err: invalid next_id %d", TableKeys, meta.NextId))
 	}
 
+	sort.SliceStable(keys, func(i, j int) bool {
+		return idNumber(keys[i].Id) < idNumber(keys[j].Id)
+	})
+
+	kt.keys = append([]*Key{}, keys...)
+	kt.index()
+	kt.nextId = meta.NextId
+	kt.updatedAt = meta.UpdatedAt
+	kt.filledAt = meta.FilledAt
+
 	return nil
 }
 
-func (kt *KeyTable) Save() (err error) {
-	defer func() {
-		_ = kt.Load()
-	}()
-
-	if err = validator.New().Struct(kt); err != nil {
-		return DataError(err.Error())
+// index rebuilds the indexes of the keys; the caller must hold the lock.
+func (kt *KeyTable) index() {
+	kt.byId = make(map[string]*Key, len(kt.keys))
+	kt.byCode = make(map[string]*Key, len(kt.keys))
+	kt.bySecret = make(map[string]*Key, len(kt.keys))
+	for _, k := range kt.keys {
+		kt.byId[k.Id] = k
+		kt.byCode[k.Code] = k
+		kt.bySecret[k.Secret] = k
 	}
-	for _, k := range kt.Keys {
-		if err = validator.New().Struct(k); err != nil {
+}
+
+// save rewrites the whole table in the store; the caller must hold the lock.
+func (kt *KeyTable) save() (err error) {
+	v := validator.New()
+	for _, k := range kt.keys {
+		if err = v.Struct(k); err != nil {
 			return DataError(err.Error())
 		}
 	}
 
-	kt.UpdatedAt = time.Now().Unix()
-	content, err := json.Marshal(kt)
+	return kt.commit(kt.nextId, func(tx Tx) error {
+		if err = tx.Truncate(TableKeys); err != nil {
+			return err
+		}
+		for _, k := range kt.keys {
+			if err = tx.Put(TableKeys, k.Id, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// commit applies the row changes of fn and the table metadata in a single transaction.
+// The caller must hold the lock.
+func (kt *KeyTable) commit(nextId int64, fn func(tx Tx) error) error {
+	meta := keyTableMeta{NextId: nextId, UpdatedAt: time.Now().Unix(), FilledAt: kt.filledAt}
+	err := kt.store.Update(func(tx Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := tx.SetVersion(TableKeys, LatestVersion(TableKeys)); err != nil {
+			return err
+		}
+		return tx.PutMeta(TableKeys, meta)
+	})
 	if err != nil {
-		return err
+		return errors.New(fmt.Sprintf("cannot save %s, err: %v", TableKeys, err))
 	}
 
-	if err = os.WriteFile(KeyPath, content, 0755); err != nil {
-		return errors.New(fmt.Sprintf("cannot save %s, err: %v", KeyPath, err))
+	kt.nextId = meta.NextId
+	kt.updatedAt = meta.UpdatedAt
+
+	return nil
+}
+
+// UpdatedAt returns the last time (in seconds) the table was changed.
+func (kt *KeyTable) UpdatedAt() int64 {
+	kt.mutex.RLock()
+	defer kt.mutex.RUnlock()
+	return kt.updatedAt
+}
+
+// FilledAt returns the last time (in seconds) a master filled the keys, or zero if they have never been filled.
+func (kt *KeyTable) FilledAt() int64 {
+	kt.mutex.RLock()
+	defer kt.mutex.RUnlock()
+	return kt.filledAt
+}
+
+// All returns copies of all the keys, except the ones in the trash.
+func (kt *KeyTable) All() []Key {
+	kt.mutex.RLock()
+	defer kt.mutex.RUnlock()
+
+	keys := make([]Key, 0, len(kt.keys))
+	for _, k := range kt.keys {
+		if k.DeletedAt == 0 {
+			keys = append(keys, k.clone())
+		}
 	}
+	return keys
+}
+
+// Trash returns copies of the deleted keys, which can be restored until they are purged.
+func (kt *KeyTable) Trash() []Key {
+	kt.mutex.RLock()
+	defer kt.mutex.RUnlock()
 
-	return kt.Load()
+	keys := make([]Key, 0)
+	for _, k := range kt.keys {
+		if k.DeletedAt != 0 {
+			keys = append(keys, k.clone())
+		}
+	}
+	return keys
 }
 
-func (kt *KeyTable) GenerateCode() string {
+// generateCode returns a unique random code; the caller must hold the lock.
+func (kt *KeyTable) generateCode() string {
 	for {
 		code := random.String(32)
-		isUnique := true
-		for _, k := range kt.Keys {
-			if k.Code == code {
-				isUnique = false
-				break
-			}
-		}
-		if isUnique {
+		if _, found := kt.byCode[code]; !found {
 			return code
 		}
 	}
 }
 
 func (kt *KeyTable) Store(key Key) (*Key, error) {
-	for _, k := range kt.Keys {
-		if k.Secret == key.Secret {
-			return nil, DataError(fmt.Sprintf("The secret `%s` already exists.", k.Secret))
+	kt.mutex.Lock()
+	defer kt.mutex.Unlock()
+
+	if k, found := kt.bySecret[key.Secret]; found {
+		if k.DeletedAt != 0 {
+			return nil, DataError(fmt.Sprintf("The secret `%s` belongs to the key %s in the trash.", k.Secret, k.Id))
 		}
+		return nil, DataError(fmt.Sprintf("The secret `%s` already exists.", k.Secret))
 	}
 
-	key.Id = fmt.Sprintf("k-%d", kt.NextId)
-	key.Code = kt.GenerateCode()
+	key.Id = fmt.Sprintf("k-%d", kt.nextId)
+	key.Code = kt.generateCode()
 	key.CreatedAt = time.Now().UnixMilli()
+	key.Tags = normalizeTags(key.Tags)
+	if key.BillingCycle == "" {
+		key.BillingCycle = BillingCycleMonthly
+	}
+	if key.BillingAnchor == 0 {
+		key.BillingAnchor = DefaultBillingAnchor(key.CreatedAt)
+	}
+	if key.Enabled {
+		key.SetStatus(KeyStatusActive, "")
+	} else {
+		key.SetStatus(KeyStatusSuspended, "Created as disabled by the admin.")
+	}
 
-	kt.NextId++
-	kt.Keys = append(kt.Keys, &key)
+	if err := validator.New().Struct(key); err != nil {
+		return nil, DataError(err.Error())
+	}
+
+	if err := kt.commit(kt.nextId+1, func(tx Tx) error {
+		return tx.Put(TableKeys, key.Id, key)
+	}); err != nil {
+		return nil, err
+	}
 
-	return &key, kt.Save()
+	stored := key.clone()
+	kt.keys = append(kt.keys, &stored)
+	kt.byId[stored.Id] = &stored
+	kt.byCode[stored.Code] = &stored
+	kt.bySecret[stored.Secret] = &stored
+
+	return &key, nil
 }
 
+// Update replaces the key attributes set by the admin.
+// Enabling a key activates it and disabling it suspends it; otherwise, the status remains the same.
+// An empty placement and nil servers (left out by the clients unaware of them) keep the current ones.
 func (kt *KeyTable) Update(key Key) (*Key, error) {
-	for _, k := range kt.Keys {
-		if k.Id != key.Id && k.Secret == key.Secret {
-			return nil, DataError(fmt.Sprintf("The secret %s already exists.", k.Secret))
-		}
+	if key.Placement != "" && key.Placement != KeyPlacementAuto && key.Placement != KeyPlacementManual {
+		return nil, DataError(fmt.Sprintf("The placement %s is not %s or %s.", key.Placement, KeyPlacementAuto, KeyPlacementManual))
 	}
 
-	for i, k := range kt.Keys {
-		if k.Id == key.Id {
-			kt.Keys[i].Cipher = key.Cipher
-			kt.Keys[i].Secret = key.Secret
-			kt.Keys[i].Name = key.Name
-			kt.Keys[i].Quota = key.Quota
-			kt.Keys[i].Enabled = key.Enabled
-			return kt.Keys[i], kt.Save()
+	return kt.Modify(key.Id, func(k *Key) {
+		k.Cipher = key.Cipher
+		k.Secret = key.Secret
+		k.Name = key.Name
+		k.Tags = normalizeTags(key.Tags)
+		k.Group = key.Group
+		k.Metadata = key.Metadata
+		if key.Placement != "" {
+			k.Placement = key.Placement
 		}
+		k.Regions = key.Regions
+		// The servers of the keys with automatic placement are chosen by the coordinator.
+		if k.Placement != KeyPlacementAuto && key.Servers != nil {
+			k.Servers = key.Servers
+		}
+		k.Quotas = key.Quotas
+		k.Cap = key.Cap
+		k.CapWindow = key.CapWindow
+		k.ExpiresAt = key.ExpiresAt
+		k.ExpiresAfter = key.ExpiresAfter
+		if key.BillingCycle != "" {
+			k.BillingCycle = key.BillingCycle
+		}
+		if key.BillingAnchor != 0 {
+			k.BillingAnchor = key.BillingAnchor
+		}
+		k.setEnabled(key.Enabled)
+	})
+}
+
+// SetEnabled activates or suspends the key with the given ID on behalf of the admin.
+// It returns nil if the key does not exist.
+func (kt *KeyTable) SetEnabled(id string, enabled bool) (*Key, error) {
+	return kt.Modify(id, func(k *Key) {
+		k.setEnabled(enabled)
+	})
+}
+
+// Modify applies fn to a copy of the key with the given ID and persists the result if it is valid.
+// It returns nil if the key does not exist or is in the trash.
+func (kt *KeyTable) Modify(id string, fn func(k *Key)) (*Key, error) {
+	kt.mutex.Lock()
+	defer kt.mutex.Unlock()
+
+	k, found := kt.byId[id]
+	if !found || k.DeletedAt != 0 {
+		return nil, nil
 	}
 
-	return nil, nil
+	return kt.modify(k, fn)
+}
+
+// modify applies fn to a copy of the given key and persists the result if it is valid.
+// The caller must hold the lock.
+func (kt *KeyTable) modify(key *Key, fn func(k *Key)) (*Key, error) {
+	updated := key.clone()
+	fn(&updated)
+	updated.Id = key.Id
+
+	if k, found := kt.bySecret[updated.Secret]; found && k.Id != updated.Id {
+		return nil, DataError(fmt.Sprintf("The secret %s already exists.", k.Secret))
+	}
+
+	if err := validator.New().Struct(updated); err != nil {
+		return nil, DataError(err.Error())
+	}
+
+	if err := kt.commit(kt.nextId, func(tx Tx) error {
+		return tx.Put(TableKeys, updated.Id, updated)
+	}); err != nil {
+		return nil, err
+	}
+
+	delete(kt.byCode, key.Code)
+	delete(kt.bySecret, key.Secret)
+	*key = updated.clone()
+	kt.byCode[key.Code] = key
+	kt.bySecret[key.Secret] = key
+
+	return &updated, nil
 }
 
+// Fill replaces all the keys with the given ones (pushed by a master) in a single transaction.
 func (kt *KeyTable) Fill(keys []Key) (err error) {
 	var nextId int64 = 1
-	for _, k := range keys {
-		if err = validator.New().Struct(k); err != nil {
+	v := validator.New()
+	ids := make(map[string]bool, len(keys))
+	secrets := make(map[string]string, len(keys))
+	for i, k := range keys {
+		if k.Status == "" {
+			// Keys pushed by masters without statuses.
+			if k.Enabled {
+				keys[i].SetStatus(KeyStatusActive, "")
+			} else {
+				keys[i].SetStatus(KeyStatusSuspended, "")
+			}
+			k = keys[i]
+		}
+		if k.BillingCycle == "" {
+			// Keys pushed by masters without billing cycles.
+			keys[i].BillingCycle = BillingCycleMonthly
+			keys[i].BillingAnchor = DefaultBillingAnchor(k.CreatedAt)
+			k = keys[i]
+		}
+		if err = v.Struct(k); err != nil {
 			return DataError(err.Error())
 		}
-		for _, k2 := range keys {
-			if k.Id != k2.Id && k.Secret == k2.Secret {
-				return DataError(fmt.Sprintf("The secret of %s and %s is %s.", k.Id, k2.Id, k.Secret))
-			}
+		if ids[k.Id] {
+			return DataError(fmt.Sprintf("The key ID %s is duplicated.", k.Id))
 		}
-		if nextId, err = strconv.ParseInt(k.Id[2:], 10, 64); err != nil {
+		ids[k.Id] = true
+		if id, found := secrets[k.Secret]; found {
+			return DataError(fmt.Sprintf("The secret of %s and %s is %s.", id, k.Id, k.Secret))
+		}
+		secrets[k.Secret] = k.Id
+		n, err := strconv.ParseInt(k.Id[2:], 10, 64)
+		if err != nil {
 			return DataError(fmt.Sprintf("Invalid key ID: %v", k.Id))
 		}
+		// The next ID follows the largest one, so new keys never take the IDs of the filled ones.
+		if n >= nextId {
+			nextId = n + 1
+		}
+	}
+
+	kt.mutex.Lock()
+	defer kt.mutex.Unlock()
+
+	filledAt := kt.filledAt
+	kt.filledAt = time.Now().Unix()
+	if err = kt.commit(nextId, func(tx Tx) error {
+		if err = tx.Truncate(TableKeys); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err = tx.Put(TableKeys, k.Id, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		kt.filledAt = filledAt
+		return err
 	}
 
-	kt.Keys = []*Key{}
+	kt.keys = make([]*Key, 0, len(keys))
 	for i := range keys {
-		kt.Keys = append(kt.Keys, &keys[i])
+		k := keys[i].clone()
+		kt.keys = append(kt.keys, &k)
 	}
-	kt.NextId = nextId
+	kt.index()
 
-	return kt.Save()
+	return nil
 }
 
-func (kt *KeyTable) RegenerateId(id string) (*Key, error) {
-	for i, k := range kt.Keys {
-		if k.Id == id {
-			kt.Keys[i].Id = fmt.Sprintf("k-%d", kt.NextId)
-			kt.NextId++
+// Find returns a copy of the key with the given ID or nil if it does not exist or is in the trash.
+func (kt *KeyTable) Find(id string) *Key {
+	kt.mutex.RLock()
+	defer kt.mutex.RUnlock()
 
-			return k, kt.Save()
-		}
+	if k, found := kt.byId[id]; found && k.DeletedAt == 0 {
+		key := k.clone()
+		return &key
 	}
-
-	return nil, nil
+	return nil
 }
 
+// FindByCode returns a copy of the key with the given code or nil if it does not exist or is in the trash.
 func (kt *KeyTable) FindByCode(code string) (*Key, error) {
-	for _, k := range kt.Keys {
-		if k.Code == code {
-			return k, nil
-		}
+	kt.mutex.RLock()
+	defer kt.mutex.RUnlock()
+
+	if k, found := kt.byCode[code]; found && k.DeletedAt == 0 {
+		key := k.clone()
+		return &key, nil
 	}
 	return nil, nil
 }
 
-func (kt *KeyTable) Delete(id string) error {
-	for i, k := range kt.Keys {
-		if k.Id == id {
-			kt.Keys = slices.Delete(kt.Keys, i, i+1)
-			return kt.Save()
-		}
+// FindBySecret returns a copy of the key with the given cipher and secret
+// or nil if it does not exist or is in the trash.
+func (kt *KeyTable) FindBySecret(cipher, secret string) *Key {
+	kt.mutex.RLock()
+	defer kt.mutex.RUnlock()
+
+	if k, found := kt.bySecret[secret]; found && k.Cipher == cipher && k.DeletedAt == 0 {
+		key := k.clone()
+		return &key
 	}
 	return nil
 }
+
+// Delete moves the key with the given ID to the trash and returns it, or nil if it does not exist.
+// The secrets of the keys in the trash stay reserved, so they can be restored.
+func (kt *KeyTable) Delete(id string) (*Key, error) {
+	kt.mutex.Lock()
+	defer kt.mutex.Unlock()
+
+	k, found := kt.byId[id]
+	if !found || k.DeletedAt != 0 {
+		return nil, nil
+	}
+
+	return kt.modify(k, func(k *Key) {
+		k.DeletedAt = time.Now().UnixMilli()
+	})
+}
+
+// Restore moves the key with the given ID out of the trash and returns it, or nil if it is not in the trash.
+func (kt *KeyTable) Restore(id string) (*Key, error) {
+	kt.mutex.Lock()
+	defer kt.mutex.Unlock()
+
+	k, found := kt.byId[id]
+	if !found || k.DeletedAt == 0 {
+		return nil, nil
+	}
+
+	return kt.modify(k, func(k *Key) {
+		k.DeletedAt = 0
+	})
+}
+
+// Purge removes the key with the given ID from the trash permanently and returns it,
+// or nil if it is not in the trash.
+func (kt *KeyTable) Purge(id string) (*Key, error) {
+	kt.mutex.Lock()
+	defer kt.mutex.Unlock()
+
+	k, found := kt.byId[id]
+	if !found || k.DeletedAt == 0 {
+		return nil, nil
+	}
+
+	if err := kt.commit(kt.nextId, func(tx Tx) error {
+		return tx.Delete(TableKeys, id)
+	}); err != nil {
+		return nil, err
+	}
+
+	purged := k.clone()
+	i := slices.Index(kt.keys, k)
+	kt.keys = slices.Delete(kt.keys, i, i+1)
+	delete(kt.byId, k.Id)
+	delete(kt.byCode, k.Code)
+	delete(kt.bySecret, k.Secret)
+
+	return &purged, nil
+}
@@ -0,0 +1,175 @@
+package database
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func newTestKeyTable(t *testing.T) *KeyTable {
+	t.Helper()
+	store, err := NewJsonStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+
+	kt := newDatabase(store, 0, 0).KeyTable
+	if err = kt.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return kt
+}
+
+func storeTestKey(t *testing.T, kt *KeyTable, n int) *Key {
+	t.Helper()
+	key, err := kt.Store(Key{
+		Cipher:   "chacha20-ietf-poly1305",
+		Secret:   fmt.Sprintf("secret-%d", n),
+		Name:     fmt.Sprintf("key %d", n),
+		Enabled:  true,
+		Tags:     []string{"a", "b"},
+		Metadata: map[string]string{"m": "1"},
+		Servers:  []string{"s-1"},
+		Regions:  []string{"eu"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// mutate changes every slice and map of the key in place.
+func mutate(k *Key) {
+	k.Tags[0] = "changed"
+	k.Metadata["m"] = "changed"
+	k.Servers[0] = "changed"
+	k.Regions[0] = "changed"
+	if len(k.UsageResets) > 0 {
+		k.UsageResets[0].Used = -1
+	}
+}
+
+func TestKeyTableCopies(t *testing.T) {
+	kt := newTestKeyTable(t)
+	input := storeTestKey(t, kt, 1)
+	id := input.Id
+
+	modified, err := kt.Modify(id, func(k *Key) {
+		k.ResetUsage(10)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := kt.Find(id)
+	byCode, _ := kt.FindByCode(found.Code)
+	bySecret := kt.FindBySecret(found.Cipher, found.Secret)
+	for _, k := range []*Key{input, modified, found, byCode, bySecret, &kt.All()[0]} {
+		mutate(k)
+	}
+
+	k := kt.Find(id)
+	if k.Tags[0] != "a" || k.Metadata["m"] != "1" || k.Servers[0] != "s-1" || k.Regions[0] != "eu" {
+		t.Errorf("the stored key changed through a copy: %+v", k)
+	}
+	if len(k.UsageResets) != 1 || k.UsageResets[0].Used != 10 {
+		t.Errorf("the usage resets of the stored key changed through a copy: %+v", k.UsageResets)
+	}
+}
+
+func TestKeyTableConcurrency(t *testing.T) {
+	kt := newTestKeyTable(t)
+	var ids []string
+	for i := 0; i < 4; i++ {
+		ids = append(ids, storeTestKey(t, kt, i).Id)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, err := kt.Modify(ids[(i+j)%len(ids)], func(k *Key) {
+					k.Tags = append(k.Tags[:2], fmt.Sprintf("t%d", j))
+					k.Metadata[fmt.Sprintf("m%d", i)] = fmt.Sprint(j)
+					k.Servers = append(k.Servers[:1], fmt.Sprintf("s-%d", j+2))
+					k.ResetUsage(int64(j))
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				for _, k := range kt.All() {
+					mutate(&k)
+				}
+				if k := kt.Find(ids[(i+j)%len(ids)]); k != nil {
+					mutate(k)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, k := range kt.All() {
+		if k.Regions[0] != "eu" || k.Servers[0] != "s-1" {
+			t.Errorf("the stored key %s changed through a copy: %+v", k.Id, k)
+		}
+	}
+}
+
+func TestKeyTableUpdatePlacement(t *testing.T) {
+	kt := newTestKeyTable(t)
+	stored := storeTestKey(t, kt, 1)
+	if _, err := kt.Modify(stored.Id, func(k *Key) {
+		k.Placement = KeyPlacementAuto
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	update := func(placement string, servers []string) (*Key, error) {
+		k := *kt.Find(stored.Id)
+		k.Placement, k.Servers = placement, servers
+		return kt.Update(k)
+	}
+
+	// An update without the placement keeps the automatic placement and its servers.
+	k, err := update("", []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Placement != KeyPlacementAuto || !slices.Equal(k.Servers, []string{"s-1"}) {
+		t.Errorf("placement %q and servers %v, want %q and [s-1]", k.Placement, k.Servers, KeyPlacementAuto)
+	}
+
+	// Switching to manual placement keeps the servers unless they are given.
+	if k, err = update(KeyPlacementManual, nil); err != nil {
+		t.Fatal(err)
+	}
+	if k.Placement != KeyPlacementManual || !slices.Equal(k.Servers, []string{"s-1"}) {
+		t.Errorf("placement %q and servers %v, want %q and [s-1]", k.Placement, k.Servers, KeyPlacementManual)
+	}
+	if k, err = update("", []string{}); err != nil {
+		t.Fatal(err)
+	}
+	if k.Placement != KeyPlacementManual || len(k.Servers) != 0 {
+		t.Errorf("placement %q and servers %v, want %q and all the servers", k.Placement, k.Servers, KeyPlacementManual)
+	}
+
+	if _, err = update("random", nil); err == nil {
+		t.Error("updated the key with an unknown placement")
+	}
+	if _, ok := err.(DataError); !ok {
+		t.Errorf("err = %v, want a data error", err)
+	}
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Record is a raw table record (metadata or row) that keeps its fields as JSON values,
+// so migrations can change the fields without depending on the current Go types.
+type Record map[string]json.RawMessage
+
+// Has checks if the record has the given field.
+func (r Record) Has(field string) bool {
+	_, found := r[field]
+	return found
+}
+
+// Get decodes the given field into v; missing fields leave v untouched.
+func (r Record) Get(field string, v interface{}) error {
+	if raw, found := r[field]; found {
+		return json.Unmarshal(raw, v)
+	}
+	return nil
+}
+
+// Set encodes v into the given field.
+func (r Record) Set(field string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r[field] = raw
+	return nil
+}
+
+// Migration upgrades a table by one schema version.
+// It changes the metadata and rows (keyed by their IDs) of the table in place.
+type Migration struct {
+	Name string
+	Up   func(meta Record, rows map[string]Record) error
+}
+
+// migrations is the registry of the schema migrations of the tables, in order.
+// The schema version of a table is the number of its migrations that have been applied.
+// Migrations must never be removed or reordered; new ones are appended.
+var migrations = map[string][]Migration{
+	TableKeys: {
+		{Name: "backfill keys created_at", Up: backfillKeysCreatedAt},
+		{Name: "derive keys status from enabled", Up: deriveKeysStatus},
+		{Name: "set keys monthly billing cycles", Up: setKeysBillingCycles},
+		{Name: "convert keys quota to byte quotas", Up: convertKeysQuota},
+	},
+	TableServers: {
+		{Name: "rename servers row field", Up: renameServersRowField},
+	},
+}
+
+// LatestVersion returns the schema version of the table that the current code works with.
+func LatestVersion(table string) int {
+	return len(migrations[table])
+}
+
+// Migrate runs the pending migrations of all the tables of the store.
+// Tables that have never been saved are skipped; they are created with the latest version.
+// It returns the names of the applied migrations.
+func Migrate(store Store) (applied []string, err error) {
+	for _, table := range []string{TableSettings, TableKeys, TableServers, TableUsage, TableAdmins, TableSessions, TableTokens, TableAudit} {
+		names, err := migrateTable(store, table)
+		applied = append(applied, names...)
+		if err != nil {
+			return applied, err
+		}
+	}
+	return applied, nil
+}
+
+// migrateTable runs the pending migrations of the table in a single transaction.
+func migrateTable(store Store, table string) ([]string, error) {
+	version, err := store.Version(table)
+	if err != nil {
+		if errors.Is(err, ErrTableNotFound) {
+			return nil, nil
+		}
+		return nil, errors.New(fmt.Sprintf("cannot read the schema version of %s, err: %v", table, err))
+	}
+
+	latest := LatestVersion(table)
+	if version > latest {
+		return nil, errors.New(fmt.Sprintf(
+			"the schema version of %s is %d, but the latest supported one is %d", table, version, latest,
+		))
+	}
+	if version == latest {
+		return nil, nil
+	}
+
+	meta := Record{}
+	var ids []string
+	rows := map[string]Record{}
+	err = store.Load(table, &meta, func(id string, row []byte) error {
+		r := Record{}
+		if err := json.Unmarshal(row, &r); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		rows[id] = r
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot load %s, err: %v", table, err))
+	}
+
+	var applied []string
+	for _, m := range migrations[table][version:] {
+		if err = m.Up(meta, rows); err != nil {
+			return nil, errors.New(fmt.Sprintf("cannot run migration `%s` on %s, err: %v", m.Name, table, err))
+		}
+		applied = append(applied, m.Name)
+	}
+
+	err = store.Update(func(tx Tx) error {
+		if err := tx.Truncate(table); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if r, found := rows[id]; found {
+				if err := tx.Put(table, id, r); err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.PutMeta(table, meta); err != nil {
+			return err
+		}
+		return tx.SetVersion(table, latest)
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot save migrated %s, err: %v", table, err))
+	}
+
+	return applied, nil
+}
+
+// renameServersRowField moves the rows of the servers JSON file from the `keys` field to `servers`.
+// The rows stay the same; rewriting the table in the new version is the rename (see jsonLegacyRowFields).
+func renameServersRowField(_ Record, _ map[string]Record) error {
+	return nil
+}
+
+// backfillKeysCreatedAt sets the creation time of the keys created before the field was introduced.
+func backfillKeysCreatedAt(_ Record, rows map[string]Record) error {
+	now := time.Now().UnixMilli()
+	for _, r := range rows {
+		var createdAt int64
+		if err := r.Get("created_at", &createdAt); err != nil {
+			return err
+		}
+		if createdAt == 0 {
+			if err := r.Set("created_at", now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deriveKeysStatus sets the statuses of the keys created before statuses were introduced.
+// Disabled keys are either expired or considered as suspended, since the reason is unknown.
+func deriveKeysStatus(_ Record, rows map[string]Record) error {
+	now := time.Now().UnixMilli()
+	for _, r := range rows {
+		var enabled bool
+		if err := r.Get("enabled", &enabled); err != nil {
+			return err
+		}
+		var expiresAt int64
+		if err := r.Get("expires_at", &expiresAt); err != nil {
+			return err
+		}
+
+		status, reason := "active", ""
+		if !enabled {
+			if expiresAt != 0 && expiresAt <= now {
+				status, reason = "expired", "The key was expired before statuses were introduced."
+			} else {
+				status, reason = "suspended", "The key was disabled before statuses were introduced."
+			}
+		}
+
+		if err := r.Set("status", status); err != nil {
+			return err
+		}
+		if err := r.Set("status_reason", reason); err != nil {
+			return err
+		}
+		if err := r.Set("status_changed_at", now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setKeysBillingCycles puts the keys created before billing cycles were introduced on monthly cycles
+// anchored on the day they were created.
+func setKeysBillingCycles(_ Record, rows map[string]Record) error {
+	for _, r := range rows {
+		var createdAt int64
+		if err := r.Get("created_at", &createdAt); err != nil {
+			return err
+		}
+		y, m, d := time.UnixMilli(createdAt).Date()
+
+		if err := r.Set("billing_cycle", "monthly"); err != nil {
+			return err
+		}
+		if err := r.Set("billing_anchor", time.Date(y, m, d, 0, 0, 0, 0, time.Local).UnixMilli()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertKeysQuota converts the single total quota (in MB) of the keys to the byte quotas.
+func convertKeysQuota(_ Record, rows map[string]Record) error {
+	for _, r := range rows {
+		var quota int64
+		if err := r.Get("quota", &quota); err != nil {
+			return err
+		}
+		delete(r, "quota")
+
+		if err := r.Set("quotas", map[string]int64{"total": quota * 1000000}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
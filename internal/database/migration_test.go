@@ -0,0 +1,180 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator"
+)
+
+// legacyKeys is a keys.json of the first releases; quotas in MB, without creation times and statuses.
+const legacyKeys = `{
+  "keys": [
+    {"id": "k-1", "code": "code-1", "cipher": "chacha20-ietf-poly1305", "secret": "secret-1", "name": "active", "quota": 500, "enabled": true},
+    {"id": "k-2", "code": "code-2", "cipher": "aes-128-gcm", "secret": "secret-2", "name": "expired", "quota": 0, "enabled": false, "expires_at": 1000},
+    {"id": "k-3", "code": "code-3", "cipher": "aes-256-gcm", "secret": "secret-3", "name": "disabled", "quota": 20, "enabled": false}
+  ],
+  "next_id": 4,
+  "updated_at": 1600000000
+}`
+
+func writeTable(t *testing.T, directory, table, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(directory, table+".json"), []byte(content), jsonFileMode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	directory := t.TempDir()
+	writeTable(t, directory, TableKeys, legacyKeys)
+
+	store, err := NewJsonStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().UnixMilli()
+	applied, err := Migrate(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != LatestVersion(TableKeys) {
+		t.Fatalf("applied %v, want all the %d migrations of %s", applied, LatestVersion(TableKeys), TableKeys)
+	}
+	for i, m := range migrations[TableKeys] {
+		if applied[i] != m.Name {
+			t.Errorf("applied[%d] = %q, want %q", i, applied[i], m.Name)
+		}
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The migrated table must be read back from the disk as the current schema.
+	store, err = NewJsonStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if version, err := store.Version(TableKeys); err != nil || version != LatestVersion(TableKeys) {
+		t.Fatalf("version = %d (err: %v), want %d", version, err, LatestVersion(TableKeys))
+	}
+	if applied, err = Migrate(store); err != nil || len(applied) != 0 {
+		t.Fatalf("second run applied %v (err: %v), want nothing", applied, err)
+	}
+
+	d := newDatabase(store, 0, 0)
+	if err = d.KeyTable.Load(); err != nil {
+		t.Fatal(err)
+	}
+	keys := d.KeyTable.All()
+	if len(keys) != 3 {
+		t.Fatalf("got %d keys, want 3", len(keys))
+	}
+	if nextId := d.KeyTable.nextId; nextId != 4 {
+		t.Errorf("next ID = %d, want 4", nextId)
+	}
+
+	want := []struct {
+		status string
+		quota  int64
+	}{
+		{KeyStatusActive, 500 * 1000000},
+		{KeyStatusExpired, 0},
+		{KeyStatusSuspended, 20 * 1000000},
+	}
+	for i, k := range keys {
+		name := fmt.Sprintf("key %s", k.Id)
+		if err = validator.New().Struct(k); err != nil {
+			t.Errorf("%s is invalid, err: %v", name, err)
+		}
+		if k.Status != want[i].status {
+			t.Errorf("%s status = %q, want %q", name, k.Status, want[i].status)
+		}
+		if int64(k.Quotas.Total) != want[i].quota {
+			t.Errorf("%s total quota = %d, want %d", name, k.Quotas.Total, want[i].quota)
+		}
+		if k.CreatedAt < before {
+			t.Errorf("%s created_at = %d, want it backfilled", name, k.CreatedAt)
+		}
+		if k.BillingCycle != BillingCycleMonthly || k.BillingAnchor != DefaultBillingAnchor(k.CreatedAt) {
+			t.Errorf("%s billing = %s/%d, want a monthly cycle from its creation day", name, k.BillingCycle, k.BillingAnchor)
+		}
+		if k.StatusChangedAt == 0 || (k.Status != KeyStatusActive && k.StatusReason == "") {
+			t.Errorf("%s status change is not recorded", name)
+		}
+	}
+}
+
+func TestMigrateNewerVersion(t *testing.T) {
+	directory := t.TempDir()
+	writeTable(t, directory, TableKeys, fmt.Sprintf(
+		`{"keys": [], "next_id": 1, "%s": %d}`, jsonVersionField, LatestVersion(TableKeys)+1,
+	))
+
+	store, err := NewJsonStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	applied, err := Migrate(store)
+	if err == nil {
+		t.Fatalf("applied %v, want an error for a newer schema version", applied)
+	}
+	if !strings.Contains(err.Error(), "latest supported") {
+		t.Errorf("err = %v, want the latest supported version in it", err)
+	}
+	if version, _ := store.Version(TableKeys); version != LatestVersion(TableKeys)+1 {
+		t.Errorf("version = %d, want the table untouched", version)
+	}
+}
+
+func TestMigrateServersRowField(t *testing.T) {
+	directory := t.TempDir()
+	writeTable(t, directory, TableServers, `{
+  "keys": [{"id": "s-1", "http_host": "127.0.0.1", "http_port": 8080, "shadowsocks_port": 1}],
+  "next_id": 2
+}`)
+
+	store, err := NewJsonStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Migrate(store); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(store.path(TableServers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file map[string]interface{}
+	if err = json.Unmarshal(content, &file); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := file["keys"]; found {
+		t.Errorf("the servers are still in the keys field: %s", content)
+	}
+
+	// The migrated table must be read back from the disk from the new field.
+	store, err = NewJsonStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	d := newDatabase(store, 0, 0)
+	if err = d.ServerTable.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if servers := d.ServerTable.All(); len(servers) != 1 || servers[0].Id != "s-1" {
+		t.Errorf("got servers %+v, want s-1", servers)
+	}
+}
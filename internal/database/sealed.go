@@ -0,0 +1,268 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/miladrahimi/shadowsocks/pkg/seal"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MasterKeyEnv is the environment variable of the master key; it takes precedence over the master key file.
+const MasterKeyEnv = "SHADOWSOCKS_MASTER_KEY"
+
+// masterKeyMinLength is the minimum length of the master keys (e.g., `openssl rand -base64 32`).
+const masterKeyMinLength = 32
+
+// sealedPrefix marks the encrypted values; the rest is the sealed JSON value in base64.
+const sealedPrefix = "sealed:"
+
+// sealedFields are the fields of the tables (in their rows and metadata) that are encrypted at rest.
+var sealedFields = map[string][]string{
+	TableSettings: {"admin_password", "api_token"},
+	TableKeys:     {"secret"},
+	TableServers:  {"api_token"},
+	TableAdmins:   {"password_hash", "totp_secret", "recovery_codes"},
+}
+
+// ErrMasterKeyRequired is returned when the store has encrypted values but no master key is given.
+var ErrMasterKeyRequired = errors.New("the database is encrypted, but no master key is given")
+
+// MasterKey reads the master key from the environment or the given file; it returns nil if neither is set.
+func MasterKey(file string) ([]byte, error) {
+	secret := os.Getenv(MasterKeyEnv)
+	if secret == "" && file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("cannot read the master key file %s, err: %v", file, err))
+		}
+		secret = strings.TrimSpace(string(content))
+	}
+	if secret == "" {
+		return nil, nil
+	}
+	if len(secret) < masterKeyMinLength {
+		return nil, errors.New(fmt.Sprintf("the master key must have at least %d characters", masterKeyMinLength))
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	return key[:], nil
+}
+
+// SealedStore is a Store that encrypts the sensitive fields (see sealedFields) with the master key
+// before they reach the underlying store, and decrypts them as they are loaded.
+// Without a master key, the fields are stored as they are, and loading encrypted ones fails.
+type SealedStore struct {
+	store Store
+	key   []byte
+	plain map[string]bool
+	mutex sync.Mutex
+}
+
+// NewSealedStore creates an instance of SealedStore over the store; the key can be nil.
+func NewSealedStore(store Store, key []byte) *SealedStore {
+	return &SealedStore{store: store, key: key, plain: map[string]bool{}}
+}
+
+// Plain returns the tables that have had sensitive fields loaded in plaintext, while there is a master key.
+func (s *SealedStore) Plain() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tables := make([]string, 0, len(s.plain))
+	for table := range s.plain {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+func (s *SealedStore) Load(table string, meta interface{}, fn func(id string, row []byte) error) error {
+	var rowFn func(id string, row []byte) error
+	if fn != nil {
+		rowFn = func(id string, row []byte) error {
+			opened, err := s.open(table, row)
+			if err != nil {
+				return errors.New(fmt.Sprintf("cannot decrypt the row %s, err: %v", id, err))
+			}
+			return fn(id, opened)
+		}
+	}
+
+	var raw json.RawMessage
+	if err := s.store.Load(table, &raw, rowFn); err != nil {
+		return err
+	}
+
+	opened, err := s.open(table, raw)
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot decrypt the metadata, err: %v", err))
+	}
+	if len(opened) > 0 {
+		return json.Unmarshal(opened, meta)
+	}
+	return nil
+}
+
+func (s *SealedStore) Version(table string) (int, error) {
+	return s.store.Version(table)
+}
+
+func (s *SealedStore) Update(fn func(tx Tx) error) error {
+	return s.store.Update(func(tx Tx) error {
+		return fn(&sealedTx{tx: tx, store: s})
+	})
+}
+
+func (s *SealedStore) Close() error {
+	return s.store.Close()
+}
+
+// open decrypts the sealed fields of the row (or metadata) content of the table.
+func (s *SealedStore) open(table string, content []byte) ([]byte, error) {
+	fields, found := sealedFields[table]
+	if !found || len(content) == 0 {
+		return content, nil
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(content, &values); err != nil || values == nil {
+		return content, nil
+	}
+
+	opened := false
+	for _, field := range fields {
+		value, found := values[field]
+		if !found || isEmptyValue(value) {
+			continue
+		}
+		var text string
+		if json.Unmarshal(value, &text) != nil || !strings.HasPrefix(text, sealedPrefix) {
+			if s.key != nil {
+				s.mutex.Lock()
+				s.plain[table] = true
+				s.mutex.Unlock()
+			}
+			continue
+		}
+
+		if s.key == nil {
+			return nil, ErrMasterKeyRequired
+		}
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(text, sealedPrefix))
+		if err != nil {
+			return nil, err
+		}
+		if values[field], err = seal.Open(s.key, sealed); err != nil {
+			return nil, err
+		}
+		opened = true
+	}
+
+	if !opened {
+		return content, nil
+	}
+	return json.Marshal(values)
+}
+
+// seal encrypts the sensitive fields of the row (or metadata) of the table.
+func (s *SealedStore) seal(table string, v interface{}) (interface{}, error) {
+	fields, found := sealedFields[table]
+	if !found || s.key == nil {
+		return v, nil
+	}
+	content, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]json.RawMessage
+	if err = json.Unmarshal(content, &values); err != nil || values == nil {
+		return v, nil
+	}
+
+	for _, field := range fields {
+		value, found := values[field]
+		if !found || isEmptyValue(value) {
+			continue
+		}
+		var text string
+		if json.Unmarshal(value, &text) == nil && strings.HasPrefix(text, sealedPrefix) {
+			continue
+		}
+
+		sealed, err := seal.Seal(s.key, value)
+		if err != nil {
+			return nil, err
+		}
+		if values[field], err = json.Marshal(sealedPrefix + base64.StdEncoding.EncodeToString(sealed)); err != nil {
+			return nil, err
+		}
+	}
+
+	content, err = json.Marshal(values)
+	return json.RawMessage(content), err
+}
+
+// isEmptyValue checks if the JSON value is null or an empty string, which are left unencrypted.
+func isEmptyValue(value json.RawMessage) bool {
+	return string(value) == "null" || string(value) == `""`
+}
+
+// sealedTx is a transaction of SealedStore.
+type sealedTx struct {
+	tx    Tx
+	store *SealedStore
+}
+
+func (tx *sealedTx) PutMeta(table string, meta interface{}) error {
+	sealed, err := tx.store.seal(table, meta)
+	if err != nil {
+		return err
+	}
+	return tx.tx.PutMeta(table, sealed)
+}
+
+func (tx *sealedTx) Put(table, id string, row interface{}) error {
+	sealed, err := tx.store.seal(table, row)
+	if err != nil {
+		return err
+	}
+	return tx.tx.Put(table, id, sealed)
+}
+
+func (tx *sealedTx) Delete(table, id string) error {
+	return tx.tx.Delete(table, id)
+}
+
+func (tx *sealedTx) Truncate(table string) error {
+	return tx.tx.Truncate(table)
+}
+
+func (tx *sealedTx) SetVersion(table string, version int) error {
+	return tx.tx.SetVersion(table, version)
+}
+
+// reseal rewrites the tables through the store, so their plaintext sensitive fields get encrypted.
+// They are written twice, so the last good generations kept by JsonStore are not in plaintext either.
+func (s *SealedStore) reseal(tables ...string) error {
+	copied := &backupStore{backup: &Backup{Tables: map[string]*BackupTable{}}}
+	if err := Copy(copied, s, tables...); err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := Copy(s, copied, tables...); err != nil {
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, table := range tables {
+		delete(s.plain, table)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miladrahimi/shadowsocks/internal/config"
+)
+
+const (
+	testMasterKey  = "a-master-key-of-at-least-32-characters"
+	testOtherKey   = "another-master-key-of-32-characters-or-more"
+	testSealSecret = "a-key-secret-to-seal"
+)
+
+// openTestDatabase opens the database in the working directory with the given master key (empty for none).
+func openTestDatabase(t *testing.T, masterKey string) (*Database, error) {
+	t.Helper()
+	t.Setenv(MasterKeyEnv, masterKey)
+	cfg := &config.Config{}
+	cfg.Database.Driver = DriverJson
+	return New(cfg)
+}
+
+// readTables returns the content of the files in the database directory by their names.
+func readTables(t *testing.T) map[string][]byte {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(Directory, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, path := range paths {
+		if files[filepath.Base(path)], err = os.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+func TestSealedStore(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(wd)
+	})
+	if err = os.MkdirAll(Directory, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// A database created without a master key holds the secrets in plaintext.
+	d, err := openTestDatabase(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := d.KeyTable.Store(Key{Cipher: "chacha20-ietf-poly1305", Secret: testSealSecret, Name: "sealed", Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiToken := d.SettingTable.Get().ApiToken
+	_ = d.Close()
+
+	// Opening it with a master key encrypts them, along with the last good generations of the tables.
+	if d, err = openTestDatabase(t, testMasterKey); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Sealed) == 0 {
+		t.Error("no tables were sealed")
+	}
+	_ = d.Close()
+
+	sealed := readTables(t)
+	for name, content := range sealed {
+		for _, secret := range []string{testSealSecret, apiToken} {
+			if bytes.Contains(content, []byte(secret)) {
+				t.Errorf("%s holds the secret %s in plaintext", name, secret)
+			}
+		}
+	}
+	if !bytes.Contains(sealed[TableKeys+".json"], []byte(sealedPrefix)) {
+		t.Errorf("the keys are not sealed: %s", sealed[TableKeys+".json"])
+	}
+
+	// The wrong key and a missing key fail cleanly, without touching the tables.
+	for _, masterKey := range []string{testOtherKey, ""} {
+		if d, err = openTestDatabase(t, masterKey); err == nil {
+			_ = d.Close()
+			t.Errorf("opened the sealed database with the master key %q", masterKey)
+			continue
+		}
+		if masterKey == "" && !strings.Contains(err.Error(), ErrMasterKeyRequired.Error()) {
+			t.Errorf("err = %v, want %v", err, ErrMasterKeyRequired)
+		}
+		for name, content := range readTables(t) {
+			if !bytes.Equal(content, sealed[name]) {
+				t.Errorf("%s changed after a failed open with the master key %q", name, masterKey)
+			}
+		}
+	}
+
+	// The right key opens the secrets again.
+	if d, err = openTestDatabase(t, testMasterKey); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if len(d.Sealed) != 0 {
+		t.Errorf("sealed %v again", d.Sealed)
+	}
+	if found := d.KeyTable.Find(k.Id); found == nil || found.Secret != testSealSecret {
+		t.Errorf("found %+v, want the secret %s", found, testSealSecret)
+	}
+	if token := d.SettingTable.Get().ApiToken; token != apiToken {
+		t.Errorf("api token = %s, want %s", token, apiToken)
+	}
+}
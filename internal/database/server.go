@@ -5,15 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/go-playground/validator"
-	"github.com/miladrahimi/shadowsocks/pkg/utils"
 	"golang.org/x/exp/slices"
-	"os"
-	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 )
 
-const ServerPath = "storage/database/servers.json"
-
 const (
 	ServerStatusActive       = "active"
 	ServerStatusProcessing   = "processing"
@@ -25,112 +22,283 @@ type Server struct {
 	Id                 string `json:"id" validate:"required"`
 	HttpHost           string `json:"http_host" validate:"required"`
 	HttpPort           int    `json:"http_port" validate:"required,min=1,max=65536"`
+	Region             string `json:"region" validate:"max=64"`
 	ShadowsocksEnabled bool   `json:"shadowsocks_enabled"`
 	ShadowsocksHost    string `json:"shadowsocks_host"`
 	ShadowsocksPort    int    `json:"shadowsocks_port" validate:"min=1,max=65536"`
 	ApiToken           string `json:"api_token"`
 	Status             string `json:"status"`
 	SyncedAt           int64  `json:"synced_at" validate:"min=0"`
+	DeletedAt          int64  `json:"deleted_at" validate:"min=0"`
 }
 
+// ServerTable holds the servers and guards them against concurrent access.
+// Its methods take and return copies of the servers, so callers never share its state.
 type ServerTable struct {
-	Servers   []*Server `json:"keys" validate:"required"`
-	NextId    int64     `json:"next_id" validate:"required,min=1"`
-	UpdatedAt int64     `json:"updated_at" validate:"min=0"`
+	servers   []*Server
+	nextId    int64
+	updatedAt int64
+	store     Store
+	mutex     sync.RWMutex
+}
+
+// serverTableMeta is the metadata record of the servers table.
+type serverTableMeta struct {
+	NextId    int64 `json:"next_id"`
+	UpdatedAt int64 `json:"updated_at"`
 }
 
 func (st *ServerTable) Load() error {
-	content, err := os.ReadFile(ServerPath)
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	var meta serverTableMeta
+	var servers []*Server
+	err := st.store.Load(TableServers, &meta, func(_ string, row []byte) error {
+		var s Server
+		if err := json.Unmarshal(row, &s); err != nil {
+			return err
+		}
+		servers = append(servers, &s)
+		return nil
+	})
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			if !utils.DirectoryExist(filepath.Dir(ServerPath)) {
-				return errors.New(fmt.Sprintf("directory %s not found", filepath.Base(ServerPath)))
-			}
-			return st.Save()
+		if errors.Is(err, ErrTableNotFound) {
+			return st.save()
 		}
-		return errors.New(fmt.Sprintf("cannot load %s, err: %v", ServerPath, err))
+		return errors.New(fmt.Sprintf("cannot load %s, err: %v", TableServers, err))
 	}
 
-	err = json.Unmarshal(content, st)
-	if err != nil {
-		return err
+	if meta.NextId < 1 {
+		return errors.New(fmt.Sprintf("cannot validate %s, err: invalid next_id %d", TableServers, meta.NextId))
 	}
 
-	if err = validator.New().Struct(st); err != nil {
-		return errors.New(fmt.Sprintf("cannot validate %s, err: %v", ServerPath, err))
-	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return idNumber(servers[i].Id) < idNumber(servers[j].Id)
+	})
+
+	st.servers = append([]*Server{}, servers...)
+	st.nextId = meta.NextId
+	st.updatedAt = meta.UpdatedAt
 
 	return nil
 }
 
-func (st *ServerTable) Save() (err error) {
-	if err = validator.New().Struct(st); err != nil {
-		return DataError(err.Error())
-	}
-	for _, s := range st.Servers {
+// save rewrites the whole table in the store; the caller must hold the lock.
+func (st *ServerTable) save() (err error) {
+	for _, s := range st.servers {
 		if err = validator.New().Struct(s); err != nil {
 			return DataError(err.Error())
 		}
 	}
 
-	st.UpdatedAt = time.Now().Unix()
-	content, err := json.Marshal(st)
+	return st.commit(st.nextId, func(tx Tx) error {
+		if err = tx.Truncate(TableServers); err != nil {
+			return err
+		}
+		for _, s := range st.servers {
+			if err = tx.Put(TableServers, s.Id, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// commit applies the row changes of fn and the table metadata in a single transaction.
+// The caller must hold the lock.
+func (st *ServerTable) commit(nextId int64, fn func(tx Tx) error) error {
+	meta := serverTableMeta{NextId: nextId, UpdatedAt: time.Now().Unix()}
+	err := st.store.Update(func(tx Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := tx.SetVersion(TableServers, LatestVersion(TableServers)); err != nil {
+			return err
+		}
+		return tx.PutMeta(TableServers, meta)
+	})
 	if err != nil {
-		return err
+		return errors.New(fmt.Sprintf("cannot save %s, err: %v", TableServers, err))
 	}
 
-	if err = os.WriteFile(ServerPath, content, 0755); err != nil {
-		return errors.New(fmt.Sprintf("cannot save %s, err: %v", ServerPath, err))
+	st.nextId = meta.NextId
+	st.updatedAt = meta.UpdatedAt
+
+	return nil
+}
+
+// All returns copies of all the servers, except the ones in the trash.
+func (st *ServerTable) All() []Server {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	servers := make([]Server, 0, len(st.servers))
+	for _, s := range st.servers {
+		if s.DeletedAt == 0 {
+			servers = append(servers, *s)
+		}
 	}
+	return servers
+}
 
-	return st.Load()
+// Trash returns copies of the deleted servers, which can be restored until they are purged.
+func (st *ServerTable) Trash() []Server {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	servers := make([]Server, 0)
+	for _, s := range st.servers {
+		if s.DeletedAt != 0 {
+			servers = append(servers, *s)
+		}
+	}
+	return servers
 }
 
 func (st *ServerTable) Store(server Server) (*Server, error) {
-	server.Id = fmt.Sprintf("s-%d", st.NextId)
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	server.Id = fmt.Sprintf("s-%d", st.nextId)
 	server.Status = ServerStatusProcessing
 	server.ShadowsocksEnabled = false
 	server.ShadowsocksHost = ""
 	server.ShadowsocksPort = 1
 
-	st.NextId++
-	st.Servers = append(st.Servers, &server)
+	if err := validator.New().Struct(server); err != nil {
+		return nil, DataError(err.Error())
+	}
+
+	if err := st.commit(st.nextId+1, func(tx Tx) error {
+		return tx.Put(TableServers, server.Id, server)
+	}); err != nil {
+		return nil, err
+	}
+
+	stored := server
+	st.servers = append(st.servers, &stored)
 
-	return &server, st.Save()
+	return &server, nil
 }
 
+// Update replaces the server attributes and marks it as not synced.
 func (st *ServerTable) Update(server Server) (*Server, error) {
-	for i, s := range st.Servers {
-		if s.Id == server.Id {
-			st.Servers[i].HttpHost = server.HttpHost
-			st.Servers[i].HttpPort = server.HttpPort
-			st.Servers[i].ShadowsocksEnabled = server.ShadowsocksEnabled
-			st.Servers[i].ShadowsocksHost = server.ShadowsocksHost
-			st.Servers[i].ShadowsocksPort = server.ShadowsocksPort
-			st.Servers[i].ApiToken = server.ApiToken
-			st.Servers[i].Status = server.Status
-			st.Servers[i].SyncedAt = 0
-			return st.Servers[i], st.Save()
-		}
+	return st.Modify(server.Id, func(s *Server) {
+		s.HttpHost = server.HttpHost
+		s.HttpPort = server.HttpPort
+		s.Region = server.Region
+		s.ShadowsocksEnabled = server.ShadowsocksEnabled
+		s.ShadowsocksHost = server.ShadowsocksHost
+		s.ShadowsocksPort = server.ShadowsocksPort
+		s.ApiToken = server.ApiToken
+		s.Status = server.Status
+		s.SyncedAt = 0
+	})
+}
+
+// Modify applies fn to a copy of the server with the given ID and persists the result if it is valid.
+// It returns nil if the server does not exist or is in the trash.
+func (st *ServerTable) Modify(id string, fn func(s *Server)) (*Server, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	i := slices.IndexFunc(st.servers, func(s *Server) bool { return s.Id == id && s.DeletedAt == 0 })
+	if i == -1 {
+		return nil, nil
 	}
-	return nil, nil
+
+	return st.modify(i, fn)
+}
+
+// modify applies fn to a copy of the server at the given index and persists the result if it is valid.
+// The caller must hold the lock.
+func (st *ServerTable) modify(i int, fn func(s *Server)) (*Server, error) {
+	id := st.servers[i].Id
+
+	updated := *st.servers[i]
+	fn(&updated)
+	updated.Id = id
+
+	if err := validator.New().Struct(updated); err != nil {
+		return nil, DataError(err.Error())
+	}
+
+	if err := st.commit(st.nextId, func(tx Tx) error {
+		return tx.Put(TableServers, updated.Id, updated)
+	}); err != nil {
+		return nil, err
+	}
+
+	*st.servers[i] = updated
+	return &updated, nil
 }
 
+// Find returns a copy of the server with the given ID or nil if it does not exist or is in the trash.
 func (st *ServerTable) Find(Id string) *Server {
-	for i, s := range st.Servers {
-		if s.Id == Id {
-			return st.Servers[i]
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	for _, s := range st.servers {
+		if s.Id == Id && s.DeletedAt == 0 {
+			server := *s
+			return &server
 		}
 	}
 	return nil
 }
 
-func (st *ServerTable) Delete(id string) error {
-	for i, s := range st.Servers {
-		if s.Id == id {
-			st.Servers = slices.Delete(st.Servers, i, i+1)
-			return st.Save()
+// Delete moves the server with the given ID to the trash and returns it, or nil if it does not exist.
+func (st *ServerTable) Delete(id string) (*Server, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	i := slices.IndexFunc(st.servers, func(s *Server) bool { return s.Id == id && s.DeletedAt == 0 })
+	if i == -1 {
+		return nil, nil
+	}
+
+	return st.modify(i, func(s *Server) {
+		s.DeletedAt = time.Now().UnixMilli()
+	})
+}
+
+// Restore moves the server with the given ID out of the trash and returns it, or nil if it is not in the trash.
+// The restored server is marked as not synced.
+func (st *ServerTable) Restore(id string) (*Server, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	i := slices.IndexFunc(st.servers, func(s *Server) bool { return s.Id == id && s.DeletedAt != 0 })
+	if i == -1 {
+		return nil, nil
+	}
+
+	return st.modify(i, func(s *Server) {
+		s.DeletedAt = 0
+		s.Status = ServerStatusProcessing
+		s.SyncedAt = 0
+	})
+}
+
+// Purge removes the server with the given ID from the trash permanently and returns it,
+// or nil if it is not in the trash.
+func (st *ServerTable) Purge(id string) (*Server, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	for i, s := range st.servers {
+		if s.Id == id && s.DeletedAt != 0 {
+			if err := st.commit(st.nextId, func(tx Tx) error {
+				return tx.Delete(TableServers, id)
+			}); err != nil {
+				return nil, err
+			}
+
+			purged := *s
+			st.servers = slices.Delete(st.servers, i, i+1)
+			return &purged, nil
 		}
 	}
-	return nil
+	return nil, nil
 }
@@ -0,0 +1,284 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/miladrahimi/shadowsocks/pkg/utils"
+	"golang.org/x/exp/slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// SessionLifetime is how long the access token of a session is valid after signing in or refreshing.
+	SessionLifetime = time.Hour
+	// SessionRefreshLifetime is how long the refresh token of a session is valid after signing in or refreshing.
+	SessionRefreshLifetime = 7 * 24 * time.Hour
+)
+
+// Session is a sign-in of an admin into the panel.
+// Only the hashes of its tokens are kept, so the stored sessions cannot be used to sign in.
+type Session struct {
+	Id               string `json:"id"`
+	AdminId          string `json:"admin_id"`
+	TokenHash        string `json:"token_hash"`
+	RefreshHash      string `json:"refresh_hash"`
+	RemoteIp         string `json:"remote_ip"`
+	UserAgent        string `json:"user_agent"`
+	CreatedAt        int64  `json:"created_at"`
+	RefreshedAt      int64  `json:"refreshed_at"`
+	ExpiresAt        int64  `json:"expires_at"`
+	RefreshExpiresAt int64  `json:"refresh_expires_at"`
+}
+
+// SessionTokens are the tokens of a session, which are only known when it is created or refreshed.
+type SessionTokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+// renew replaces the tokens of the session and extends its expiration times.
+func (s *Session) renew(now time.Time) SessionTokens {
+	tokens := SessionTokens{
+		Token:        utils.SecureString(32),
+		RefreshToken: utils.SecureString(48),
+		ExpiresAt:    now.Add(SessionLifetime).UnixMilli(),
+	}
+	s.TokenHash = hashToken(tokens.Token)
+	s.RefreshHash = hashToken(tokens.RefreshToken)
+	s.RefreshedAt = now.UnixMilli()
+	s.ExpiresAt = tokens.ExpiresAt
+	s.RefreshExpiresAt = now.Add(SessionRefreshLifetime).UnixMilli()
+	return tokens
+}
+
+// IsExpired checks if the session can no longer be used or refreshed.
+func (s *Session) IsExpired(now time.Time) bool {
+	return s.RefreshExpiresAt <= now.UnixMilli()
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SessionTable holds the sessions of the admins and guards them against concurrent access.
+// Expired sessions are dropped whenever the table is saved.
+type SessionTable struct {
+	sessions  []*Session
+	updatedAt int64
+	store     Store
+	mutex     sync.RWMutex
+}
+
+// sessionTableMeta is the metadata record of the sessions table.
+type sessionTableMeta struct {
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+func (st *SessionTable) Load() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	var meta sessionTableMeta
+	var sessions []*Session
+	err := st.store.Load(TableSessions, &meta, func(_ string, row []byte) error {
+		var s Session
+		if err := json.Unmarshal(row, &s); err != nil {
+			return err
+		}
+		sessions = append(sessions, &s)
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrTableNotFound) {
+			return st.commit(func(tx Tx) error { return nil })
+		}
+		return errors.New(fmt.Sprintf("cannot load %s, err: %v", TableSessions, err))
+	}
+
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt < sessions[j].CreatedAt
+	})
+
+	st.sessions = append([]*Session{}, sessions...)
+	st.updatedAt = meta.UpdatedAt
+
+	return nil
+}
+
+// commit applies the row changes of fn, removes the expired sessions,
+// and saves the table metadata in a single transaction. The caller must hold the lock.
+func (st *SessionTable) commit(fn func(tx Tx) error) error {
+	now := time.Now()
+	var expired []string
+	for _, s := range st.sessions {
+		if s.IsExpired(now) {
+			expired = append(expired, s.Id)
+		}
+	}
+
+	meta := sessionTableMeta{UpdatedAt: now.Unix()}
+	err := st.store.Update(func(tx Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		for _, id := range expired {
+			if err := tx.Delete(TableSessions, id); err != nil {
+				return err
+			}
+		}
+		if err := tx.SetVersion(TableSessions, LatestVersion(TableSessions)); err != nil {
+			return err
+		}
+		return tx.PutMeta(TableSessions, meta)
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot save %s, err: %v", TableSessions, err))
+	}
+
+	st.sessions = dropSessions(st.sessions, expired)
+	st.updatedAt = meta.UpdatedAt
+
+	return nil
+}
+
+// All returns copies of the sessions that are not expired.
+func (st *SessionTable) All() []Session {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	now := time.Now()
+	sessions := make([]Session, 0, len(st.sessions))
+	for _, s := range st.sessions {
+		if !s.IsExpired(now) {
+			sessions = append(sessions, *s)
+		}
+	}
+	return sessions
+}
+
+// Create starts a session for the admin and returns it with its tokens.
+func (st *SessionTable) Create(adminId, remoteIp, userAgent string) (*Session, SessionTokens, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	now := time.Now()
+	session := Session{
+		Id:        utils.SecureString(16),
+		AdminId:   adminId,
+		RemoteIp:  remoteIp,
+		UserAgent: userAgent,
+		CreatedAt: now.UnixMilli(),
+	}
+	tokens := session.renew(now)
+
+	if err := st.commit(func(tx Tx) error {
+		return tx.Put(TableSessions, session.Id, session)
+	}); err != nil {
+		return nil, SessionTokens{}, err
+	}
+
+	stored := session
+	st.sessions = append(st.sessions, &stored)
+
+	return &session, tokens, nil
+}
+
+// Authenticate returns a copy of the session with the given access token,
+// or nil if there is no such session or its access token is expired.
+func (st *SessionTable) Authenticate(token string) *Session {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	hash := hashToken(token)
+	now := time.Now().UnixMilli()
+	for _, s := range st.sessions {
+		if s.TokenHash == hash && s.ExpiresAt > now {
+			session := *s
+			return &session
+		}
+	}
+	return nil
+}
+
+// Refresh replaces the tokens of the session with the given refresh token and extends it.
+// The old tokens stop working. It returns nil if there is no such session or it is expired.
+func (st *SessionTable) Refresh(refreshToken string) (*Session, SessionTokens, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	hash := hashToken(refreshToken)
+	now := time.Now()
+	i := slices.IndexFunc(st.sessions, func(s *Session) bool {
+		return s.RefreshHash == hash && !s.IsExpired(now)
+	})
+	if i == -1 {
+		return nil, SessionTokens{}, nil
+	}
+
+	session := *st.sessions[i]
+	tokens := session.renew(now)
+
+	if err := st.commit(func(tx Tx) error {
+		return tx.Put(TableSessions, session.Id, session)
+	}); err != nil {
+		return nil, SessionTokens{}, err
+	}
+
+	if i = slices.IndexFunc(st.sessions, func(s *Session) bool { return s.Id == session.Id }); i != -1 {
+		*st.sessions[i] = session
+	}
+
+	return &session, tokens, nil
+}
+
+// Revoke ends the sessions that match the given function.
+func (st *SessionTable) Revoke(fn func(s Session) bool) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	var revoked []string
+	for _, s := range st.sessions {
+		if fn(*s) {
+			revoked = append(revoked, s.Id)
+		}
+	}
+	if len(revoked) == 0 {
+		return nil
+	}
+
+	if err := st.commit(func(tx Tx) error {
+		for _, id := range revoked {
+			if err := tx.Delete(TableSessions, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	st.sessions = dropSessions(st.sessions, revoked)
+
+	return nil
+}
+
+// dropSessions returns the sessions without the ones with the given IDs.
+func dropSessions(sessions []*Session, ids []string) []*Session {
+	if len(ids) == 0 {
+		return sessions
+	}
+	kept := make([]*Session, 0, len(sessions))
+	for _, s := range sessions {
+		if !slices.Contains(ids, s.Id) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
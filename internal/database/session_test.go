@@ -0,0 +1,139 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	store, err := NewJsonStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+
+	d := newDatabase(store, 0, 0)
+	if err = d.load(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// expireSession sets the expiration times of the access and refresh tokens of the session relative to now.
+func expireSession(st *SessionTable, id string, token, refresh time.Duration) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for _, s := range st.sessions {
+		if s.Id == id {
+			s.ExpiresAt = time.Now().Add(token).UnixMilli()
+			s.RefreshExpiresAt = time.Now().Add(refresh).UnixMilli()
+		}
+	}
+}
+
+func TestSessionTableRefresh(t *testing.T) {
+	d := newTestDatabase(t)
+	st := d.SessionTable
+
+	session, tokens, err := st.Create("a-1", "127.0.0.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := st.Authenticate(tokens.Token); found == nil || found.Id != session.Id {
+		t.Fatalf("authenticated %+v, want the session %s", found, session.Id)
+	}
+	if st.Authenticate(tokens.RefreshToken) != nil {
+		t.Error("authenticated with the refresh token")
+	}
+
+	// An expired access token no longer works, but the session can still be refreshed.
+	expireSession(st, session.Id, -time.Second, time.Hour)
+	if st.Authenticate(tokens.Token) != nil {
+		t.Error("authenticated with an expired access token")
+	}
+	refreshed, renewed, err := st.Refresh(tokens.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed == nil || refreshed.Id != session.Id {
+		t.Fatalf("refreshed %+v, want the session %s", refreshed, session.Id)
+	}
+	if renewed.Token == tokens.Token || renewed.RefreshToken == tokens.RefreshToken {
+		t.Error("the tokens were not replaced")
+	}
+	if found := st.Authenticate(renewed.Token); found == nil || found.Id != session.Id {
+		t.Errorf("authenticated %+v with the new access token, want the session %s", found, session.Id)
+	}
+
+	// The old refresh token is used up.
+	if refreshed, _, err = st.Refresh(tokens.RefreshToken); err != nil || refreshed != nil {
+		t.Errorf("refreshed %+v (err: %v) with an old refresh token", refreshed, err)
+	}
+
+	// An expired session can neither be used nor refreshed, and it is dropped on the next save.
+	expireSession(st, session.Id, -time.Second, -time.Second)
+	if refreshed, _, err = st.Refresh(renewed.RefreshToken); err != nil || refreshed != nil {
+		t.Errorf("refreshed %+v (err: %v) an expired session", refreshed, err)
+	}
+	if _, _, err = st.Create("a-1", "127.0.0.1", "test"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range st.All() {
+		if s.Id == session.Id {
+			t.Errorf("the expired session %s was kept", session.Id)
+		}
+	}
+	if err = st.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if sessions := st.All(); len(sessions) != 1 {
+		t.Errorf("loaded %d sessions, want only the new one", len(sessions))
+	}
+}
+
+func TestSessionTableRevoke(t *testing.T) {
+	d := newTestDatabase(t)
+	st := d.SessionTable
+
+	var tokens []SessionTokens
+	for _, adminId := range []string{"a-1", "a-2", "a-2"} {
+		_, created, err := st.Create(adminId, "127.0.0.1", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, created)
+	}
+
+	if err := st.Revoke(func(s Session) bool { return s.AdminId == "a-2" }); err != nil {
+		t.Fatal(err)
+	}
+	if st.Authenticate(tokens[0].Token) == nil {
+		t.Error("revoked the session of another admin")
+	}
+	for _, revoked := range tokens[1:] {
+		if st.Authenticate(revoked.Token) != nil {
+			t.Error("authenticated with a revoked session")
+		}
+		if s, _, err := st.Refresh(revoked.RefreshToken); err != nil || s != nil {
+			t.Errorf("refreshed %+v (err: %v) a revoked session", s, err)
+		}
+	}
+
+	// Restoring a backup signs everyone out.
+	b, err := d.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.Restore(b, false); err != nil {
+		t.Fatal(err)
+	}
+	if st.Authenticate(tokens[0].Token) != nil {
+		t.Error("authenticated with a session from before the restore")
+	}
+	if sessions := st.All(); len(sessions) != 0 {
+		t.Errorf("kept %d sessions after the restore", len(sessions))
+	}
+}
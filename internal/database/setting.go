@@ -1,65 +1,101 @@
 package database
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-playground/validator"
-	"github.com/miladrahimi/shadowsocks/pkg/utils"
-	"os"
-	"path/filepath"
+	"sync"
+	"time"
 )
 
-const SettingPath = "storage/database/settings.json"
-
-type SettingTable struct {
-	AdminPassword      string  `json:"admin_password" validate:"required,min=8,max=32"`
+type Settings struct {
+	AdminPassword      string  `json:"admin_password,omitempty" validate:"omitempty,min=8,max=32"`
 	ApiToken           string  `json:"api_token" validate:"required,min=16,max=128"`
 	ShadowsocksEnabled bool    `json:"shadowsocks_enabled"`
 	ShadowsocksHost    string  `json:"shadowsocks_host" validate:"required,max=128"`
 	ShadowsocksPort    int     `json:"shadowsocks_port" validate:"required,min=1,max=65536"`
+	Region             string  `json:"region" validate:"max=64"`
+	PlacementReplicas  int     `json:"placement_replicas" validate:"min=0,max=64"`
 	ExternalHttps      string  `json:"external_https"`
 	ExternalHttp       string  `json:"external_http"`
 	TrafficRatio       float64 `json:"traffic_ratio" validate:"required,min=1"`
 }
 
+// SettingTable holds the settings and guards them against concurrent access.
+type SettingTable struct {
+	settings  Settings
+	updatedAt int64
+	store     Store
+	mutex     sync.RWMutex
+}
+
 func (st *SettingTable) Load() error {
-	content, err := os.ReadFile(SettingPath)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			if !utils.DirectoryExist(filepath.Dir(SettingPath)) {
-				return errors.New(fmt.Sprintf("directory %s not found", filepath.Base(SettingPath)))
-			}
-			return st.Save()
-		}
-		return errors.New(fmt.Sprintf("cannot load %s, err: %v", SettingPath, err))
-	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
 
-	err = json.Unmarshal(content, st)
+	// The default admin password only seeds the owner account of new installations.
+	settings := st.settings
+	settings.AdminPassword = ""
+	err := st.store.Load(TableSettings, &settings, nil)
 	if err != nil {
-		return err
+		if errors.Is(err, ErrTableNotFound) {
+			return st.save(st.settings)
+		}
+		return errors.New(fmt.Sprintf("cannot load %s, err: %v", TableSettings, err))
 	}
 
-	if err = validator.New().Struct(st); err != nil {
-		return errors.New(fmt.Sprintf("cannot validate %s, err: %v", SettingPath, err))
+	if err = validator.New().Struct(settings); err != nil {
+		return errors.New(fmt.Sprintf("cannot validate %s, err: %v", TableSettings, err))
 	}
+	st.settings = settings
 
 	return nil
 }
 
-func (st *SettingTable) Save() error {
-	if err := validator.New().Struct(st); err != nil {
+// save persists the given settings and replaces the current ones; the caller must hold the lock.
+func (st *SettingTable) save(settings Settings) error {
+	if err := validator.New().Struct(settings); err != nil {
 		return DataError(err.Error())
 	}
 
-	content, err := json.Marshal(st)
-	if err != nil {
-		return err
+	if err := st.store.Update(func(tx Tx) error {
+		if err := tx.SetVersion(TableSettings, LatestVersion(TableSettings)); err != nil {
+			return err
+		}
+		return tx.PutMeta(TableSettings, settings)
+	}); err != nil {
+		return errors.New(fmt.Sprintf("cannot save %s, err: %v", TableSettings, err))
 	}
+	st.settings = settings
+	st.updatedAt = time.Now().Unix()
+
+	return nil
+}
+
+// UpdatedAt returns the time (in seconds) the settings were last saved by this process.
+func (st *SettingTable) UpdatedAt() int64 {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.updatedAt
+}
+
+// Get returns a copy of the current settings.
+func (st *SettingTable) Get() Settings {
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+	return st.settings
+}
+
+// Modify applies fn to a copy of the settings and persists the result if it is valid.
+func (st *SettingTable) Modify(fn func(s *Settings)) (Settings, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
 
-	if err = os.WriteFile(SettingPath, content, 0755); err != nil {
-		return errors.New(fmt.Sprintf("cannot save %s, err: %v", ServerPath, err))
+	settings := st.settings
+	fn(&settings)
+	if err := st.save(settings); err != nil {
+		return st.settings, err
 	}
 
-	return st.Load()
+	return settings, nil
 }
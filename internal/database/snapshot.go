@@ -0,0 +1,143 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miladrahimi/shadowsocks/pkg/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SnapshotLatest picks the newest snapshot in FindSnapshot.
+const SnapshotLatest = "latest"
+
+// Snapshot is a backup file in the snapshot directory.
+// Its ID is its creation time in UTC (e.g., 20060102-150405), as in its file name.
+type Snapshot struct {
+	Id        string `json:"id"`
+	CreatedAt int64  `json:"created_at"`
+	Size      int64  `json:"size"`
+}
+
+// SnapshotPath returns the path of the snapshot file with the given ID.
+func SnapshotPath(directory, id string) string {
+	return filepath.Join(directory, BackupFormat+"-"+id+".json")
+}
+
+// ListSnapshots returns the snapshots in the directory, the newest first.
+func ListSnapshots(directory string) ([]Snapshot, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Snapshot{}, nil
+		}
+		return nil, errors.New(fmt.Sprintf("cannot list the snapshots in %s, err: %v", directory, err))
+	}
+
+	snapshots := make([]Snapshot, 0, len(entries))
+	for _, e := range entries {
+		id := strings.TrimSuffix(strings.TrimPrefix(e.Name(), BackupFormat+"-"), ".json")
+		t, err := time.ParseInLocation(backupTimeLayout, id, time.UTC)
+		if err != nil || e.IsDir() || e.Name() != BackupFileName(t) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{Id: id, CreatedAt: t.UnixMilli(), Size: info.Size()})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt > snapshots[j].CreatedAt
+	})
+
+	return snapshots, nil
+}
+
+// FindSnapshot returns the snapshot with the given ID (or the newest one for SnapshotLatest),
+// or nil if there is no such snapshot.
+func FindSnapshot(directory, id string) (*Snapshot, error) {
+	snapshots, err := ListSnapshots(directory)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		if s.Id == id || id == SnapshotLatest {
+			return &s, nil
+		}
+	}
+	return nil, nil
+}
+
+// ReadSnapshot reads and decodes the snapshot with the given ID.
+func (d *Database) ReadSnapshot(directory, id, passphrase string) (*Backup, error) {
+	content, err := os.ReadFile(SnapshotPath(directory, id))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot read the snapshot %s, err: %v", id, err))
+	}
+	return d.DecodeBackup(content, passphrase)
+}
+
+// WriteSnapshot writes a backup of the database into the directory, encrypted by EncodeBackup.
+func (d *Database) WriteSnapshot(directory, passphrase string) (*Snapshot, error) {
+	backup, err := d.Backup()
+	if err != nil {
+		return nil, err
+	}
+	content, err := d.EncodeBackup(backup, passphrase)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot encode the snapshot, err: %v", err))
+	}
+
+	t := time.UnixMilli(backup.CreatedAt).UTC()
+	s := &Snapshot{Id: t.Format(backupTimeLayout), CreatedAt: t.Truncate(time.Second).UnixMilli(), Size: int64(len(content))}
+	if err = os.MkdirAll(directory, 0700); err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot create the snapshot directory %s, err: %v", directory, err))
+	}
+	if err = utils.AtomicWriteFile(SnapshotPath(directory, s.Id), content, 0600); err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot write the snapshot %s, err: %v", s.Id, err))
+	}
+
+	return s, nil
+}
+
+// PruneSnapshots keeps the newest snapshot of each of the last `daily` days and `weekly` (ISO) weeks
+// that have snapshots, plus the newest snapshot overall, and removes the others.
+// Nothing is removed if both are zero. It returns the removed snapshots.
+func PruneSnapshots(directory string, daily, weekly int) ([]Snapshot, error) {
+	snapshots, err := ListSnapshots(directory)
+	if err != nil || (daily <= 0 && weekly <= 0) {
+		return []Snapshot{}, err
+	}
+
+	days, weeks := map[string]bool{}, map[string]bool{}
+	removed := make([]Snapshot, 0)
+	for i, s := range snapshots {
+		t := time.UnixMilli(s.CreatedAt).UTC()
+		day := t.Format("2006-01-02")
+		year, w := t.ISOWeek()
+		week := fmt.Sprintf("%d-%d", year, w)
+
+		keep := i == 0
+		if !days[day] && len(days) < daily {
+			days[day], keep = true, true
+		}
+		if !weeks[week] && len(weeks) < weekly {
+			weeks[week], keep = true, true
+		}
+		if keep {
+			continue
+		}
+
+		if err = os.Remove(SnapshotPath(directory, s.Id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, errors.New(fmt.Sprintf("cannot remove the snapshot %s, err: %v", s.Id, err))
+		}
+		removed = append(removed, s)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	TableSettings = "settings"
+	TableKeys     = "keys"
+	TableServers  = "servers"
+	TableUsage    = "usage"
+	TableAdmins   = "admins"
+	TableSessions = "sessions"
+	TableTokens   = "tokens"
+	TableAudit    = "audit"
+)
+
+// ErrTableNotFound is returned by stores when the requested table has never been saved.
+var ErrTableNotFound = errors.New("table not found")
+
+// Store is a storage engine that persists the database tables.
+// Each table has a metadata record and a set of rows identified by their IDs.
+type Store interface {
+	// Load decodes the metadata of the table into meta and calls fn for each row of the table.
+	Load(table string, meta interface{}, fn func(id string, row []byte) error) error
+	// Version returns the schema version of the table.
+	Version(table string) (int, error)
+	// Update runs fn in a transaction and commits all of its changes atomically
+	// (per table with JsonStore; see its limitations).
+	Update(fn func(tx Tx) error) error
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// Tx is a writable transaction of a Store.
+type Tx interface {
+	// PutMeta replaces the metadata of the table.
+	PutMeta(table string, meta interface{}) error
+	// Put inserts or replaces the row with the given ID.
+	Put(table, id string, row interface{}) error
+	// Delete removes the row with the given ID.
+	Delete(table, id string) error
+	// Truncate removes all the rows of the table.
+	Truncate(table string) error
+	// SetVersion sets the schema version of the table.
+	SetVersion(table string, version int) error
+}
+
+// Copy copies the given tables from src into dst in a single transaction.
+// Tables that do not exist in src are skipped.
+func Copy(dst, src Store, tables ...string) error {
+	return dst.Update(func(tx Tx) error {
+		for _, table := range tables {
+			var meta json.RawMessage
+			var rows = map[string]json.RawMessage{}
+			err := src.Load(table, &meta, func(id string, row []byte) error {
+				rows[id] = row
+				return nil
+			})
+			if errors.Is(err, ErrTableNotFound) {
+				continue
+			}
+			if err != nil {
+				return errors.New(fmt.Sprintf("cannot load %s, err: %v", table, err))
+			}
+			version, err := src.Version(table)
+			if err != nil {
+				return err
+			}
+
+			if err = tx.Truncate(table); err != nil {
+				return err
+			}
+			for id, row := range rows {
+				if err = tx.Put(table, id, row); err != nil {
+					return err
+				}
+			}
+			if err = tx.PutMeta(table, meta); err != nil {
+				return err
+			}
+			if err = tx.SetVersion(table, version); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// idNumber returns the numeric part of the given ID (like `12` for `k-12`).
+func idNumber(id string) int64 {
+	n, _ := strconv.ParseInt(id[strings.LastIndex(id, "-")+1:], 10, 64)
+	return n
+}
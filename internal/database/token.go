@@ -0,0 +1,260 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/validator"
+	"github.com/miladrahimi/shadowsocks/pkg/utils"
+	"golang.org/x/exp/slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	TokenScopeKeysRead     = "keys:read"
+	TokenScopeKeysWrite    = "keys:write"
+	TokenScopeServersRead  = "servers:read"
+	TokenScopeServersWrite = "servers:write"
+	TokenScopeSettings     = "settings"
+	TokenScopeAuditRead    = "audit:read"
+)
+
+// tokenUsageInterval is how often the last use of a token is saved.
+const tokenUsageInterval = time.Minute
+
+// Token is a named API token for automation (e.g., billing systems and monitoring scripts).
+// Only the hash of the token is kept; its prefix is kept to tell the tokens apart.
+type Token struct {
+	Id         string   `json:"id" validate:"required"`
+	Name       string   `json:"name" validate:"required,max=64"`
+	Hash       string   `json:"hash" validate:"required"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes" validate:"required,min=1,dive,oneof=keys:read keys:write servers:read servers:write settings audit:read"`
+	CreatedAt  int64    `json:"created_at"`
+	ExpiresAt  int64    `json:"expires_at" validate:"min=0"`
+	LastUsedAt int64    `json:"last_used_at"`
+}
+
+// HasScope checks if the token is granted the given scope.
+func (t *Token) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// IsExpired checks if the token has an expiration time that has passed.
+func (t *Token) IsExpired(now time.Time) bool {
+	return t.ExpiresAt != 0 && t.ExpiresAt <= now.UnixMilli()
+}
+
+// TokenTable holds the API tokens and guards them against concurrent access.
+type TokenTable struct {
+	tokens    []*Token
+	nextId    int64
+	updatedAt int64
+	store     Store
+	mutex     sync.RWMutex
+}
+
+// tokenTableMeta is the metadata record of the tokens table.
+type tokenTableMeta struct {
+	NextId    int64 `json:"next_id"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+func (tt *TokenTable) Load() error {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	var meta tokenTableMeta
+	var tokens []*Token
+	err := tt.store.Load(TableTokens, &meta, func(_ string, row []byte) error {
+		var t Token
+		if err := json.Unmarshal(row, &t); err != nil {
+			return err
+		}
+		tokens = append(tokens, &t)
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrTableNotFound) {
+			return tt.commit(tt.nextId, func(tx Tx) error { return nil })
+		}
+		return errors.New(fmt.Sprintf("cannot load %s, err: %v", TableTokens, err))
+	}
+
+	if meta.NextId < 1 {
+		return errors.New(fmt.Sprintf("cannot validate %s, err: invalid next_id %d", TableTokens, meta.NextId))
+	}
+
+	sort.SliceStable(tokens, func(i, j int) bool {
+		return idNumber(tokens[i].Id) < idNumber(tokens[j].Id)
+	})
+
+	tt.tokens = append([]*Token{}, tokens...)
+	tt.nextId = meta.NextId
+	tt.updatedAt = meta.UpdatedAt
+
+	return nil
+}
+
+// commit applies the row changes of fn and the table metadata in a single transaction.
+// The caller must hold the lock.
+func (tt *TokenTable) commit(nextId int64, fn func(tx Tx) error) error {
+	meta := tokenTableMeta{NextId: nextId, UpdatedAt: time.Now().Unix()}
+	err := tt.store.Update(func(tx Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := tx.SetVersion(TableTokens, LatestVersion(TableTokens)); err != nil {
+			return err
+		}
+		return tx.PutMeta(TableTokens, meta)
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot save %s, err: %v", TableTokens, err))
+	}
+
+	tt.nextId = meta.NextId
+	tt.updatedAt = meta.UpdatedAt
+
+	return nil
+}
+
+// All returns copies of all the tokens.
+func (tt *TokenTable) All() []Token {
+	tt.mutex.RLock()
+	defer tt.mutex.RUnlock()
+
+	tokens := make([]Token, 0, len(tt.tokens))
+	for _, t := range tt.tokens {
+		tokens = append(tokens, *t)
+	}
+	return tokens
+}
+
+// Store creates a token and returns it with its plain value, which is not kept.
+func (tt *TokenTable) Store(token Token) (*Token, string, error) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	plain := "sst_" + utils.SecureString(40)
+	token.Id = fmt.Sprintf("t-%d", tt.nextId)
+	token.Hash = hashToken(plain)
+	token.Prefix = plain[:8]
+	token.CreatedAt = time.Now().UnixMilli()
+	token.LastUsedAt = 0
+
+	if err := validator.New().Struct(token); err != nil {
+		return nil, "", DataError(err.Error())
+	}
+
+	if err := tt.commit(tt.nextId+1, func(tx Tx) error {
+		return tx.Put(TableTokens, token.Id, token)
+	}); err != nil {
+		return nil, "", err
+	}
+
+	stored := token
+	tt.tokens = append(tt.tokens, &stored)
+
+	return &token, plain, nil
+}
+
+// Modify applies fn to a copy of the token with the given ID and persists the result if it is valid.
+// It returns nil if the token does not exist.
+func (tt *TokenTable) Modify(id string, fn func(t *Token)) (*Token, error) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	i := slices.IndexFunc(tt.tokens, func(t *Token) bool { return t.Id == id })
+	if i == -1 {
+		return nil, nil
+	}
+
+	updated := *tt.tokens[i]
+	fn(&updated)
+	updated.Id = id
+	updated.Hash = tt.tokens[i].Hash
+	updated.Prefix = tt.tokens[i].Prefix
+
+	if err := validator.New().Struct(updated); err != nil {
+		return nil, DataError(err.Error())
+	}
+
+	if err := tt.commit(tt.nextId, func(tx Tx) error {
+		return tx.Put(TableTokens, updated.Id, updated)
+	}); err != nil {
+		return nil, err
+	}
+
+	*tt.tokens[i] = updated
+	return &updated, nil
+}
+
+// Authenticate returns a copy of the unexpired token with the given plain value or nil if there is none.
+// It records the use of the token (at most once per tokenUsageInterval).
+func (tt *TokenTable) Authenticate(plain string) *Token {
+	hash := hashToken(plain)
+	now := time.Now()
+
+	tt.mutex.RLock()
+	var token *Token
+	for _, t := range tt.tokens {
+		if t.Hash == hash && !t.IsExpired(now) {
+			found := *t
+			token = &found
+			break
+		}
+	}
+	tt.mutex.RUnlock()
+
+	if token == nil {
+		return nil
+	}
+
+	if token.LastUsedAt < now.Add(-tokenUsageInterval).UnixMilli() {
+		token.LastUsedAt = now.UnixMilli()
+		tt.touch(token.Id, token.LastUsedAt)
+	}
+
+	return token
+}
+
+// touch saves the last use of the token; failures are ignored, as the use is only informational.
+func (tt *TokenTable) touch(id string, usedAt int64) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	i := slices.IndexFunc(tt.tokens, func(t *Token) bool { return t.Id == id })
+	if i == -1 {
+		return
+	}
+
+	updated := *tt.tokens[i]
+	updated.LastUsedAt = usedAt
+	if err := tt.commit(tt.nextId, func(tx Tx) error {
+		return tx.Put(TableTokens, updated.Id, updated)
+	}); err == nil {
+		*tt.tokens[i] = updated
+	}
+}
+
+func (tt *TokenTable) Delete(id string) error {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	for i, t := range tt.tokens {
+		if t.Id == id {
+			if err := tt.commit(tt.nextId, func(tx Tx) error {
+				return tx.Delete(TableTokens, id)
+			}); err != nil {
+				return err
+			}
+
+			tt.tokens = slices.Delete(tt.tokens, i, i+1)
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,391 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/exp/slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UsageDateLayout is the layout of the dates of the usage rollups.
+const UsageDateLayout = "2006-01-02"
+
+// UsageMonthLayout is the layout of the dates of the monthly rollups that the old daily ones are compacted into.
+const UsageMonthLayout = "2006-01"
+
+// usageMinRetention is the shortest retention of the daily rollups,
+// so the usage in the billing cycles and of the servers is always calculated from the daily rollups.
+const usageMinRetention = 62 * 24 * time.Hour
+
+// Usage is the traffic (in bytes) of a key or server in a day (in the local time zone),
+// or in a month (UsageMonthLayout) for the days older than the retention.
+type Usage struct {
+	Date    string `json:"date"`
+	Subject string `json:"subject"`
+	DownTcp int64  `json:"down_tcp"`
+	UpTcp   int64  `json:"up_tcp"`
+	DownUdp int64  `json:"down_udp"`
+	UpUdp   int64  `json:"up_udp"`
+	Total   int64  `json:"total"`
+}
+
+// id returns the row ID of the usage.
+func (u *Usage) id() string {
+	return u.Date + "/" + u.Subject
+}
+
+// add adds the traffic of the given usage to this one.
+func (u *Usage) add(o Usage) {
+	u.DownTcp += o.DownTcp
+	u.UpTcp += o.UpTcp
+	u.DownUdp += o.DownUdp
+	u.UpUdp += o.UpUdp
+	u.Total += o.Total
+}
+
+// sub subtracts the traffic of the given usage from this one.
+func (u *Usage) sub(o Usage) {
+	u.DownTcp -= o.DownTcp
+	u.UpTcp -= o.UpTcp
+	u.DownUdp -= o.DownUdp
+	u.UpUdp -= o.UpUdp
+	u.Total -= o.Total
+}
+
+// merge keeps the larger value of each counter of this usage and the given one.
+// It returns true if this usage changed.
+func (u *Usage) merge(o Usage) bool {
+	merged := *u
+	merged.DownTcp = larger(u.DownTcp, o.DownTcp)
+	merged.UpTcp = larger(u.UpTcp, o.UpTcp)
+	merged.DownUdp = larger(u.DownUdp, o.DownUdp)
+	merged.UpUdp = larger(u.UpUdp, o.UpUdp)
+	merged.Total = merged.DownTcp + merged.UpTcp + merged.DownUdp + merged.UpUdp
+
+	changed := merged != *u
+	*u = merged
+	return changed
+}
+
+// UsageTable holds the daily usage rollups of the keys and servers (the subjects),
+// so the usage history outlives the Prometheus retention and data wipes.
+// The daily rollups of the months older than the retention (if any) are compacted into monthly ones.
+// It guards them against concurrent access, indexes them by subject, and keeps the lifetime totals of the subjects.
+type UsageTable struct {
+	usages    map[string]*Usage
+	subjects  map[string][]*Usage
+	totals    map[string]*Usage
+	retention time.Duration
+	updatedAt int64
+	store     Store
+	mutex     sync.RWMutex
+}
+
+// usageTableMeta is the metadata record of the usage table.
+type usageTableMeta struct {
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+func (ut *UsageTable) Load() error {
+	ut.mutex.Lock()
+	defer ut.mutex.Unlock()
+
+	var meta usageTableMeta
+	usages := map[string]*Usage{}
+	err := ut.store.Load(TableUsage, &meta, func(id string, row []byte) error {
+		var u Usage
+		if err := json.Unmarshal(row, &u); err != nil {
+			return err
+		}
+		usages[id] = &u
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrTableNotFound) {
+			return ut.commit(func(tx Tx) error { return nil })
+		}
+		return errors.New(fmt.Sprintf("cannot load %s, err: %v", TableUsage, err))
+	}
+
+	ut.usages = usages
+	ut.subjects = map[string][]*Usage{}
+	ut.totals = map[string]*Usage{}
+	for _, u := range usages {
+		ut.subjects[u.Subject] = append(ut.subjects[u.Subject], u)
+		ut.total(u.Subject).add(*u)
+	}
+	for _, rows := range ut.subjects {
+		sort.Slice(rows, func(i, j int) bool {
+			return rows[i].Date < rows[j].Date
+		})
+	}
+	ut.updatedAt = meta.UpdatedAt
+
+	return nil
+}
+
+// commit applies the row changes of fn and the table metadata in a single transaction.
+// The caller must hold the lock.
+func (ut *UsageTable) commit(fn func(tx Tx) error) error {
+	meta := usageTableMeta{UpdatedAt: time.Now().Unix()}
+	err := ut.store.Update(func(tx Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := tx.SetVersion(TableUsage, LatestVersion(TableUsage)); err != nil {
+			return err
+		}
+		return tx.PutMeta(TableUsage, meta)
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot save %s, err: %v", TableUsage, err))
+	}
+
+	ut.updatedAt = meta.UpdatedAt
+	return nil
+}
+
+// total returns the lifetime total of the subject, creating it if needed; the caller must hold the lock.
+func (ut *UsageTable) total(subject string) *Usage {
+	if _, found := ut.totals[subject]; !found {
+		ut.totals[subject] = &Usage{Subject: subject}
+	}
+	return ut.totals[subject]
+}
+
+// insert adds the rollup to the table and the index of its subject (sorted by date); the caller must hold the lock.
+func (ut *UsageTable) insert(u *Usage) {
+	ut.usages[u.id()] = u
+	rows := ut.subjects[u.Subject]
+	i := sort.Search(len(rows), func(i int) bool {
+		return rows[i].Date >= u.Date
+	})
+	ut.subjects[u.Subject] = slices.Insert(rows, i, u)
+}
+
+// remove removes the rollup from the table and the index of its subject; the caller must hold the lock.
+func (ut *UsageTable) remove(u *Usage) {
+	delete(ut.usages, u.id())
+	rows := ut.subjects[u.Subject]
+	if i := slices.Index(rows, u); i != -1 {
+		rows = slices.Delete(rows, i, i+1)
+	}
+	if len(rows) == 0 {
+		delete(ut.subjects, u.Subject)
+	} else {
+		ut.subjects[u.Subject] = rows
+	}
+}
+
+// compactions returns the monthly rollups that the daily rollups of the months older than the retention
+// are compacted into (merged with the existing monthly ones), and the IDs of those daily rollups.
+// The changed rollups (to be recorded) are compacted in place of the stored ones, and the new ones of the old months
+// go straight into their monthly rollups, so a monthly rollup never overlaps a daily one.
+// Only whole months are compacted. The caller must hold the lock.
+func (ut *UsageTable) compactions(now time.Time, changed map[string]Usage) (months map[string]Usage, days map[string]bool) {
+	if ut.retention <= 0 {
+		return nil, nil
+	}
+	retention := ut.retention
+	if retention < usageMinRetention {
+		retention = usageMinRetention
+	}
+	threshold := now.Add(-retention).Format(UsageMonthLayout)
+
+	months, days = map[string]Usage{}, map[string]bool{}
+	compact := func(u Usage) {
+		month := Usage{Date: u.Date[:len(UsageMonthLayout)], Subject: u.Subject}
+		if m, found := months[month.id()]; found {
+			month = m
+		} else if current, found := ut.usages[month.id()]; found {
+			month = *current
+		}
+		month.add(u)
+		months[month.id()] = month
+		days[u.id()] = true
+	}
+
+	for _, rows := range ut.subjects {
+		for _, u := range rows {
+			if u.Date >= threshold {
+				break
+			}
+			if len(u.Date) != len(UsageDateLayout) {
+				continue
+			}
+			if c, found := changed[u.id()]; found {
+				compact(c)
+			} else {
+				compact(*u)
+			}
+		}
+	}
+	for id, u := range changed {
+		if _, found := ut.usages[id]; !found && len(u.Date) == len(UsageDateLayout) && u.Date < threshold {
+			compact(u)
+		}
+	}
+	return months, days
+}
+
+// Record merges the given daily rollups into the table and compacts the old ones.
+// Rollups of the same day are recomputed as the day goes on, so each counter keeps its largest value;
+// this way, a Prometheus wipe never shrinks the recorded usage.
+func (ut *UsageTable) Record(usages []Usage) error {
+	ut.mutex.Lock()
+	defer ut.mutex.Unlock()
+
+	changed := map[string]Usage{}
+	for _, u := range usages {
+		merged := Usage{Date: u.Date, Subject: u.Subject}
+		if current, found := ut.usages[u.id()]; found {
+			merged = *current
+		}
+		if merged.merge(u) {
+			changed[u.id()] = merged
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	months, days := ut.compactions(time.Now(), changed)
+
+	if err := ut.commit(func(tx Tx) error {
+		for id, u := range changed {
+			if days[id] {
+				continue
+			}
+			if err := tx.Put(TableUsage, id, u); err != nil {
+				return err
+			}
+		}
+		for id := range days {
+			if _, found := ut.usages[id]; !found {
+				continue
+			}
+			if err := tx.Delete(TableUsage, id); err != nil {
+				return err
+			}
+		}
+		for id, u := range months {
+			if err := tx.Put(TableUsage, id, u); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// The totals lose the replaced and removed rollups and gain the stored ones,
+	// so the compactions (moving the usage into the monthly rollups) leave them the same.
+	put := func(u Usage) {
+		total := ut.total(u.Subject)
+		if current, found := ut.usages[u.id()]; found {
+			total.sub(*current)
+			*current = u
+		} else {
+			stored := u
+			ut.insert(&stored)
+		}
+		total.add(u)
+	}
+	drop := func(id string) {
+		if current, found := ut.usages[id]; found {
+			ut.total(current.Subject).sub(*current)
+			ut.remove(current)
+		}
+	}
+
+	for id, u := range changed {
+		if !days[id] {
+			put(u)
+		}
+	}
+	for id := range days {
+		drop(id)
+	}
+	for _, u := range months {
+		put(u)
+	}
+
+	return nil
+}
+
+// Lifetime returns the total usage of the subject in all the recorded days.
+func (ut *UsageTable) Lifetime(subject string) Usage {
+	ut.mutex.RLock()
+	defer ut.mutex.RUnlock()
+
+	if t, found := ut.totals[subject]; found {
+		return *t
+	}
+	return Usage{Subject: subject}
+}
+
+// Between returns the rollups of the subject from one date to another (inclusive), sorted by date.
+// Empty dates mean unbounded. The monthly rollups are returned if their months overlap the dates.
+func (ut *UsageTable) Between(subject, from, to string) []Usage {
+	ut.mutex.RLock()
+	defer ut.mutex.RUnlock()
+
+	month := func(date string) string {
+		if len(date) > len(UsageMonthLayout) {
+			return date[:len(UsageMonthLayout)]
+		}
+		return date
+	}
+
+	rows := ut.subjects[subject]
+	i := sort.Search(len(rows), func(i int) bool {
+		return rows[i].Date >= month(from)
+	})
+
+	usages := make([]Usage, 0)
+	for _, u := range rows[i:] {
+		if to != "" && month(u.Date) > month(to) {
+			break
+		}
+		if len(u.Date) == len(UsageMonthLayout) || ((from == "" || u.Date >= from) && (to == "" || u.Date <= to)) {
+			usages = append(usages, *u)
+		}
+	}
+	return usages
+}
+
+// Delete removes all the rollups of the subject (e.g., a purged key).
+func (ut *UsageTable) Delete(subject string) error {
+	ut.mutex.Lock()
+	defer ut.mutex.Unlock()
+
+	rows := ut.subjects[subject]
+
+	if err := ut.commit(func(tx Tx) error {
+		for _, u := range rows {
+			if err := tx.Delete(TableUsage, u.id()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, u := range rows {
+		delete(ut.usages, u.id())
+	}
+	delete(ut.subjects, subject)
+	delete(ut.totals, subject)
+
+	return nil
+}
+
+func larger(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestUsageTable(t *testing.T, directory string, retention time.Duration) *UsageTable {
+	t.Helper()
+	store, err := NewJsonStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+
+	ut := newDatabase(store, 0, retention).UsageTable
+	if err = ut.Load(); err != nil {
+		t.Fatal(err)
+	}
+	return ut
+}
+
+func TestUsageTableCompaction(t *testing.T) {
+	directory := t.TempDir()
+	ut := newTestUsageTable(t, directory, usageMinRetention)
+
+	now := time.Now()
+	old := time.Date(now.Year(), now.Month(), 1, 12, 0, 0, 0, now.Location()).AddDate(0, -4, 0)
+	month := old.Format(UsageMonthLayout)
+	days := []string{
+		old.Format(UsageDateLayout),
+		old.AddDate(0, 0, 1).Format(UsageDateLayout),
+	}
+	today := now.Format(UsageDateLayout)
+
+	err := ut.Record([]Usage{
+		{Date: days[0], Subject: "k-1", DownTcp: 1},
+		{Date: days[1], Subject: "k-1", DownTcp: 2},
+		{Date: days[0], Subject: "k-2", DownTcp: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The rollups of the old days go straight into the monthly rollups, along with the late ones.
+	if err = ut.Record([]Usage{{Date: today, Subject: "k-1", DownTcp: 8}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ut.Record([]Usage{{Date: days[1], Subject: "k-2", DownTcp: 16}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ut := range []*UsageTable{ut, newTestUsageTable(t, directory, usageMinRetention)} {
+		usages := ut.Between("k-1", "", "")
+		if len(usages) != 2 || usages[0].Date != month || usages[0].Total != 3 || usages[1].Date != today {
+			t.Errorf("k-1 rollups = %+v, want a monthly rollup of 3 bytes and today", usages)
+		}
+		if total := ut.Lifetime("k-1").Total; total != 11 {
+			t.Errorf("k-1 lifetime = %d, want 11", total)
+		}
+		if usages = ut.Between("k-2", days[1], days[1]); len(usages) != 1 || usages[0].Total != 20 {
+			t.Errorf("k-2 rollups = %+v, want the monthly rollup of 20 bytes overlapping the day", usages)
+		}
+		if total := ut.Lifetime("k-2").Total; total != 20 {
+			t.Errorf("k-2 lifetime = %d, want 20", total)
+		}
+		if usages = ut.Between("k-1", today, ""); len(usages) != 1 || usages[0].Date != today {
+			t.Errorf("k-1 rollups since today = %+v, want only today", usages)
+		}
+	}
+}
@@ -4,16 +4,28 @@ import (
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/miladrahimi/shadowsocks/internal/coordinator"
+	"github.com/miladrahimi/shadowsocks/internal/http/middleware"
+	"io"
 	"net/http"
 )
 
-func Metrics(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+// Metrics serves the metrics of the shadowsocks server, followed by the rejected requests of the HTTP server.
+func Metrics(coordinator *coordinator.Coordinator, rejections *middleware.Rejections) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		url := fmt.Sprintf("http://127.0.0.1:%d%s", coordinator.MetricsPort, c.Request().RequestURI)
 		r, err := http.Get(url)
 		if err != nil {
 			return err
 		}
-		return c.Stream(r.StatusCode, r.Header.Get("Content-Type"), r.Body)
+		defer func() {
+			_ = r.Body.Close()
+		}()
+
+		c.Response().Header().Set(echo.HeaderContentType, r.Header.Get("Content-Type"))
+		c.Response().WriteHeader(r.StatusCode)
+		if _, err = io.Copy(c.Response(), r.Body); err != nil {
+			return err
+		}
+		return rejections.WriteMetrics(c.Response())
 	}
 }
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/miladrahimi/shadowsocks/internal/coordinator"
-	"github.com/miladrahimi/shadowsocks/internal/database"
 	"net/http"
 	"strings"
 )
@@ -26,12 +25,7 @@ func Public(cdr *coordinator.Coordinator) echo.HandlerFunc {
 			})
 		}
 
-		var key *database.Key
-		for _, k := range cdr.Database.KeyTable.Keys {
-			if k.Cipher == parts[0] && k.Secret == parts[1] {
-				key = k
-			}
-		}
+		key := cdr.Database.KeyTable.FindBySecret(parts[0], parts[1])
 		if key == nil {
 			return c.JSON(http.StatusNotFound, map[string]string{
 				"message": "Not found.",
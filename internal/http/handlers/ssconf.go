@@ -4,7 +4,6 @@ import (
 	b64 "encoding/base64"
 	"github.com/labstack/echo/v4"
 	"github.com/miladrahimi/shadowsocks/internal/coordinator"
-	"github.com/miladrahimi/shadowsocks/internal/database"
 	"golang.org/x/exp/rand"
 	"net/http"
 	"net/url"
@@ -29,27 +28,14 @@ func SSConf(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 			})
 		}
 
-		var key *database.Key
-		for _, k := range coordinator.Database.KeyTable.Keys {
-			if k.Cipher == parts[0] && k.Secret == parts[1] {
-				key = k
-			}
-		}
+		key := coordinator.Database.KeyTable.FindBySecret(parts[0], parts[1])
 		if key == nil {
 			return c.JSON(http.StatusNotFound, map[string]string{
 				"message": "Not found.",
 			})
 		}
 
-		var servers []*database.Server
-		if coordinator.CurrentServer().ShadowsocksEnabled {
-			servers = append(servers, coordinator.CurrentServer())
-		}
-		for _, s := range coordinator.Database.ServerTable.Servers {
-			if s.Status == database.ServerStatusActive {
-				servers = append(servers, s)
-			}
-		}
+		servers := coordinator.KeyServers(key)
 
 		if len(servers) == 0 {
 			return c.JSON(http.StatusNotFound, map[string]interface{}{})
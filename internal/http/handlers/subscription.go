@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/miladrahimi/shadowsocks/internal/coordinator"
-	"github.com/miladrahimi/shadowsocks/internal/database"
 	"net/http"
 	"net/url"
 	"strings"
@@ -28,27 +27,14 @@ func Subscription(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 			})
 		}
 
-		var key *database.Key
-		for _, k := range coordinator.Database.KeyTable.Keys {
-			if k.Cipher == parts[0] && k.Secret == parts[1] {
-				key = k
-			}
-		}
+		key := coordinator.Database.KeyTable.FindBySecret(parts[0], parts[1])
 		if key == nil {
 			return c.JSON(http.StatusNotFound, map[string]string{
 				"message": "Not found.",
 			})
 		}
 
-		var servers []*database.Server
-		if coordinator.CurrentServer().ShadowsocksEnabled {
-			servers = append(servers, coordinator.CurrentServer())
-		}
-		for _, s := range coordinator.Database.ServerTable.Servers {
-			if s.Status == database.ServerStatusActive {
-				servers = append(servers, s)
-			}
-		}
+		servers := coordinator.KeyServers(key)
 
 		authPart := b64.StdEncoding.EncodeToString([]byte(key.Cipher + ":" + key.Secret))
 
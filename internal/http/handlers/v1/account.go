@@ -0,0 +1,250 @@
+package v1
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/miladrahimi/shadowsocks/internal/coordinator"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"github.com/miladrahimi/shadowsocks/pkg/totp"
+	"net/http"
+)
+
+type AccountResponse struct {
+	AdminResponse
+	RecoveryCodes int `json:"recovery_codes"`
+}
+
+type TotpSetupResponse struct {
+	Secret string `json:"secret"`
+	Url    string `json:"url"`
+}
+
+type TotpCodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type TotpDisableRequest struct {
+	Password string `json:"password" validate:"required"`
+	Code     string `json:"code" validate:"required"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// accountAdmin returns the signed-in admin, or nil (with the response sent) for the API tokens,
+// which have no accounts.
+func accountAdmin(c echo.Context) (*database.Admin, error) {
+	admin := currentAdmin(c)
+	if admin == nil {
+		return nil, c.JSON(http.StatusForbidden, map[string]string{
+			"message": "Only signed-in admins have accounts.",
+		})
+	}
+	return admin, nil
+}
+
+// verifySecondFactor checks the TOTP or recovery code of the admin, or sends the error response.
+func verifySecondFactor(c echo.Context, coordinator *coordinator.Coordinator, id, code string) (bool, error) {
+	verified, err := coordinator.Database.AdminTable.VerifySecondFactor(id, code)
+	if err != nil {
+		return false, c.JSON(http.StatusInternalServerError, map[string]string{
+			"message": "Cannot update the database.",
+		})
+	}
+	if !verified {
+		return false, c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "The two-factor code is invalid.",
+		})
+	}
+	return true, nil
+}
+
+func AccountShow(_ *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		admin, err := accountAdmin(c)
+		if admin == nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, AccountResponse{
+			AdminResponse: newAdminResponse(admin),
+			RecoveryCodes: len(admin.RecoveryCodes),
+		})
+	}
+}
+
+// AccountTotpSetup starts the enrollment of the two-factor authentication with a new secret,
+// which takes effect once a code of it is confirmed by AccountTotpEnable.
+func AccountTotpSetup(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		admin, err := accountAdmin(c)
+		if admin == nil {
+			return err
+		}
+		if admin.TotpEnabled {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "The two-factor authentication is already enabled.",
+			})
+		}
+
+		secret, err := totp.GenerateSecret()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Internal error.",
+			})
+		}
+
+		updated, err := coordinator.Database.AdminTable.Modify(admin.Id, func(a *database.Admin) error {
+			a.DisableTotp()
+			a.TotpSecret = secret
+			return nil
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		if updated != nil {
+			audit(c, coordinator, "account.totp_setup", admin.Id, admin, updated)
+		}
+
+		return c.JSON(http.StatusOK, TotpSetupResponse{
+			Secret: secret,
+			Url:    totp.URL("Shadowsocks", admin.Username, secret),
+		})
+	}
+}
+
+// AccountTotpEnable enables the pending two-factor authentication and returns the recovery codes.
+func AccountTotpEnable(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		admin, err := accountAdmin(c)
+		if admin == nil {
+			return err
+		}
+
+		var r TotpCodeRequest
+		if err = c.Bind(&r); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "Cannot parse the request body.",
+			})
+		}
+		if err = c.Validate(r); err != nil {
+			return err
+		}
+
+		if admin.TotpEnabled || admin.TotpSecret == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "There is no pending two-factor authentication to enable.",
+			})
+		}
+		if ok, err := verifySecondFactor(c, coordinator, admin.Id, r.Code); !ok {
+			return err
+		}
+
+		var codes []string
+		updated, err := coordinator.Database.AdminTable.Modify(admin.Id, func(a *database.Admin) error {
+			a.TotpEnabled = true
+			codes = a.GenerateRecoveryCodes()
+			return nil
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		if updated != nil {
+			audit(c, coordinator, "account.totp_enable", admin.Id, admin, updated)
+		}
+
+		return c.JSON(http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+	}
+}
+
+// AccountTotpDisable disables the two-factor authentication; it requires the password and a code.
+func AccountTotpDisable(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		admin, err := accountAdmin(c)
+		if admin == nil {
+			return err
+		}
+
+		var r TotpDisableRequest
+		if err = c.Bind(&r); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "Cannot parse the request body.",
+			})
+		}
+		if err = c.Validate(r); err != nil {
+			return err
+		}
+
+		if !admin.CheckPassword(r.Password) {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "The password is invalid.",
+			})
+		}
+		if ok, err := verifySecondFactor(c, coordinator, admin.Id, r.Code); !ok {
+			return err
+		}
+
+		updated, err := coordinator.Database.AdminTable.Modify(admin.Id, func(a *database.Admin) error {
+			a.DisableTotp()
+			return nil
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		if updated != nil {
+			audit(c, coordinator, "account.totp_disable", admin.Id, admin, updated)
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// AccountRecoveryCodes replaces the recovery codes of the admin; it requires a code.
+func AccountRecoveryCodes(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		admin, err := accountAdmin(c)
+		if admin == nil {
+			return err
+		}
+
+		var r TotpCodeRequest
+		if err = c.Bind(&r); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "Cannot parse the request body.",
+			})
+		}
+		if err = c.Validate(r); err != nil {
+			return err
+		}
+
+		if !admin.TotpEnabled {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "The two-factor authentication is not enabled.",
+			})
+		}
+		if ok, err := verifySecondFactor(c, coordinator, admin.Id, r.Code); !ok {
+			return err
+		}
+
+		var codes []string
+		updated, err := coordinator.Database.AdminTable.Modify(admin.Id, func(a *database.Admin) error {
+			codes = a.GenerateRecoveryCodes()
+			return nil
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		if updated != nil {
+			audit(c, coordinator, "account.recovery_codes", admin.Id, admin, updated)
+		}
+
+		return c.JSON(http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+	}
+}
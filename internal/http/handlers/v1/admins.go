@@ -0,0 +1,196 @@
+package v1
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/miladrahimi/shadowsocks/internal/coordinator"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"net/http"
+)
+
+type AdminResponse struct {
+	Id          string `json:"id"`
+	Username    string `json:"username"`
+	Role        string `json:"role"`
+	TotpEnabled bool   `json:"totp_enabled"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+type AdminsStoreRequest struct {
+	Username string `json:"username" validate:"required,min=3,max=32,alphanum"`
+	Password string `json:"password" validate:"omitempty,min=8,max=64"`
+	Role     string `json:"role" validate:"required,oneof=owner operator read_only"`
+}
+
+type AdminsUpdateRequest struct {
+	AdminsStoreRequest
+	Id string `json:"id" validate:"required"`
+}
+
+func newAdminResponse(a *database.Admin) AdminResponse {
+	return AdminResponse{
+		Id:          a.Id,
+		Username:    a.Username,
+		Role:        a.Role,
+		TotpEnabled: a.TotpEnabled,
+		CreatedAt:   a.CreatedAt,
+	}
+}
+
+// revokeAdminSessions signs the admin out of all its sessions.
+func revokeAdminSessions(coordinator *coordinator.Coordinator, id string) error {
+	return coordinator.Database.SessionTable.Revoke(func(s database.Session) bool {
+		return s.AdminId == id
+	})
+}
+
+func AdminsIndex(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		all := coordinator.Database.AdminTable.All()
+		admins := make([]AdminResponse, 0, len(all))
+		for i := range all {
+			admins = append(admins, newAdminResponse(&all[i]))
+		}
+		return c.JSON(http.StatusOK, admins)
+	}
+}
+
+func AdminsStore(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var r AdminsStoreRequest
+		if err := c.Bind(&r); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "Cannot parse the request body.",
+			})
+		}
+		if err := c.Validate(r); err != nil {
+			return err
+		}
+		if r.Password == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "The password is required.",
+			})
+		}
+
+		admin, err := coordinator.Database.AdminTable.Store(database.Admin{
+			Username: r.Username,
+			Role:     r.Role,
+		}, r.Password)
+		if err != nil {
+			if _, ok := err.(database.DataError); ok {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"message": err.Error(),
+				})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Internal error.",
+			})
+		}
+
+		audit(c, coordinator, "admins.create", admin.Id, nil, admin)
+
+		return c.JSON(http.StatusCreated, newAdminResponse(admin))
+	}
+}
+
+// AdminsUpdate updates the username and role of the admin, and its password if a new one is given.
+// Changing the password signs the admin out of all its sessions.
+func AdminsUpdate(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var r AdminsUpdateRequest
+		if err := c.Bind(&r); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "Cannot parse the request body.",
+			})
+		}
+		if err := c.Validate(r); err != nil {
+			return err
+		}
+
+		var before database.Admin
+		admin, err := coordinator.Database.AdminTable.Modify(r.Id, func(a *database.Admin) error {
+			before = *a
+			a.Username = r.Username
+			a.Role = r.Role
+			if r.Password != "" {
+				return a.SetPassword(r.Password)
+			}
+			return nil
+		})
+		if err != nil {
+			if _, ok := err.(database.DataError); ok {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"message": err.Error(),
+				})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Internal error.",
+			})
+		}
+		if admin == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"message": "Admin not found.",
+			})
+		}
+		audit(c, coordinator, "admins.update", admin.Id, before, admin)
+
+		if r.Password != "" {
+			if err = revokeAdminSessions(coordinator, admin.Id); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{
+					"message": "Cannot update the database.",
+				})
+			}
+		}
+
+		return c.JSON(http.StatusOK, newAdminResponse(admin))
+	}
+}
+
+func AdminsDelete(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		before := coordinator.Database.AdminTable.Find(c.Param("id"))
+		if err := coordinator.Database.AdminTable.Delete(c.Param("id")); err != nil {
+			if _, ok := err.(database.DataError); ok {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"message": err.Error(),
+				})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Internal error.",
+			})
+		}
+		if before != nil {
+			audit(c, coordinator, "admins.delete", before.Id, before, nil)
+		}
+		if err := revokeAdminSessions(coordinator, c.Param("id")); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// AdminsTotpDelete removes the two-factor authentication of the admin (e.g., after losing the device and codes).
+func AdminsTotpDelete(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var before database.Admin
+		admin, err := coordinator.Database.AdminTable.Modify(c.Param("id"), func(a *database.Admin) error {
+			before = *a
+			a.DisableTotp()
+			return nil
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		if admin == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"message": "Admin not found.",
+			})
+		}
+		audit(c, coordinator, "admins.totp_reset", admin.Id, before, admin)
+
+		return c.JSON(http.StatusOK, newAdminResponse(admin))
+	}
+}
@@ -0,0 +1,106 @@
+package v1
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/miladrahimi/shadowsocks/internal/config"
+	"github.com/miladrahimi/shadowsocks/internal/coordinator"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"github.com/miladrahimi/shadowsocks/internal/http/validator"
+	"go.uber.org/zap"
+)
+
+func newTestCoordinator(t *testing.T) *coordinator.Coordinator {
+	t.Helper()
+	t.Setenv(database.MasterKeyEnv, "")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(wd)
+	})
+	if err = os.MkdirAll(database.Directory, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Database.Driver = database.DriverJson
+	db, err := database.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return coordinator.New(cfg, zap.NewNop(), nil, nil, db, nil)
+}
+
+func TestAdminsUpdateRevokesSessions(t *testing.T) {
+	c := newTestCoordinator(t)
+	owner := c.Database.AdminTable.All()[0]
+	admin, err := c.Database.AdminTable.Store(database.Admin{Username: "operator", Role: database.AdminRoleOperator}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, tokens, err := c.Database.SessionTable.Create(admin.Id, "127.0.0.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ownerTokens, err := c.Database.SessionTable.Create(owner.Id, "127.0.0.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Validator = validator.New()
+	update := func(password string) int {
+		body, _ := json.Marshal(map[string]string{
+			"id":       admin.Id,
+			"username": admin.Username,
+			"role":     database.AdminRoleReadOnly,
+			"password": password,
+		})
+		request := httptest.NewRequest(http.MethodPut, "/v1/admins", bytes.NewReader(body))
+		request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		recorder := httptest.NewRecorder()
+		context := e.NewContext(request, recorder)
+		context.Set("admin", &owner)
+		if err := AdminsUpdate(c)(context); err != nil {
+			t.Fatal(err)
+		}
+		return recorder.Code
+	}
+
+	// Other changes keep the sessions.
+	if code := update(""); code != http.StatusOK {
+		t.Fatalf("status %d, want %d", code, http.StatusOK)
+	}
+	if c.Database.SessionTable.Authenticate(tokens.Token) == nil {
+		t.Error("revoked the sessions without a password change")
+	}
+
+	// A new password signs the admin out everywhere, and only the admin.
+	if code := update("new-password"); code != http.StatusOK {
+		t.Fatalf("status %d, want %d", code, http.StatusOK)
+	}
+	if c.Database.SessionTable.Authenticate(tokens.Token) != nil {
+		t.Error("authenticated with a session from before the password change")
+	}
+	if s, _, err := c.Database.SessionTable.Refresh(tokens.RefreshToken); err != nil || s != nil {
+		t.Errorf("refreshed %+v (err: %v) a session from before the password change", s, err)
+	}
+	if c.Database.SessionTable.Authenticate(ownerTokens.Token) == nil {
+		t.Error("revoked the sessions of another admin")
+	}
+}
@@ -0,0 +1,53 @@
+package v1
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/miladrahimi/shadowsocks/internal/coordinator"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"net/http"
+	"strconv"
+)
+
+const (
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+)
+
+// AuditIndex returns the audit entries, the newest first, optionally filtered by the query parameters;
+// `actor` (e.g., `admin:root`), `action` (a prefix, e.g., `keys.` or `keys.status`), `target` (e.g., `k-1`),
+// `from` and `to` (Unix milliseconds), and `limit` (100 by default, 1000 at most).
+func AuditIndex(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filter := database.AuditFilter{
+			Actor:  c.QueryParam("actor"),
+			Action: c.QueryParam("action"),
+			Target: c.QueryParam("target"),
+			Limit:  auditDefaultLimit,
+		}
+
+		numbers := map[string]*int64{"from": &filter.From, "to": &filter.To}
+		for name, value := range numbers {
+			if p := c.QueryParam(name); p != "" {
+				n, err := strconv.ParseInt(p, 10, 64)
+				if err != nil || n < 0 {
+					return c.JSON(http.StatusBadRequest, map[string]string{
+						"message": "The " + name + " must be a time in Unix milliseconds.",
+					})
+				}
+				*value = n
+			}
+		}
+
+		if p := c.QueryParam("limit"); p != "" {
+			limit, err := strconv.Atoi(p)
+			if err != nil || limit < 1 || limit > auditMaxLimit {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"message": "The limit must be between 1 and " + strconv.Itoa(auditMaxLimit) + ".",
+				})
+			}
+			filter.Limit = limit
+		}
+
+		return c.JSON(http.StatusOK, coordinator.Database.AuditTable.Query(filter))
+	}
+}
@@ -3,6 +3,7 @@ package v1
 import (
 	"github.com/labstack/echo/v4"
 	"github.com/miladrahimi/shadowsocks/internal/coordinator"
+	"github.com/miladrahimi/shadowsocks/internal/database"
 	"net/http"
 	"time"
 )
@@ -10,6 +11,17 @@ import (
 type SignInRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type SignInResponse struct {
+	database.SessionTokens
+	Username string `json:"username"`
+	Role     string `json:"role"`
 }
 
 func SignIn(coordinator *coordinator.Coordinator) echo.HandlerFunc {
@@ -25,14 +37,137 @@ func SignIn(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 			})
 		}
 
-		if r.Username == "admin" && r.Password == coordinator.Database.SettingTable.AdminPassword {
-			return c.JSON(http.StatusOK, map[string]string{
-				"token": coordinator.Database.SettingTable.ApiToken,
+		admin := coordinator.Database.AdminTable.Authenticate(r.Username, r.Password)
+		if admin == nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{
+				"message": "Unauthorized.",
 			})
 		}
 
-		return c.JSON(http.StatusUnauthorized, map[string]string{
-			"message": "Unauthorized.",
-		})
+		if admin.TotpEnabled {
+			if r.Code == "" {
+				return c.JSON(http.StatusUnauthorized, map[string]interface{}{
+					"message":       "The two-factor code is required.",
+					"totp_required": true,
+				})
+			}
+			verified, err := coordinator.Database.AdminTable.VerifySecondFactor(admin.Id, r.Code)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{
+					"message": "Cannot update the database.",
+				})
+			}
+			if !verified {
+				return c.JSON(http.StatusUnauthorized, map[string]interface{}{
+					"message":       "The two-factor code is invalid.",
+					"totp_required": true,
+				})
+			}
+		}
+
+		session, tokens, err := coordinator.Database.SessionTable.Create(admin.Id, c.RealIP(), c.Request().UserAgent())
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		coordinator.Audit("admin:"+admin.Username, c.RealIP(), "auth.sign_in", session.Id, nil, session)
+
+		return c.JSON(http.StatusOK, SignInResponse{SessionTokens: tokens, Username: admin.Username, Role: admin.Role})
 	}
 }
+
+// SignInRefresh exchanges the refresh token of a session for new tokens; the old ones stop working.
+func SignInRefresh(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var r RefreshRequest
+		if err := c.Bind(&r); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "Cannot parse the request body.",
+			})
+		}
+		if err := c.Validate(r); err != nil {
+			return err
+		}
+
+		session, tokens, err := coordinator.Database.SessionTable.Refresh(r.RefreshToken)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		if session == nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{
+				"message": "Unauthorized.",
+			})
+		}
+
+		admin := coordinator.Database.AdminTable.Find(session.AdminId)
+		if admin == nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{
+				"message": "Unauthorized.",
+			})
+		}
+
+		return c.JSON(http.StatusOK, SignInResponse{SessionTokens: tokens, Username: admin.Username, Role: admin.Role})
+	}
+}
+
+// SignOut revokes the current session.
+func SignOut(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if session := currentSession(c); session != nil {
+			err := coordinator.Database.SessionTable.Revoke(func(s database.Session) bool {
+				return s.Id == session.Id
+			})
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{
+					"message": "Cannot update the database.",
+				})
+			}
+			audit(c, coordinator, "auth.sign_out", session.Id, session, nil)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// currentAdmin returns the admin authorized by the middleware or nil for the API tokens.
+func currentAdmin(c echo.Context) *database.Admin {
+	admin, _ := c.Get("admin").(*database.Admin)
+	return admin
+}
+
+// allows checks if the authorized admin has the permissions of the given role,
+// or the authorized API token has the given scope; the other nodes have all the permissions.
+func allows(c echo.Context, role, scope string) bool {
+	if admin := currentAdmin(c); admin != nil {
+		return database.RoleAllows(admin.Role, role)
+	}
+	if token, _ := c.Get("token").(*database.Token); token != nil {
+		return scope != "" && token.HasScope(scope)
+	}
+	return true
+}
+
+// currentSession returns the session authorized by the middleware or nil for the API tokens.
+func currentSession(c echo.Context) *database.Session {
+	session, _ := c.Get("session").(*database.Session)
+	return session
+}
+
+// auditActor returns the actor of the request in the audit log;
+// the signed-in admin, the API token, or the other nodes (the API token of the settings).
+func auditActor(c echo.Context) string {
+	if admin := currentAdmin(c); admin != nil {
+		return "admin:" + admin.Username
+	}
+	if token, _ := c.Get("token").(*database.Token); token != nil {
+		return "token:" + token.Id
+	}
+	return "node"
+}
+
+// audit records the change that the request has made in the audit log (see coordinator.Audit).
+func audit(c echo.Context, coordinator *coordinator.Coordinator, action, target string, before, after interface{}) {
+	coordinator.Audit(auditActor(c), c.RealIP(), action, target, before, after)
+}
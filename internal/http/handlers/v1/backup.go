@@ -0,0 +1,133 @@
+package v1
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/miladrahimi/shadowsocks/internal/coordinator"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"io"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// BackupShow downloads a backup of the settings, keys, servers, usage, admins, and tokens;
+// it is encrypted with the snapshot passphrase or the master key, if there is either.
+func BackupShow(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		backup, err := coordinator.Database.Backup()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Internal error.",
+			})
+		}
+		content, err := coordinator.Database.EncodeBackup(backup, coordinator.Config.Snapshot.Passphrase)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Internal error.",
+			})
+		}
+		audit(c, coordinator, "backup.create", "database", nil, nil)
+
+		name := database.BackupFileName(time.UnixMilli(backup.CreatedAt))
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name))
+		return c.Blob(http.StatusOK, echo.MIMEApplicationJSON, content)
+	}
+}
+
+// BackupRestore restores the backup in the request body (encrypted ones with the snapshot passphrase or the master key);
+// with the `dry_run` query parameter, it only validates the backup. Restoring signs out all the admins.
+func BackupRestore(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		content, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "Cannot read the request body.",
+			})
+		}
+
+		backup, err := coordinator.Database.DecodeBackup(content, coordinator.Config.Snapshot.Passphrase)
+		return restore(c, coordinator, "database", backup, err)
+	}
+}
+
+// SnapshotsIndex returns the snapshots, the newest first.
+func SnapshotsIndex(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		snapshots, err := database.ListSnapshots(coordinator.Config.Snapshot.Directory)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Internal error.",
+			})
+		}
+		return c.JSON(http.StatusOK, snapshots)
+	}
+}
+
+// SnapshotsShow downloads the snapshot file (as it is, encrypted or not) by its ID or `latest`.
+func SnapshotsShow(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		directory := coordinator.Config.Snapshot.Directory
+		snapshot, err := database.FindSnapshot(directory, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Internal error.",
+			})
+		}
+		if snapshot == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"message": "Snapshot not found.",
+			})
+		}
+		audit(c, coordinator, "backup.download", snapshot.Id, nil, nil)
+
+		path := database.SnapshotPath(directory, snapshot.Id)
+		return c.Attachment(path, filepath.Base(path))
+	}
+}
+
+// SnapshotsRestore restores the snapshot by its ID or `latest`, like BackupRestore.
+func SnapshotsRestore(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		directory := coordinator.Config.Snapshot.Directory
+		snapshot, err := database.FindSnapshot(directory, c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Internal error.",
+			})
+		}
+		if snapshot == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"message": "Snapshot not found.",
+			})
+		}
+
+		backup, err := coordinator.Database.ReadSnapshot(directory, snapshot.Id, coordinator.Config.Snapshot.Passphrase)
+		return restore(c, coordinator, snapshot.Id, backup, err)
+	}
+}
+
+// restore restores (or with the `dry_run` query parameter, validates) the decoded backup,
+// unless decoding it has failed (err).
+func restore(c echo.Context, coordinator *coordinator.Coordinator, target string, backup *database.Backup, err error) error {
+	if err == nil {
+		var summary *database.RestoreSummary
+		dryRun := c.QueryParam("dry_run") == "true" || c.QueryParam("dry_run") == "1"
+		if summary, err = coordinator.Database.Restore(backup, dryRun); err == nil {
+			if !dryRun {
+				audit(c, coordinator, "backup.restore", target, nil, summary)
+				go coordinator.Sync()
+			}
+			return c.JSON(http.StatusOK, summary)
+		}
+	}
+
+	if _, ok := err.(database.DataError); ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": err.Error(),
+		})
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{
+		"message": "Cannot update the database.",
+	})
+}
@@ -4,15 +4,30 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/miladrahimi/shadowsocks/internal/coordinator"
 	"github.com/miladrahimi/shadowsocks/internal/database"
+	"github.com/miladrahimi/shadowsocks/pkg/utils"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type KeysStoreRequest struct {
-	Cipher  string `json:"cipher"`
-	Secret  string `json:"secret"`
-	Name    string `json:"name"`
-	Quota   int64  `json:"quota"`
-	Enabled bool   `json:"enabled"`
+	Cipher        string            `json:"cipher"`
+	Secret        string            `json:"secret"`
+	Name          string            `json:"name"`
+	Tags          []string          `json:"tags"`
+	Group         string            `json:"group"`
+	Metadata      map[string]string `json:"metadata"`
+	Placement     string            `json:"placement" validate:"omitempty,oneof=auto manual"`
+	Servers       []string          `json:"servers"`
+	Regions       []string          `json:"regions"`
+	Quotas        database.Quotas   `json:"quotas"`
+	Cap           utils.Bytes       `json:"cap" validate:"min=0"`
+	CapWindow     string            `json:"cap_window" validate:"omitempty,oneof=daily hourly"`
+	Enabled       bool              `json:"enabled"`
+	ExpiresAt     int64             `json:"expires_at" validate:"min=0"`
+	ExpiresAfter  int64             `json:"expires_after" validate:"min=0,max=36500"`
+	BillingCycle  string            `json:"billing_cycle" validate:"omitempty,oneof=monthly weekly lifetime"`
+	BillingAnchor int64             `json:"billing_anchor" validate:"min=0"`
 }
 
 type KeysUpdateRequest struct {
@@ -20,22 +35,98 @@ type KeysUpdateRequest struct {
 	Id string `json:"id"`
 }
 
+type KeysBulkRequest struct {
+	Filter database.KeyFilter `json:"filter"`
+	Action string             `json:"action" validate:"required,oneof=enable disable reset delete"`
+}
+
+type KeysBulkResponse struct {
+	Keys []string `json:"keys"`
+}
+
 type KeyResponse struct {
 	*database.Key
-	Used int64  `json:"used"`
-	Link string `json:"link"`
+	Used       int64                 `json:"used"`
+	Usage      coordinator.KeyMetric `json:"usage"`
+	Lifetime   int64                 `json:"lifetime"`
+	CapUsed    int64                 `json:"cap_used"`
+	CapEnd     int64                 `json:"cap_end"`
+	CycleStart int64                 `json:"cycle_start"`
+	CycleEnd   int64                 `json:"cycle_end"`
+	Link       string                `json:"link"`
+}
+
+// newKeyResponse returns the response of the key with the current billing cycle,
+// its usage in the cycle (in bytes and MB), its lifetime usage in MB, and its usage in the cap window in bytes.
+func newKeyResponse(cdr *coordinator.Coordinator, key *database.Key, externalHttp string) KeyResponse {
+	now := time.Now()
+	kr := KeyResponse{Key: key, Link: externalHttp + "/profile?c=" + key.Code}
+	kr.Usage = coordinator.KeyMetric{Id: key.Id}
+	if m := cdr.FindKeyMetric(key.Id); m != nil {
+		kr.Usage = *m
+		kr.Used = m.Total / 1000000
+	}
+	kr.Lifetime = cdr.Database.UsageTable.Lifetime(key.Id).Total / 1000000
+	if key.Cap != 0 {
+		if m := cdr.FindCapMetric(*key); m != nil {
+			kr.CapUsed = m.Total
+		}
+		kr.CapEnd = key.CapWindowEnd(now).UnixMilli()
+	}
+	kr.CycleStart = key.CycleStart(now).UnixMilli()
+	if end := key.CycleEnd(now); !end.IsZero() {
+		kr.CycleEnd = end.UnixMilli()
+	}
+	return kr
 }
 
+// unknownServer returns the first of the given server IDs that does not exist, or an empty string.
+func unknownServer(coordinator *coordinator.Coordinator, ids []string) string {
+	for _, id := range ids {
+		if id != coordinator.CurrentServer().Id && coordinator.Database.ServerTable.Find(id) == nil {
+			return id
+		}
+	}
+	return ""
+}
+
+// keysFilter reads the key filter from the query parameters; `tag`, `server`, and `region` (repeatable),
+// `group`, `placement`, and `metadata.<name>` (e.g., `metadata.customer=42`).
+func keysFilter(c echo.Context) database.KeyFilter {
+	filter := database.KeyFilter{Metadata: map[string]string{}}
+	for name, values := range c.QueryParams() {
+		switch {
+		case name == "tag":
+			filter.Tags = append(filter.Tags, values...)
+		case name == "server":
+			filter.Servers = append(filter.Servers, values...)
+		case name == "region":
+			filter.Regions = append(filter.Regions, values...)
+		case name == "group":
+			filter.Group = values[0]
+		case name == "placement":
+			filter.Placement = values[0]
+		case strings.HasPrefix(name, "metadata."):
+			filter.Metadata[strings.TrimPrefix(name, "metadata.")] = values[0]
+		}
+	}
+	return filter
+}
+
+// KeysIndex returns the keys, optionally filtered by their tags, group, metadata, placement, servers,
+// and regions (see keysFilter).
 func KeysIndex(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		krs := make([]KeyResponse, 0, len(coordinator.Database.KeyTable.Keys))
-		for _, k := range coordinator.Database.KeyTable.Keys {
-			kr := &KeyResponse{Key: k}
-			kr.Link = coordinator.Database.SettingTable.ExternalHttp + "/profile?c=" + k.Code
-			if m, found := coordinator.KeyMetrics[k.Id]; found {
-				kr.Used = m.Total / 1000000
+		keys := coordinator.Database.KeyTable.All()
+		externalHttp := coordinator.Database.SettingTable.Get().ExternalHttp
+		filter := keysFilter(c)
+
+		krs := make([]KeyResponse, 0, len(keys))
+		for i := range keys {
+			if !filter.Match(&keys[i]) {
+				continue
 			}
-			krs = append(krs, *kr)
+			krs = append(krs, newKeyResponse(coordinator, &keys[i], externalHttp))
 		}
 
 		return c.JSON(http.StatusOK, krs)
@@ -50,13 +141,48 @@ func KeysStore(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 				"message": "Cannot parse the request body.",
 			})
 		}
+		if err := c.Validate(r); err != nil {
+			return err
+		}
+		if r.ExpiresAt != 0 && r.ExpiresAt <= time.Now().UnixMilli() {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "The expiration time must be in the future.",
+			})
+		}
+		if r.BillingAnchor > time.Now().UnixMilli() {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "The billing anchor cannot be in the future.",
+			})
+		}
+		if id := unknownServer(coordinator, r.Servers); id != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "The server " + id + " does not exist.",
+			})
+		}
+
+		// New keys are placed automatically, unless their servers are given or placement is disabled.
+		if r.Placement == "" && len(r.Servers) == 0 && coordinator.Database.SettingTable.Get().PlacementReplicas > 0 {
+			r.Placement = database.KeyPlacementAuto
+		}
 
 		key, err := coordinator.Database.KeyTable.Store(database.Key{
-			Cipher:  r.Cipher,
-			Secret:  r.Secret,
-			Name:    r.Name,
-			Quota:   r.Quota,
-			Enabled: r.Enabled,
+			Cipher:        r.Cipher,
+			Secret:        r.Secret,
+			Name:          r.Name,
+			Tags:          r.Tags,
+			Group:         r.Group,
+			Metadata:      r.Metadata,
+			Placement:     r.Placement,
+			Servers:       r.Servers,
+			Regions:       r.Regions,
+			Quotas:        r.Quotas,
+			Cap:           r.Cap,
+			CapWindow:     r.CapWindow,
+			Enabled:       r.Enabled,
+			ExpiresAt:     r.ExpiresAt,
+			ExpiresAfter:  r.ExpiresAfter,
+			BillingCycle:  r.BillingCycle,
+			BillingAnchor: r.BillingAnchor,
 		})
 		if err != nil {
 			if _, ok := err.(database.DataError); ok {
@@ -69,9 +195,12 @@ func KeysStore(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 			})
 		}
 
+		audit(c, coordinator, "keys.create", key.Id, nil, key)
+
 		go coordinator.Sync()
 
-		return c.JSON(http.StatusCreated, KeyResponse{Key: key, Used: 0})
+		externalHttp := coordinator.Database.SettingTable.Get().ExternalHttp
+		return c.JSON(http.StatusCreated, newKeyResponse(coordinator, key, externalHttp))
 	}
 }
 
@@ -83,14 +212,40 @@ func KeysUpdate(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 				"message": "Cannot parse the request body.",
 			})
 		}
+		if err := c.Validate(r); err != nil {
+			return err
+		}
+		if r.BillingAnchor > time.Now().UnixMilli() {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "The billing anchor cannot be in the future.",
+			})
+		}
+		if id := unknownServer(coordinator, r.Servers); id != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "The server " + id + " does not exist.",
+			})
+		}
 
+		before := coordinator.Database.KeyTable.Find(r.Id)
 		key, err := coordinator.Database.KeyTable.Update(database.Key{
-			Id:      r.Id,
-			Cipher:  r.Cipher,
-			Secret:  r.Secret,
-			Name:    r.Name,
-			Quota:   r.Quota,
-			Enabled: r.Enabled,
+			Id:            r.Id,
+			Cipher:        r.Cipher,
+			Secret:        r.Secret,
+			Name:          r.Name,
+			Tags:          r.Tags,
+			Group:         r.Group,
+			Metadata:      r.Metadata,
+			Placement:     r.Placement,
+			Servers:       r.Servers,
+			Regions:       r.Regions,
+			Quotas:        r.Quotas,
+			Cap:           r.Cap,
+			CapWindow:     r.CapWindow,
+			Enabled:       r.Enabled,
+			ExpiresAt:     r.ExpiresAt,
+			ExpiresAfter:  r.ExpiresAfter,
+			BillingCycle:  r.BillingCycle,
+			BillingAnchor: r.BillingAnchor,
 		})
 		if err != nil {
 			if _, ok := err.(database.DataError); ok {
@@ -107,41 +262,53 @@ func KeysUpdate(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 				"message": "Key not found.",
 			})
 		}
+		audit(c, coordinator, "keys.update", key.Id, before, key)
 
+		go coordinator.CheckStatuses()
 		go coordinator.Sync()
 
-		kr := KeyResponse{Key: key}
-		if m, found := coordinator.KeyMetrics[kr.Id]; found {
-			kr.Used = m.Total / 1000000
-		}
+		externalHttp := coordinator.Database.SettingTable.Get().ExternalHttp
 
-		return c.JSON(http.StatusOK, kr)
+		return c.JSON(http.StatusOK, newKeyResponse(coordinator, key, externalHttp))
 	}
 }
 
 func KeysEmpty(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		key, err := coordinator.Database.KeyTable.RegenerateId(c.Param("id"))
+		before := coordinator.Database.KeyTable.Find(c.Param("id"))
+		key, err := coordinator.ResetKeyUsage(c.Param("id"))
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]interface{}{
 				"message": "Cannot update the database.",
 			})
 		}
+		if key == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"message": "Key not found.",
+			})
+		}
+		audit(c, coordinator, "keys.reset", key.Id, before, key)
 
-		coordinator.Sync()
+		go coordinator.CheckStatuses()
+		go coordinator.Sync()
 
 		return c.JSON(http.StatusOK, key)
 	}
 }
 
+// KeysDelete moves the key to the trash, where it can be restored until it is purged.
 func KeysDelete(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		err := coordinator.Database.KeyTable.Delete(c.Param("id"))
+		before := coordinator.Database.KeyTable.Find(c.Param("id"))
+		key, err := coordinator.Database.KeyTable.Delete(c.Param("id"))
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]interface{}{
 				"message": "Cannot update the database.",
 			})
 		}
+		if key != nil {
+			audit(c, coordinator, "keys.delete", key.Id, before, key)
+		}
 
 		go coordinator.Sync()
 
@@ -158,6 +325,7 @@ func KeysFill(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 			})
 		}
 
+		before := coordinator.Database.KeyTable.All()
 		err := coordinator.Database.KeyTable.Fill(r)
 		if err != nil {
 			if _, ok := err.(database.DataError); ok {
@@ -169,9 +337,88 @@ func KeysFill(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 				"message": "Internal error.",
 			})
 		}
+		auditFill(c, coordinator, before, coordinator.Database.KeyTable.All())
 
 		go coordinator.Sync()
 
 		return c.NoContent(http.StatusNoContent)
 	}
 }
+
+// auditFill records the keys that the fill has created, changed, or deleted.
+func auditFill(c echo.Context, coordinator *coordinator.Coordinator, before, after []database.Key) {
+	previous := map[string]database.Key{}
+	for _, k := range before {
+		previous[k.Id] = k
+	}
+	for _, k := range after {
+		if p, found := previous[k.Id]; found {
+			audit(c, coordinator, "keys.fill", k.Id, p, k)
+			delete(previous, k.Id)
+		} else {
+			audit(c, coordinator, "keys.fill", k.Id, nil, k)
+		}
+	}
+	for _, p := range previous {
+		audit(c, coordinator, "keys.fill", p.Id, p, nil)
+	}
+}
+
+// KeysBulk applies the action (enable, disable, reset, or delete) to all the keys that match the filter;
+// the deleted keys are moved to the trash.
+// The filter must have a criterion, so all the keys are never affected by mistake.
+func KeysBulk(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var r KeysBulkRequest
+		if err := c.Bind(&r); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "Cannot parse the request body.",
+			})
+		}
+		if err := c.Validate(r); err != nil {
+			return err
+		}
+		if r.Filter.IsEmpty() {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "The filter must have at least a tag, group, metadata, placement, server, or region.",
+			})
+		}
+
+		response := KeysBulkResponse{Keys: []string{}}
+		for _, k := range coordinator.Database.KeyTable.All() {
+			if !r.Filter.Match(&k) {
+				continue
+			}
+
+			var key *database.Key
+			var err error
+			switch r.Action {
+			case "enable":
+				key, err = coordinator.Database.KeyTable.SetEnabled(k.Id, true)
+			case "disable":
+				key, err = coordinator.Database.KeyTable.SetEnabled(k.Id, false)
+			case "reset":
+				key, err = coordinator.ResetKeyUsage(k.Id)
+			case "delete":
+				key, err = coordinator.Database.KeyTable.Delete(k.Id)
+			}
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+					"message": "Cannot update the database.",
+					"keys":    response.Keys,
+				})
+			}
+
+			if key != nil {
+				audit(c, coordinator, "keys."+r.Action, k.Id, k, key)
+			}
+
+			response.Keys = append(response.Keys, k.Id)
+		}
+
+		go coordinator.CheckStatuses()
+		go coordinator.Sync()
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
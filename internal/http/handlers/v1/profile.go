@@ -7,16 +7,93 @@ import (
 	"github.com/labstack/gommon/random"
 	"github.com/miladrahimi/shadowsocks/internal/coordinator"
 	"github.com/miladrahimi/shadowsocks/internal/database"
+	"github.com/miladrahimi/shadowsocks/pkg/utils"
 	"net/http"
 	"strings"
+	"time"
 )
 
+// ProfileResponse is the public view of a key for its holder;
+// the admin attributes of the key (like its code, tags, metadata, and servers) are never exposed.
 type ProfileResponse struct {
-	database.Key
-	coordinator.KeyMetric
-	SSCONF       string   `json:"ssconf"`
-	Subscription string   `json:"subscription"`
-	SSKeys       []string `json:"ss_keys"`
+	Name          string          `json:"name"`
+	Enabled       bool            `json:"enabled"`
+	Status        string          `json:"status"`
+	StatusReason  string          `json:"status_reason"`
+	CreatedAt     int64           `json:"created_at"`
+	ExpiresAt     int64           `json:"expires_at"`
+	BillingCycle  string          `json:"billing_cycle"`
+	Quotas        database.Quotas `json:"quotas"`
+	Quota         int64           `json:"quota"`
+	DownTcp       int64           `json:"down_tcp"`
+	UpTcp         int64           `json:"up_tcp"`
+	DownUdp       int64           `json:"down_udp"`
+	UpUdp         int64           `json:"up_udp"`
+	Total         int64           `json:"total"`
+	RemainingDays int64           `json:"remaining_days"`
+	CycleStart    int64           `json:"cycle_start"`
+	CycleEnd      int64           `json:"cycle_end"`
+	SSCONF        string          `json:"ssconf"`
+	Subscription  string          `json:"subscription"`
+	SSKeys        []string        `json:"ss_keys"`
+}
+
+// newProfileResponse returns the public view of the key with its links and its usage in the current cycle,
+// both scaled by the traffic ratio.
+func newProfileResponse(cdr *coordinator.Coordinator, key *database.Key) ProfileResponse {
+	settings := cdr.Database.SettingTable.Get()
+
+	r := ProfileResponse{
+		Name:         key.Name,
+		Enabled:      key.Enabled,
+		Status:       key.Status,
+		StatusReason: key.StatusReason,
+		CreatedAt:    key.CreatedAt,
+		ExpiresAt:    key.ExpiresAt,
+		BillingCycle: key.BillingCycle,
+		SSKeys:       []string{},
+	}
+	r.Quotas = database.Quotas{
+		Total:    utils.Bytes(float64(key.Quotas.Total) * settings.TrafficRatio),
+		Download: utils.Bytes(float64(key.Quotas.Download) * settings.TrafficRatio),
+		Upload:   utils.Bytes(float64(key.Quotas.Upload) * settings.TrafficRatio),
+		Tcp:      utils.Bytes(float64(key.Quotas.Tcp) * settings.TrafficRatio),
+		Udp:      utils.Bytes(float64(key.Quotas.Udp) * settings.TrafficRatio),
+	}
+	r.Quota = int64(r.Quotas.Total) / 1000000
+	now := time.Now()
+	r.RemainingDays = key.RemainingDays(now.UnixMilli())
+	r.CycleStart = key.CycleStart(now).UnixMilli()
+	if end := key.CycleEnd(now); !end.IsZero() {
+		r.CycleEnd = end.UnixMilli()
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte(key.Cipher + ":" + key.Secret))
+
+	if settings.ExternalHttps != "" {
+		url := strings.Replace(settings.ExternalHttps, "https://", "ssconf://", 1)
+		r.SSCONF = fmt.Sprintf("%s/ssconf/%s.json#%s", url, auth, key.Name)
+	}
+
+	if settings.ExternalHttp != "" {
+		r.Subscription = fmt.Sprintf("%s/subscription/%s#%s", settings.ExternalHttp, auth, key.Name)
+	}
+
+	for _, s := range cdr.KeyServers(key) {
+		r.SSKeys = append(r.SSKeys, fmt.Sprintf(
+			"ss://%s@%s:%d/?outline=1#%s", auth, s.ShadowsocksHost, s.ShadowsocksPort, key.Name,
+		))
+	}
+
+	if m := cdr.FindKeyMetric(key.Id); m != nil {
+		r.DownTcp = int64(float64(m.DownTcp)*settings.TrafficRatio) / 1000000
+		r.DownUdp = int64(float64(m.DownUdp)*settings.TrafficRatio) / 1000000
+		r.UpTcp = int64(float64(m.UpTcp)*settings.TrafficRatio) / 1000000
+		r.UpUdp = int64(float64(m.UpUdp)*settings.TrafficRatio) / 1000000
+		r.Total = int64(float64(m.Total)*settings.TrafficRatio) / 1000000
+	}
+
+	return r
 }
 
 func ProfileShow(cdr *coordinator.Coordinator) echo.HandlerFunc {
@@ -33,42 +110,7 @@ func ProfileShow(cdr *coordinator.Coordinator) echo.HandlerFunc {
 			})
 		}
 
-		var r ProfileResponse
-		r.Key = *key
-		r.Quota = int64(float64(r.Quota) * cdr.Database.SettingTable.TrafficRatio)
-
-		auth := base64.StdEncoding.EncodeToString([]byte(r.Cipher + ":" + r.Secret))
-		settings := cdr.Database.SettingTable
-
-		if settings.ExternalHttps != "" {
-			url := strings.Replace(settings.ExternalHttps, "https://", "ssconf://", 1)
-			r.SSCONF = fmt.Sprintf("%s/ssconf/%s.json#%s", url, auth, r.Name)
-		}
-
-		if settings.ExternalHttp != "" {
-			r.Subscription = fmt.Sprintf("%s/subscription/%s#%s", settings.ExternalHttp, auth, r.Name)
-		}
-
-		for _, s := range append(cdr.Database.ServerTable.Servers, cdr.CurrentServer()) {
-			if s.ShadowsocksEnabled && s.Status == database.ServerStatusActive {
-				r.SSKeys = append(r.SSKeys, fmt.Sprintf(
-					"ss://%s@%s:%d/?outline=1#%s", auth, s.ShadowsocksHost, s.ShadowsocksPort, r.Name,
-				))
-			}
-		}
-
-		if m, found := cdr.KeyMetrics[key.Id]; found {
-			r.KeyMetric = coordinator.KeyMetric{
-				Id:      m.Id,
-				DownTcp: int64(float64(m.DownTcp)*cdr.Database.SettingTable.TrafficRatio) / 1000000,
-				DownUdp: int64(float64(m.DownUdp)*cdr.Database.SettingTable.TrafficRatio) / 1000000,
-				UpTcp:   int64(float64(m.UpTcp)*cdr.Database.SettingTable.TrafficRatio) / 1000000,
-				UpUdp:   int64(float64(m.UpUdp)*cdr.Database.SettingTable.TrafficRatio) / 1000000,
-				Total:   int64(float64(m.Total)*cdr.Database.SettingTable.TrafficRatio) / 1000000,
-			}
-		}
-
-		return c.JSON(http.StatusOK, r)
+		return c.JSON(http.StatusOK, newProfileResponse(cdr, key))
 	}
 }
 
@@ -86,8 +128,10 @@ func ProfileReset(cdr *coordinator.Coordinator) echo.HandlerFunc {
 			})
 		}
 
-		key.Secret = random.String(16)
-		key, err = cdr.Database.KeyTable.Update(*key)
+		before := key
+		key, err = cdr.Database.KeyTable.Modify(key.Id, func(k *database.Key) {
+			k.Secret = random.String(16)
+		})
 		if err != nil {
 			if _, ok := err.(database.DataError); ok {
 				return c.JSON(http.StatusBadRequest, map[string]string{
@@ -98,8 +142,14 @@ func ProfileReset(cdr *coordinator.Coordinator) echo.HandlerFunc {
 				"message": "Internal error.",
 			})
 		}
+		if key == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"message": "Not found.",
+			})
+		}
+		cdr.Audit("key:"+key.Id, c.RealIP(), "keys.reset_secret", key.Id, before, key)
 		cdr.Sync()
 
-		return c.JSON(http.StatusOK, key)
+		return c.JSON(http.StatusOK, newProfileResponse(cdr, key))
 	}
 }
@@ -9,14 +9,17 @@ import (
 
 type ServerResponse struct {
 	database.Server
-	Id   string `json:"id"`
-	Used int64  `json:"used"`
+	Id       string `json:"id"`
+	Used     int64  `json:"used"`
+	Lifetime int64  `json:"lifetime"`
+	Keys     int    `json:"keys"`
 }
 
 type ServersStoreRequest struct {
 	HttpHost string `json:"http_host"`
 	HttpPort int    `json:"http_port"`
 	ApiToken string `json:"api_token"`
+	Region   string `json:"region"`
 }
 
 type ServersUpdateRequest struct {
@@ -24,24 +27,48 @@ type ServersUpdateRequest struct {
 	Id string `json:"id"`
 }
 
+// countServerKeys counts the keys that the server serves.
+func countServerKeys(keys []database.Key, server *database.Server) int {
+	count := 0
+	for i := range keys {
+		if keys[i].AllowsServer(server) {
+			count++
+		}
+	}
+	return count
+}
+
 func ServersIndex(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		servers := make([]ServerResponse, 0, len(coordinator.Database.ServerTable.Servers)+1)
+		all := coordinator.Database.ServerTable.All()
+		keys := coordinator.Database.KeyTable.All()
+		servers := make([]ServerResponse, 0, len(all)+1)
 
 		server := ServerResponse{Server: *coordinator.CurrentServer(), Id: "s-0"}
-		if m, found := coordinator.ServerMetrics["s-0"]; found {
+		if m := coordinator.FindServerMetric("s-0"); m != nil {
 			server.Used = m.Total / 1000000
 		}
+		server.Lifetime = coordinator.Database.UsageTable.Lifetime("s-0").Total / 1000000
+		server.Keys = countServerKeys(keys, &server.Server)
 		servers = append(servers, server)
 
-		for _, s := range coordinator.Database.ServerTable.Servers {
-			server = ServerResponse{Server: *s, Id: s.Id}
-			if m, found := coordinator.ServerMetrics[s.Id]; found {
+		for _, s := range all {
+			server = ServerResponse{Server: s, Id: s.Id}
+			if m := coordinator.FindServerMetric(s.Id); m != nil {
 				server.Used = m.Total / 1000000
 			}
+			server.Lifetime = coordinator.Database.UsageTable.Lifetime(s.Id).Total / 1000000
+			server.Keys = countServerKeys(keys, &server.Server)
 			servers = append(servers, server)
 		}
 
+		// The API tokens of the servers grant full access to them, so only the ones who can change servers see them.
+		if !allows(c, database.AdminRoleOperator, database.TokenScopeServersWrite) {
+			for i := range servers {
+				servers[i].ApiToken = ""
+			}
+		}
+
 		return c.JSON(http.StatusOK, servers)
 	}
 }
@@ -59,6 +86,7 @@ func ServersStore(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 			HttpHost: r.HttpHost,
 			HttpPort: r.HttpPort,
 			ApiToken: r.ApiToken,
+			Region:   r.Region,
 		})
 		if err != nil {
 			if _, ok := err.(database.DataError); ok {
@@ -71,6 +99,8 @@ func ServersStore(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 			})
 		}
 
+		audit(c, coordinator, "servers.create", server.Id, nil, server)
+
 		go coordinator.Sync()
 
 		sr := ServerResponse{Server: *server, Id: server.Id}
@@ -95,11 +125,13 @@ func ServersUpdate(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 			})
 		}
 
+		before := *server
 		server, err := coordinator.Database.ServerTable.Update(database.Server{
 			Id:                 r.Id,
 			HttpHost:           r.HttpHost,
 			HttpPort:           r.HttpPort,
 			ApiToken:           r.ApiToken,
+			Region:             r.Region,
 			ShadowsocksEnabled: server.ShadowsocksEnabled,
 			ShadowsocksHost:    server.ShadowsocksHost,
 			ShadowsocksPort:    server.ShadowsocksPort,
@@ -121,6 +153,7 @@ func ServersUpdate(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 				"message": "Server not found.",
 			})
 		}
+		audit(c, coordinator, "servers.update", server.Id, before, server)
 
 		go coordinator.Sync()
 
@@ -128,7 +161,7 @@ func ServersUpdate(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 			Server: *server,
 			Id:     server.Id,
 		}
-		if m, found := coordinator.ServerMetrics[sr.Id]; found {
+		if m := coordinator.FindServerMetric(sr.Id); m != nil {
 			sr.Used = m.Total / 1000000
 		}
 
@@ -136,16 +169,21 @@ func ServersUpdate(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 	}
 }
 
+// ServersDelete moves the server to the trash, where it can be restored until it is purged.
 func ServersDelete(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		id := c.Param("id")
 
-		err := coordinator.Database.ServerTable.Delete(id)
+		before := coordinator.Database.ServerTable.Find(id)
+		server, err := coordinator.Database.ServerTable.Delete(id)
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, map[string]interface{}{
 				"message": "Cannot update the database.",
 			})
 		}
+		if server != nil {
+			audit(c, coordinator, "servers.delete", id, before, server)
+		}
 
 		go coordinator.Sync()
 
@@ -0,0 +1,81 @@
+package v1
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/miladrahimi/shadowsocks/internal/coordinator"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"net/http"
+)
+
+type SessionResponse struct {
+	Id               string `json:"id"`
+	AdminId          string `json:"admin_id"`
+	Username         string `json:"username"`
+	RemoteIp         string `json:"remote_ip"`
+	UserAgent        string `json:"user_agent"`
+	CreatedAt        int64  `json:"created_at"`
+	RefreshedAt      int64  `json:"refreshed_at"`
+	ExpiresAt        int64  `json:"expires_at"`
+	RefreshExpiresAt int64  `json:"refresh_expires_at"`
+	Current          bool   `json:"current"`
+}
+
+// visibleSession checks if the authorized admin can see and revoke the session;
+// owners can manage all the sessions, and the others only their own.
+func visibleSession(c echo.Context, s *database.Session) bool {
+	admin := currentAdmin(c)
+	return allows(c, database.AdminRoleOwner, "") || (admin != nil && admin.Id == s.AdminId)
+}
+
+func SessionsIndex(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		current := currentSession(c)
+		sessions := make([]SessionResponse, 0)
+		for _, s := range coordinator.Database.SessionTable.All() {
+			if !visibleSession(c, &s) {
+				continue
+			}
+			sr := SessionResponse{
+				Id:               s.Id,
+				AdminId:          s.AdminId,
+				RemoteIp:         s.RemoteIp,
+				UserAgent:        s.UserAgent,
+				CreatedAt:        s.CreatedAt,
+				RefreshedAt:      s.RefreshedAt,
+				ExpiresAt:        s.ExpiresAt,
+				RefreshExpiresAt: s.RefreshExpiresAt,
+				Current:          current != nil && current.Id == s.Id,
+			}
+			if admin := coordinator.Database.AdminTable.Find(s.AdminId); admin != nil {
+				sr.Username = admin.Username
+			}
+			sessions = append(sessions, sr)
+		}
+		return c.JSON(http.StatusOK, sessions)
+	}
+}
+
+func SessionsDelete(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var revoked *database.Session
+		err := coordinator.Database.SessionTable.Revoke(func(s database.Session) bool {
+			if s.Id != c.Param("id") || !visibleSession(c, &s) {
+				return false
+			}
+			revoked = &s
+			return true
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		if revoked == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"message": "Session not found.",
+			})
+		}
+		audit(c, coordinator, "sessions.revoke", revoked.Id, revoked, nil)
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -9,38 +9,59 @@ import (
 )
 
 type SettingsResponse struct {
-	database.SettingTable
+	database.Settings
 	HttpPort int `json:"http_port"`
 }
 
 func SettingsShow(cfg *config.Config, coordinator *coordinator.Coordinator) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		return c.JSON(http.StatusOK, SettingsResponse{
-			SettingTable: *coordinator.Database.SettingTable,
-			HttpPort:     cfg.HttpServer.Port,
+			Settings: redactSettings(c, coordinator.Database.SettingTable.Get()),
+			HttpPort: cfg.HttpServer.Port,
 		})
 	}
 }
 
+// redactSettings hides the API token of the settings from everyone but the master (reading the settings).
+// It grants the master access to this node, so the admins can only replace it.
+func redactSettings(c echo.Context, settings database.Settings) database.Settings {
+	if token, _ := c.Get("token").(*database.Token); token != nil || currentAdmin(c) != nil {
+		settings.ApiToken = ""
+	}
+	return settings
+}
+
 func SettingsUpdate(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		var r database.SettingTable
+		var r database.Settings
 		if err := c.Bind(&r); err != nil {
 			return c.JSON(http.StatusBadRequest, map[string]string{
 				"message": "Cannot parse the request body.",
 			})
 		}
 
-		coordinator.Database.SettingTable.ExternalHttps = r.ExternalHttps
-		coordinator.Database.SettingTable.ExternalHttp = r.ExternalHttp
-		coordinator.Database.SettingTable.ShadowsocksHost = r.ShadowsocksHost
-		coordinator.Database.SettingTable.ShadowsocksPort = r.ShadowsocksPort
-		coordinator.Database.SettingTable.ShadowsocksEnabled = r.ShadowsocksEnabled
-		coordinator.Database.SettingTable.ApiToken = r.ApiToken
-		coordinator.Database.SettingTable.AdminPassword = r.AdminPassword
-		coordinator.Database.SettingTable.TrafficRatio = r.TrafficRatio
+		before := coordinator.Database.SettingTable.Get()
+		// An empty API token keeps the current one, and the named API tokens cannot replace it.
+		if r.ApiToken == "" {
+			r.ApiToken = before.ApiToken
+		} else if token, _ := c.Get("token").(*database.Token); token != nil {
+			return c.JSON(http.StatusForbidden, map[string]string{
+				"message": "API tokens cannot change the API token of the settings.",
+			})
+		}
 
-		if err := coordinator.Database.SettingTable.Save(); err != nil {
+		settings, err := coordinator.Database.SettingTable.Modify(func(s *database.Settings) {
+			s.ExternalHttps = r.ExternalHttps
+			s.ExternalHttp = r.ExternalHttp
+			s.ShadowsocksHost = r.ShadowsocksHost
+			s.ShadowsocksPort = r.ShadowsocksPort
+			s.ShadowsocksEnabled = r.ShadowsocksEnabled
+			s.Region = r.Region
+			s.PlacementReplicas = r.PlacementReplicas
+			s.ApiToken = r.ApiToken
+			s.TrafficRatio = r.TrafficRatio
+		})
+		if err != nil {
 			if _, ok := err.(database.DataError); ok {
 				return c.JSON(http.StatusBadRequest, map[string]string{
 					"message": err.Error(),
@@ -48,9 +69,10 @@ func SettingsUpdate(coordinator *coordinator.Coordinator) echo.HandlerFunc {
 			}
 			return err
 		}
+		audit(c, coordinator, "settings.update", "settings", before, settings)
 
 		go coordinator.Sync()
 
-		return c.JSON(http.StatusOK, coordinator.Database.SettingTable)
+		return c.JSON(http.StatusOK, redactSettings(c, settings))
 	}
 }
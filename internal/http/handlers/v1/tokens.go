@@ -0,0 +1,154 @@
+package v1
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/miladrahimi/shadowsocks/internal/coordinator"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"net/http"
+)
+
+type TokenResponse struct {
+	Id         string   `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  int64    `json:"created_at"`
+	ExpiresAt  int64    `json:"expires_at"`
+	LastUsedAt int64    `json:"last_used_at"`
+	// Token is the plain token, which is only returned when the token is created.
+	Token string `json:"token,omitempty"`
+}
+
+type TokensStoreRequest struct {
+	Name      string   `json:"name" validate:"required,max=64"`
+	Scopes    []string `json:"scopes" validate:"required,min=1,dive,oneof=keys:read keys:write servers:read servers:write settings audit:read"`
+	ExpiresAt int64    `json:"expires_at" validate:"min=0"`
+}
+
+type TokensUpdateRequest struct {
+	TokensStoreRequest
+	Id string `json:"id" validate:"required"`
+}
+
+func newTokenResponse(t *database.Token) TokenResponse {
+	return TokenResponse{
+		Id:         t.Id,
+		Name:       t.Name,
+		Prefix:     t.Prefix,
+		Scopes:     t.Scopes,
+		CreatedAt:  t.CreatedAt,
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedAt: t.LastUsedAt,
+	}
+}
+
+func TokensIndex(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		all := coordinator.Database.TokenTable.All()
+		tokens := make([]TokenResponse, 0, len(all))
+		for i := range all {
+			tokens = append(tokens, newTokenResponse(&all[i]))
+		}
+		return c.JSON(http.StatusOK, tokens)
+	}
+}
+
+// TokensStore creates a token; the plain token is in the response and cannot be retrieved later.
+func TokensStore(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var r TokensStoreRequest
+		if err := c.Bind(&r); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "Cannot parse the request body.",
+			})
+		}
+		if err := c.Validate(r); err != nil {
+			return err
+		}
+
+		token, plain, err := coordinator.Database.TokenTable.Store(database.Token{
+			Name:      r.Name,
+			Scopes:    r.Scopes,
+			ExpiresAt: r.ExpiresAt,
+		})
+		if err != nil {
+			if _, ok := err.(database.DataError); ok {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"message": err.Error(),
+				})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Internal error.",
+			})
+		}
+
+		audit(c, coordinator, "tokens.create", token.Id, nil, token)
+
+		tr := newTokenResponse(token)
+		tr.Token = plain
+
+		return c.JSON(http.StatusCreated, tr)
+	}
+}
+
+func TokensUpdate(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var r TokensUpdateRequest
+		if err := c.Bind(&r); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "Cannot parse the request body.",
+			})
+		}
+		if err := c.Validate(r); err != nil {
+			return err
+		}
+
+		var before database.Token
+		token, err := coordinator.Database.TokenTable.Modify(r.Id, func(t *database.Token) {
+			before = *t
+			t.Name = r.Name
+			t.Scopes = r.Scopes
+			t.ExpiresAt = r.ExpiresAt
+		})
+		if err != nil {
+			if _, ok := err.(database.DataError); ok {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"message": err.Error(),
+				})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Internal error.",
+			})
+		}
+		if token == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"message": "Token not found.",
+			})
+		}
+		audit(c, coordinator, "tokens.update", token.Id, before, token)
+
+		return c.JSON(http.StatusOK, newTokenResponse(token))
+	}
+}
+
+func TokensDelete(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var before *database.Token
+		for _, t := range coordinator.Database.TokenTable.All() {
+			if t.Id == c.Param("id") {
+				found := t
+				before = &found
+				break
+			}
+		}
+		if err := coordinator.Database.TokenTable.Delete(c.Param("id")); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		if before != nil {
+			audit(c, coordinator, "tokens.delete", before.Id, before, nil)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
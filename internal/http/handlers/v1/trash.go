@@ -0,0 +1,153 @@
+package v1
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/miladrahimi/shadowsocks/internal/coordinator"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"net/http"
+)
+
+type TrashedKeyResponse struct {
+	database.Key
+	PurgeAt int64 `json:"purge_at"`
+}
+
+type TrashedServerResponse struct {
+	database.Server
+	PurgeAt int64 `json:"purge_at"`
+}
+
+// TrashKeysIndex returns the deleted keys with the time they are purged (zero if never).
+func TrashKeysIndex(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		keys := coordinator.Database.KeyTable.Trash()
+		response := make([]TrashedKeyResponse, 0, len(keys))
+		for _, k := range keys {
+			response = append(response, TrashedKeyResponse{Key: k, PurgeAt: coordinator.TrashPurgeAt(k.DeletedAt)})
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func TrashKeysRestore(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var before *database.Key
+		for _, k := range coordinator.Database.KeyTable.Trash() {
+			if k.Id == c.Param("id") {
+				before = &k
+				break
+			}
+		}
+
+		key, err := coordinator.Database.KeyTable.Restore(c.Param("id"))
+		if err != nil {
+			if _, ok := err.(database.DataError); ok {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"message": err.Error(),
+				})
+			}
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		if key == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"message": "Key not found in the trash.",
+			})
+		}
+		audit(c, coordinator, "keys.restore", key.Id, before, key)
+
+		go coordinator.CheckStatuses()
+		go coordinator.Sync()
+
+		externalHttp := coordinator.Database.SettingTable.Get().ExternalHttp
+		return c.JSON(http.StatusOK, newKeyResponse(coordinator, key, externalHttp))
+	}
+}
+
+// TrashKeysPurge removes the key from the trash permanently, along with its usage data.
+func TrashKeysPurge(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key, err := coordinator.PurgeKey(c.Param("id"))
+		if key != nil {
+			audit(c, coordinator, "keys.purge", key.Id, key, nil)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		if key == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"message": "Key not found in the trash.",
+			})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// TrashServersIndex returns the deleted servers with the time they are purged (zero if never).
+func TrashServersIndex(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		servers := coordinator.Database.ServerTable.Trash()
+		response := make([]TrashedServerResponse, 0, len(servers))
+		for _, s := range servers {
+			// The API tokens of the servers grant full access to them, so only the ones who can change servers see them.
+			if !allows(c, database.AdminRoleOperator, database.TokenScopeServersWrite) {
+				s.ApiToken = ""
+			}
+			response = append(response, TrashedServerResponse{Server: s, PurgeAt: coordinator.TrashPurgeAt(s.DeletedAt)})
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func TrashServersRestore(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var before *database.Server
+		for _, s := range coordinator.Database.ServerTable.Trash() {
+			if s.Id == c.Param("id") {
+				before = &s
+				break
+			}
+		}
+
+		server, err := coordinator.Database.ServerTable.Restore(c.Param("id"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		if server == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"message": "Server not found in the trash.",
+			})
+		}
+		audit(c, coordinator, "servers.restore", server.Id, before, server)
+
+		go coordinator.Sync()
+
+		return c.JSON(http.StatusOK, ServerResponse{Server: *server, Id: server.Id})
+	}
+}
+
+// TrashServersPurge removes the server from the trash permanently, along with its usage data.
+func TrashServersPurge(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		server, err := coordinator.PurgeServer(c.Param("id"))
+		if server != nil {
+			audit(c, coordinator, "servers.purge", server.Id, server, nil)
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{
+				"message": "Cannot update the database.",
+			})
+		}
+		if server == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{
+				"message": "Server not found in the trash.",
+			})
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,36 @@
+package v1
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/miladrahimi/shadowsocks/internal/coordinator"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+	"net/http"
+	"time"
+)
+
+type UsageResponse struct {
+	Lifetime database.Usage   `json:"lifetime"`
+	Days     []database.Usage `json:"days"`
+}
+
+// UsageShow returns the daily usage rollups (in bytes) of the key or server with the given ID.
+// The optional `from` and `to` query parameters (YYYY-MM-DD) limit the days.
+// The days older than the usage retention are returned as monthly rollups (YYYY-MM).
+func UsageShow(coordinator *coordinator.Coordinator) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		from, to := c.QueryParam("from"), c.QueryParam("to")
+		for _, date := range []string{from, to} {
+			if _, err := time.Parse(database.UsageDateLayout, date); date != "" && err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"message": "The dates must be in the YYYY-MM-DD format.",
+				})
+			}
+		}
+
+		id := c.Param("id")
+		return c.JSON(http.StatusOK, UsageResponse{
+			Lifetime: coordinator.Database.UsageTable.Lifetime(id),
+			Days:     coordinator.Database.UsageTable.Between(id, from, to),
+		})
+	}
+}
@@ -1,26 +1,79 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"github.com/labstack/echo/v4"
 	"github.com/miladrahimi/shadowsocks/internal/database"
 	"strings"
 )
 
-func Authorize(d *database.Database) func(echo.HandlerFunc) echo.HandlerFunc {
+// Authorize allows the requests of the admins with the given role (or a higher one),
+// authenticated by the access tokens of their sessions,
+// and the requests of the named API tokens with the given scope (no scope means admins only).
+// The authorized admin, session, and API token (nil if not used) are set in the context
+// as "admin", "session", and "token".
+func Authorize(d *database.Database, role, scope string) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(context echo.Context) error {
-			if !authorizeToken(d.SettingTable.ApiToken, context) {
+			context.Set("admin", (*database.Admin)(nil))
+			context.Set("session", (*database.Session)(nil))
+			context.Set("token", (*database.Token)(nil))
+
+			token := bearerToken(context)
+			if token == "" {
 				return echo.ErrUnauthorized
 			}
-			return next(context)
+			if session := d.SessionTable.Authenticate(token); session != nil {
+				admin := d.AdminTable.Find(session.AdminId)
+				if admin == nil {
+					return echo.ErrUnauthorized
+				}
+				if !database.RoleAllows(admin.Role, role) {
+					return echo.ErrForbidden
+				}
+				context.Set("admin", admin)
+				context.Set("session", session)
+				return next(context)
+			}
+
+			if t := d.TokenTable.Authenticate(token); t != nil {
+				if scope == "" || !t.HasScope(scope) {
+					return echo.ErrForbidden
+				}
+				context.Set("token", t)
+				return next(context)
+			}
+
+			return echo.ErrUnauthorized
 		}
 	}
 }
 
-func authorizeToken(token string, context echo.Context) bool {
+func bearerToken(context echo.Context) string {
 	authHeader := context.Request().Header.Get("Authorization")
 	if strings.HasPrefix(authHeader, "Bearer ") {
-		return authHeader[len("Bearer "):] == token
+		return authHeader[len("Bearer "):]
+	}
+	return ""
+}
+
+// AuthorizeNode works like Authorize and also allows the requests of the other nodes,
+// authenticated by the API token of the settings.
+// It must be used only on the routes the master calls on its nodes (reading the settings and filling the keys).
+func AuthorizeNode(d *database.Database, role, scope string) echo.MiddlewareFunc {
+	authorize := Authorize(d, role, scope)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		authorized := authorize(next)
+		return func(context echo.Context) error {
+			token := bearerToken(context)
+			apiToken := d.SettingTable.Get().ApiToken
+			if token != "" && apiToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) == 1 {
+				context.Set("admin", (*database.Admin)(nil))
+				context.Set("session", (*database.Session)(nil))
+				context.Set("token", (*database.Token)(nil))
+				return next(context)
+			}
+			return authorized(context)
+		}
 	}
-	return false
 }
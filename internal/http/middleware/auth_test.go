@@ -0,0 +1,221 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/miladrahimi/shadowsocks/internal/config"
+	"github.com/miladrahimi/shadowsocks/internal/database"
+)
+
+// newTestDatabase creates a database in a temporary directory.
+func newTestDatabase(t *testing.T) *database.Database {
+	t.Helper()
+	t.Setenv(database.MasterKeyEnv, "")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(wd)
+	})
+	if err = os.MkdirAll(database.Directory, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Database.Driver = database.DriverJson
+	d, err := database.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = d.Close()
+	})
+	return d
+}
+
+// signIn creates an admin with the given role and returns the access token of a new session of it.
+func signIn(t *testing.T, d *database.Database, username, role string) (*database.Admin, string) {
+	t.Helper()
+	admin, err := d.AdminTable.Store(database.Admin{Username: username, Role: role}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, tokens, err := d.SessionTable.Create(admin.Id, "127.0.0.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return admin, tokens.Token
+}
+
+// authorized runs the middleware with the bearer token and returns the response status
+// and the context that the next handler got (nil if it was not called).
+func authorized(mw echo.MiddlewareFunc, token string) (int, echo.Context) {
+	e := echo.New()
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	if token != "" {
+		request.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	context := e.NewContext(request, httptest.NewRecorder())
+
+	var next echo.Context
+	err := mw(func(c echo.Context) error {
+		next = c
+		return c.NoContent(http.StatusOK)
+	})(context)
+
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code, next
+	}
+	return context.Response().Status, next
+}
+
+func TestAuthorizeRoles(t *testing.T) {
+	d := newTestDatabase(t)
+	tokens := map[string]string{}
+	for _, role := range []string{database.AdminRoleOwner, database.AdminRoleOperator, database.AdminRoleReadOnly} {
+		_, tokens[role] = signIn(t, d, "test"+role[:4], role)
+	}
+
+	cases := []struct {
+		role     string
+		required string
+		status   int
+	}{
+		{database.AdminRoleOwner, database.AdminRoleOwner, http.StatusOK},
+		{database.AdminRoleOwner, database.AdminRoleOperator, http.StatusOK},
+		{database.AdminRoleOwner, database.AdminRoleReadOnly, http.StatusOK},
+		{database.AdminRoleOperator, database.AdminRoleOwner, http.StatusForbidden},
+		{database.AdminRoleOperator, database.AdminRoleOperator, http.StatusOK},
+		{database.AdminRoleOperator, database.AdminRoleReadOnly, http.StatusOK},
+		{database.AdminRoleReadOnly, database.AdminRoleOwner, http.StatusForbidden},
+		{database.AdminRoleReadOnly, database.AdminRoleOperator, http.StatusForbidden},
+		{database.AdminRoleReadOnly, database.AdminRoleReadOnly, http.StatusOK},
+	}
+	for _, c := range cases {
+		status, next := authorized(Authorize(d, c.required, database.TokenScopeKeysRead), tokens[c.role])
+		if status != c.status {
+			t.Errorf("%s on a %s route: status %d, want %d", c.role, c.required, status, c.status)
+		}
+		if next == nil {
+			continue
+		}
+		if admin, _ := next.Get("admin").(*database.Admin); admin == nil || admin.Role != c.role {
+			t.Errorf("%s on a %s route: admin %+v in the context", c.role, c.required, admin)
+		}
+		if session, _ := next.Get("session").(*database.Session); session == nil {
+			t.Errorf("%s on a %s route: no session in the context", c.role, c.required)
+		}
+	}
+
+	for name, token := range map[string]string{"no token": "", "unknown token": "unknown"} {
+		if status, _ := authorized(Authorize(d, database.AdminRoleReadOnly, ""), token); status != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want %d", name, status, http.StatusUnauthorized)
+		}
+	}
+
+	// The sessions of the deleted admins no longer work.
+	admin, token := signIn(t, d, "deleted", database.AdminRoleOperator)
+	if err := d.AdminTable.Delete(admin.Id); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := authorized(Authorize(d, database.AdminRoleReadOnly, ""), token); status != http.StatusUnauthorized {
+		t.Errorf("deleted admin: status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthorizeTokenScopes(t *testing.T) {
+	d := newTestDatabase(t)
+	token, plain, err := d.TokenTable.Store(database.Token{
+		Name:   "test",
+		Scopes: []string{database.TokenScopeKeysRead, database.TokenScopeServersWrite},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		scope  string
+		status int
+	}{
+		{database.TokenScopeKeysRead, http.StatusOK},
+		{database.TokenScopeServersWrite, http.StatusOK},
+		{database.TokenScopeKeysWrite, http.StatusForbidden},
+		{database.TokenScopeServersRead, http.StatusForbidden},
+		{database.TokenScopeSettings, http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		// The role of the route does not matter to the tokens.
+		status, next := authorized(Authorize(d, database.AdminRoleReadOnly, c.scope), plain)
+		if status != c.status {
+			t.Errorf("scope %q: status %d, want %d", c.scope, status, c.status)
+		}
+		if next == nil {
+			continue
+		}
+		if found, _ := next.Get("token").(*database.Token); found == nil || found.Id != token.Id {
+			t.Errorf("scope %q: token %+v in the context", c.scope, found)
+		}
+		if admin, _ := next.Get("admin").(*database.Admin); admin != nil {
+			t.Errorf("scope %q: admin %+v in the context", c.scope, admin)
+		}
+	}
+
+	// The expired tokens no longer work.
+	if _, err = d.TokenTable.Modify(token.Id, func(t *database.Token) {
+		t.ExpiresAt = time.Now().Add(-time.Minute).UnixMilli()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := authorized(Authorize(d, database.AdminRoleReadOnly, database.TokenScopeKeysRead), plain); status != http.StatusUnauthorized {
+		t.Errorf("expired token: status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestAuthorizeNode(t *testing.T) {
+	d := newTestDatabase(t)
+	apiToken := d.SettingTable.Get().ApiToken
+	_, token := signIn(t, d, "operator", database.AdminRoleOperator)
+
+	// The nodes are allowed regardless of the role and scope of the route, with no admin or token in the context.
+	status, next := authorized(AuthorizeNode(d, database.AdminRoleOwner, ""), apiToken)
+	if status != http.StatusOK {
+		t.Fatalf("node: status %d, want %d", status, http.StatusOK)
+	}
+	for _, key := range []string{"admin", "session", "token"} {
+		if value := next.Get(key); value == nil || !reflect.ValueOf(value).IsNil() {
+			t.Errorf("node: %s = %v in the context, want a typed nil", key, value)
+		}
+	}
+
+	cases := []struct {
+		name       string
+		middleware echo.MiddlewareFunc
+		token      string
+		status     int
+	}{
+		{"api token on other routes", Authorize(d, database.AdminRoleReadOnly, database.TokenScopeSettings), apiToken, http.StatusUnauthorized},
+		{"wrong api token", AuthorizeNode(d, database.AdminRoleReadOnly, database.TokenScopeSettings), apiToken + "x", http.StatusUnauthorized},
+		{"no token", AuthorizeNode(d, database.AdminRoleReadOnly, database.TokenScopeSettings), "", http.StatusUnauthorized},
+		{"admin with the role", AuthorizeNode(d, database.AdminRoleOperator, database.TokenScopeSettings), token, http.StatusOK},
+		{"admin without the role", AuthorizeNode(d, database.AdminRoleOwner, database.TokenScopeSettings), token, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if status, _ := authorized(c.middleware, c.token); status != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, status, c.status)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/miladrahimi/shadowsocks/internal/config"
+	"golang.org/x/time/rate"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	RejectionRateLimit = "rate_limit"
+	RejectionLockout   = "lockout"
+)
+
+// rejection is a route and the reason its requests are rejected for.
+type rejection struct {
+	route  string
+	reason string
+}
+
+// Rejections counts the requests rejected by the rate limiter and the sign-in lockout.
+type Rejections struct {
+	counts map[rejection]int64
+	mutex  sync.Mutex
+}
+
+func NewRejections() *Rejections {
+	return &Rejections{counts: map[rejection]int64{}}
+}
+
+func (r *Rejections) add(route, reason string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.counts[rejection{route: route, reason: reason}]++
+}
+
+// WriteMetrics writes the counts in the Prometheus text format.
+func (r *Rejections) WriteMetrics(w io.Writer) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	keys := make([]rejection, 0, len(r.counts))
+	for k := range r.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].route+keys[i].reason < keys[j].route+keys[j].reason
+	})
+
+	lines := "# HELP shadowsocks_http_rejected_requests_total Requests rejected by the rate limiter or sign-in lockout.\n" +
+		"# TYPE shadowsocks_http_rejected_requests_total counter\n"
+	for _, k := range keys {
+		lines += fmt.Sprintf(
+			"shadowsocks_http_rejected_requests_total{route=%q,reason=%q} %d\n", k.route, k.reason, r.counts[k],
+		)
+	}
+	_, err := io.WriteString(w, lines)
+	return err
+}
+
+// RateLimit limits the requests of each client IP to the configured rate.
+func RateLimit(c *config.Config, rejections *Rejections) echo.MiddlewareFunc {
+	if c.RateLimit.Rate <= 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}
+	}
+
+	store := middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+		Rate:      rate.Limit(c.RateLimit.Rate),
+		Burst:     c.RateLimit.Burst,
+		ExpiresIn: 3 * time.Minute,
+	})
+
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store: store,
+		DenyHandler: func(context echo.Context, _ string, _ error) error {
+			rejections.add(context.Path(), RejectionRateLimit)
+			return context.JSON(http.StatusTooManyRequests, map[string]string{
+				"message": "Too many requests.",
+			})
+		},
+	})
+}
+
+// signInFailures is the record of the failed sign-ins of a client IP.
+type signInFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// SignInLockout locks the client IPs out of signing in after the configured number of failed sign-ins
+// (the unauthorized responses); each further failure doubles the lockout, up to the configured maximum.
+// A successful sign-in clears the failures, and so does a quiet period as long as the longest lockout.
+func SignInLockout(c *config.Config, rejections *Rejections) echo.MiddlewareFunc {
+	if c.RateLimit.SignInFailures <= 0 {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}
+	}
+
+	first := time.Duration(c.RateLimit.SignInLockout) * time.Second
+	longest := time.Duration(c.RateLimit.SignInMaxLockout) * time.Second
+	if longest < first {
+		longest = first
+	}
+
+	var mutex sync.Mutex
+	failures := map[string]*signInFailures{}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(context echo.Context) error {
+			ip := context.RealIP()
+			now := time.Now()
+
+			mutex.Lock()
+			for k, f := range failures {
+				if now.Sub(f.lastFailure) > longest && now.After(f.lockedUntil) {
+					delete(failures, k)
+				}
+			}
+			if f, found := failures[ip]; found && now.Before(f.lockedUntil) {
+				retry := int(math.Ceil(f.lockedUntil.Sub(now).Seconds()))
+				mutex.Unlock()
+				rejections.add(context.Path(), RejectionLockout)
+				context.Response().Header().Set("Retry-After", strconv.Itoa(retry))
+				return context.JSON(http.StatusTooManyRequests, map[string]string{
+					"message": fmt.Sprintf("Too many failed sign-ins; try again in %d seconds.", retry),
+				})
+			}
+			mutex.Unlock()
+
+			err := next(context)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch context.Response().Status {
+			case http.StatusOK:
+				delete(failures, ip)
+			case http.StatusUnauthorized:
+				f, found := failures[ip]
+				if !found {
+					f = &signInFailures{}
+					failures[ip] = f
+				}
+				f.count++
+				f.lastFailure = time.Now()
+				if extra := f.count - c.RateLimit.SignInFailures; extra >= 0 {
+					lockout := first
+					for i := 0; i < extra && lockout < longest; i++ {
+						lockout *= 2
+					}
+					if lockout > longest {
+						lockout = longest
+					}
+					f.lockedUntil = f.lastFailure.Add(lockout)
+				}
+			}
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/miladrahimi/shadowsocks/internal/config"
+)
+
+// newTestServer serves the route with the given responses (by the "status" query) behind the middleware.
+func newTestServer(path string, mw echo.MiddlewareFunc) *echo.Echo {
+	e := echo.New()
+	e.GET(path, func(c echo.Context) error {
+		if c.QueryParam("status") == "ok" {
+			return c.NoContent(http.StatusOK)
+		}
+		return c.NoContent(http.StatusUnauthorized)
+	}, mw)
+	return e
+}
+
+// request sends a request from the client IP and returns the response.
+func request(e *echo.Echo, target, ip string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.RemoteAddr = ip + ":1234"
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, r)
+	return recorder
+}
+
+func TestSignInLockout(t *testing.T) {
+	c := &config.Config{}
+	c.RateLimit.SignInFailures = 2
+	c.RateLimit.SignInLockout = 1
+	c.RateLimit.SignInMaxLockout = 3
+	rejections := NewRejections()
+	e := newTestServer("/sign-in", SignInLockout(c, rejections))
+
+	// A successful sign-in clears the failures; reaching the threshold locks the client out
+	// (even with the right credentials), but not the other clients.
+	steps := []struct {
+		target string
+		ip     string
+		status int
+		retry  string
+	}{
+		{"/sign-in", "192.0.2.1", http.StatusUnauthorized, ""},
+		{"/sign-in?status=ok", "192.0.2.1", http.StatusOK, ""},
+		{"/sign-in", "192.0.2.1", http.StatusUnauthorized, ""},
+		{"/sign-in", "192.0.2.1", http.StatusUnauthorized, ""},
+		{"/sign-in", "192.0.2.1", http.StatusTooManyRequests, "1"},
+		{"/sign-in?status=ok", "192.0.2.1", http.StatusTooManyRequests, "1"},
+		{"/sign-in", "192.0.2.2", http.StatusUnauthorized, ""},
+	}
+	for i, s := range steps {
+		response := request(e, s.target, s.ip)
+		if response.Code != s.status || response.Header().Get("Retry-After") != s.retry {
+			t.Fatalf("step %d: status %d (retry after %q), want %d (retry after %q)",
+				i, response.Code, response.Header().Get("Retry-After"), s.status, s.retry)
+		}
+	}
+
+	// Each failure after the lockout doubles it, up to the maximum.
+	lockouts := []struct {
+		wait  time.Duration
+		retry string
+	}{
+		{time.Second, "2"},
+		{2 * time.Second, "3"},
+	}
+	for _, l := range lockouts {
+		time.Sleep(l.wait + 100*time.Millisecond)
+		if response := request(e, "/sign-in", "192.0.2.1"); response.Code != http.StatusUnauthorized {
+			t.Fatalf("status %d after the lockout, want %d", response.Code, http.StatusUnauthorized)
+		}
+		response := request(e, "/sign-in", "192.0.2.1")
+		if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") != l.retry {
+			t.Errorf("status %d (retry after %q), want %d (retry after %q)",
+				response.Code, response.Header().Get("Retry-After"), http.StatusTooManyRequests, l.retry)
+		}
+	}
+
+	var metrics bytes.Buffer
+	if err := rejections.WriteMetrics(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{route="/sign-in",reason="lockout"} 4`; !strings.Contains(metrics.String(), want) {
+		t.Errorf("metrics = %s, want %s", metrics.String(), want)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c := &config.Config{}
+	c.RateLimit.Rate = 0.01
+	c.RateLimit.Burst = 3
+	rejections := NewRejections()
+	e := newTestServer("/health", RateLimit(c, rejections))
+
+	for i := 0; i < c.RateLimit.Burst; i++ {
+		if response := request(e, "/health?status=ok", "192.0.2.1"); response.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want %d", i, response.Code, http.StatusOK)
+		}
+	}
+	if response := request(e, "/health?status=ok", "192.0.2.1"); response.Code != http.StatusTooManyRequests {
+		t.Errorf("status %d beyond the burst, want %d", response.Code, http.StatusTooManyRequests)
+	}
+	// The other clients have their own limits.
+	if response := request(e, "/health?status=ok", "192.0.2.2"); response.Code != http.StatusOK {
+		t.Errorf("status %d for another client, want %d", response.Code, http.StatusOK)
+	}
+
+	var metrics bytes.Buffer
+	if err := rejections.WriteMetrics(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{route="/health",reason="rate_limit"} 1`; !strings.Contains(metrics.String(), want) {
+		t.Errorf("metrics = %s, want %s", metrics.String(), want)
+	}
+
+	// A zero rate disables the limiter.
+	e = newTestServer("/health", RateLimit(&config.Config{}, rejections))
+	for i := 0; i < 10; i++ {
+		if response := request(e, "/health?status=ok", "192.0.2.1"); response.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d without a rate, want %d", i, response.Code, http.StatusOK)
+		}
+	}
+}
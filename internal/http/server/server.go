@@ -7,11 +7,13 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/miladrahimi/shadowsocks/internal/config"
 	"github.com/miladrahimi/shadowsocks/internal/coordinator"
+	"github.com/miladrahimi/shadowsocks/internal/database"
 	"github.com/miladrahimi/shadowsocks/internal/http/handlers"
 	"github.com/miladrahimi/shadowsocks/internal/http/handlers/v1"
 	internalMw "github.com/miladrahimi/shadowsocks/internal/http/middleware"
 	"github.com/miladrahimi/shadowsocks/internal/http/validator"
 	"go.uber.org/zap"
+	"net"
 	"net/http"
 	"time"
 )
@@ -32,37 +34,94 @@ func New(config *config.Config, logger *zap.Logger, coordinator *coordinator.Coo
 }
 
 func (s *Server) Run() {
+	// The rate limiter, the sign-in lockout, the sessions, and the audit log rely on the client IPs,
+	// so the forwarded headers are only trusted from the configured proxies.
+	extractor, err := ipExtractor(s.config.HttpServer.TrustedProxies)
+	if err != nil {
+		s.logger.Fatal("cannot parse the trusted proxies", zap.Error(err))
+	}
+	s.Engine.IPExtractor = extractor
+
 	s.Engine.Use(middleware.CORS())
 	s.Engine.Use(internalMw.Logger(s.logger))
 
 	s.Engine.Static("/", "web")
 
-	s.Engine.GET("/metrics", handlers.Metrics(s.coordinator))
-	s.Engine.GET("/ssconf/*", handlers.SSConf(s.coordinator))
-	s.Engine.GET("/subscription/*", handlers.Subscription(s.coordinator))
-	s.Engine.GET("/public", handlers.Public(s.coordinator))
-	s.Engine.GET("/profile", handlers.Profile(s.coordinator))
+	// The public endpoints take guessable codes and secrets, so they share a rate limiter with the sign-in.
+	rejections := internalMw.NewRejections()
+	limit := internalMw.RateLimit(s.config, rejections)
+	lockout := internalMw.SignInLockout(s.config, rejections)
+
+	s.Engine.GET("/metrics", handlers.Metrics(s.coordinator, rejections))
+	s.Engine.GET("/ssconf/*", handlers.SSConf(s.coordinator), limit)
+	s.Engine.GET("/subscription/*", handlers.Subscription(s.coordinator), limit)
+	s.Engine.GET("/public", handlers.Public(s.coordinator), limit)
+	s.Engine.GET("/profile", handlers.Profile(s.coordinator), limit)
 
 	g1 := s.Engine.Group("/v1")
-	g1.POST("/sign-in", v1.SignIn(s.coordinator))
-	g1.GET("/profile", v1.ProfileShow(s.coordinator))
-	g1.POST("/profile/reset", v1.ProfileReset(s.coordinator))
+	g1.POST("/sign-in", v1.SignIn(s.coordinator), limit, lockout)
+	g1.POST("/sign-in/refresh", v1.SignInRefresh(s.coordinator), limit, lockout)
+	g1.GET("/profile", v1.ProfileShow(s.coordinator), limit)
+	g1.POST("/profile/reset", v1.ProfileReset(s.coordinator), limit)
 
-	g2 := s.Engine.Group("/v1")
-	g2.Use(internalMw.Authorize(s.coordinator.Database))
 	s.Engine.GET("/health", v1.Health())
-	g2.GET("/settings", v1.SettingsShow(s.config, s.coordinator))
-	g2.POST("/settings", v1.SettingsUpdate(s.coordinator))
-	g2.GET("/servers", v1.ServersIndex(s.coordinator))
-	g2.POST("/servers", v1.ServersStore(s.coordinator))
-	g2.PUT("/servers", v1.ServersUpdate(s.coordinator))
-	g2.DELETE("/servers/:id", v1.ServersDelete(s.coordinator))
-	g2.GET("/keys", v1.KeysIndex(s.coordinator))
-	g2.POST("/keys", v1.KeysStore(s.coordinator))
-	g2.PUT("/keys", v1.KeysUpdate(s.coordinator))
-	g2.DELETE("/keys/:id", v1.KeysDelete(s.coordinator))
-	g2.PATCH("/keys/:id/empty", v1.KeysEmpty(s.coordinator))
-	g2.POST("/keys/fill", v1.KeysFill(s.coordinator))
+
+	// Each route requires an admin role and, to be used by the named API tokens, a scope.
+	authorize := func(role, scope string) echo.MiddlewareFunc {
+		return internalMw.Authorize(s.coordinator.Database, role, scope)
+	}
+	// The routes called by the master (reading the settings and filling the keys) also accept the API token
+	// of the settings; it must never grant changing the settings.
+	authorizeNode := func(role, scope string) echo.MiddlewareFunc {
+		return internalMw.AuthorizeNode(s.coordinator.Database, role, scope)
+	}
+	readOnly, operator, owner := database.AdminRoleReadOnly, database.AdminRoleOperator, database.AdminRoleOwner
+
+	g2 := s.Engine.Group("/v1")
+	g2.POST("/sign-out", v1.SignOut(s.coordinator), authorize(readOnly, ""))
+	g2.GET("/sessions", v1.SessionsIndex(s.coordinator), authorize(readOnly, ""))
+	g2.DELETE("/sessions/:id", v1.SessionsDelete(s.coordinator), authorize(readOnly, ""))
+	g2.GET("/account", v1.AccountShow(s.coordinator), authorize(readOnly, ""))
+	g2.POST("/account/totp", v1.AccountTotpSetup(s.coordinator), authorize(readOnly, ""))
+	g2.POST("/account/totp/enable", v1.AccountTotpEnable(s.coordinator), authorize(readOnly, ""))
+	g2.POST("/account/totp/disable", v1.AccountTotpDisable(s.coordinator), authorize(readOnly, ""))
+	g2.POST("/account/recovery-codes", v1.AccountRecoveryCodes(s.coordinator), authorize(readOnly, ""))
+	g2.GET("/settings", v1.SettingsShow(s.config, s.coordinator), authorizeNode(owner, database.TokenScopeSettings))
+	g2.POST("/settings", v1.SettingsUpdate(s.coordinator), authorize(owner, database.TokenScopeSettings))
+	g2.GET("/admins", v1.AdminsIndex(s.coordinator), authorize(owner, ""))
+	g2.POST("/admins", v1.AdminsStore(s.coordinator), authorize(owner, ""))
+	g2.PUT("/admins", v1.AdminsUpdate(s.coordinator), authorize(owner, ""))
+	g2.DELETE("/admins/:id", v1.AdminsDelete(s.coordinator), authorize(owner, ""))
+	g2.DELETE("/admins/:id/totp", v1.AdminsTotpDelete(s.coordinator), authorize(owner, ""))
+	g2.GET("/tokens", v1.TokensIndex(s.coordinator), authorize(owner, ""))
+	g2.POST("/tokens", v1.TokensStore(s.coordinator), authorize(owner, ""))
+	g2.PUT("/tokens", v1.TokensUpdate(s.coordinator), authorize(owner, ""))
+	g2.DELETE("/tokens/:id", v1.TokensDelete(s.coordinator), authorize(owner, ""))
+	g2.GET("/audit", v1.AuditIndex(s.coordinator), authorize(owner, database.TokenScopeAuditRead))
+	g2.GET("/backup", v1.BackupShow(s.coordinator), authorize(owner, ""))
+	g2.POST("/backup/restore", v1.BackupRestore(s.coordinator), authorize(owner, ""))
+	g2.GET("/backup/snapshots", v1.SnapshotsIndex(s.coordinator), authorize(owner, ""))
+	g2.GET("/backup/snapshots/:id", v1.SnapshotsShow(s.coordinator), authorize(owner, ""))
+	g2.POST("/backup/snapshots/:id/restore", v1.SnapshotsRestore(s.coordinator), authorize(owner, ""))
+	g2.GET("/servers", v1.ServersIndex(s.coordinator), authorize(readOnly, database.TokenScopeServersRead))
+	g2.POST("/servers", v1.ServersStore(s.coordinator), authorize(operator, database.TokenScopeServersWrite))
+	g2.PUT("/servers", v1.ServersUpdate(s.coordinator), authorize(operator, database.TokenScopeServersWrite))
+	g2.DELETE("/servers/:id", v1.ServersDelete(s.coordinator), authorize(operator, database.TokenScopeServersWrite))
+	g2.GET("/servers/:id/usage", v1.UsageShow(s.coordinator), authorize(readOnly, database.TokenScopeServersRead))
+	g2.GET("/keys", v1.KeysIndex(s.coordinator), authorize(readOnly, database.TokenScopeKeysRead))
+	g2.POST("/keys", v1.KeysStore(s.coordinator), authorize(operator, database.TokenScopeKeysWrite))
+	g2.PUT("/keys", v1.KeysUpdate(s.coordinator), authorize(operator, database.TokenScopeKeysWrite))
+	g2.DELETE("/keys/:id", v1.KeysDelete(s.coordinator), authorize(operator, database.TokenScopeKeysWrite))
+	g2.PATCH("/keys/:id/empty", v1.KeysEmpty(s.coordinator), authorize(operator, database.TokenScopeKeysWrite))
+	g2.GET("/keys/:id/usage", v1.UsageShow(s.coordinator), authorize(readOnly, database.TokenScopeKeysRead))
+	g2.POST("/keys/fill", v1.KeysFill(s.coordinator), authorizeNode(operator, database.TokenScopeKeysWrite))
+	g2.POST("/keys/bulk", v1.KeysBulk(s.coordinator), authorize(operator, database.TokenScopeKeysWrite))
+	g2.GET("/trash/keys", v1.TrashKeysIndex(s.coordinator), authorize(readOnly, database.TokenScopeKeysRead))
+	g2.POST("/trash/keys/:id/restore", v1.TrashKeysRestore(s.coordinator), authorize(operator, database.TokenScopeKeysWrite))
+	g2.DELETE("/trash/keys/:id", v1.TrashKeysPurge(s.coordinator), authorize(operator, database.TokenScopeKeysWrite))
+	g2.GET("/trash/servers", v1.TrashServersIndex(s.coordinator), authorize(readOnly, database.TokenScopeServersRead))
+	g2.POST("/trash/servers/:id/restore", v1.TrashServersRestore(s.coordinator), authorize(operator, database.TokenScopeServersWrite))
+	g2.DELETE("/trash/servers/:id", v1.TrashServersPurge(s.coordinator), authorize(operator, database.TokenScopeServersWrite))
 
 	address := fmt.Sprintf("%s:%d", s.config.HttpServer.Host, s.config.HttpServer.Port)
 	if err := s.Engine.Start(address); err != nil && err != http.ErrServerClosed {
@@ -70,6 +129,23 @@ func (s *Server) Run() {
 	}
 }
 
+// ipExtractor returns the extractor of the client IPs; the connection address, unless there are trusted proxies.
+func ipExtractor(proxies []string) (echo.IPExtractor, error) {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range proxies {
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
 func (s *Server) Shutdown() {
 	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -3,12 +3,14 @@ package prometheus
 import (
 	"errors"
 	"fmt"
+	"github.com/miladrahimi/shadowsocks/pkg/utils"
 	"gopkg.in/yaml.v3"
-	"os"
+	"sync"
 )
 
 type config struct {
 	path    string
+	mutex   sync.Mutex
 	content struct {
 		Global struct {
 			ScrapeInterval string `yaml:"scrape_interval"`
@@ -35,6 +37,9 @@ type label struct {
 }
 
 func (c *config) update(servers map[string]string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	c.content.ScrapeConfigs[0].StaticConfigs = []*staticConfig{}
 	for id, s := range servers {
 		c.content.ScrapeConfigs[0].StaticConfigs = append(c.content.ScrapeConfigs[0].StaticConfigs, &staticConfig{
@@ -46,7 +51,7 @@ func (c *config) update(servers map[string]string) error {
 	if err != nil {
 		return err
 	}
-	if err = os.WriteFile(c.path, content, 0755); err != nil {
+	if err = utils.SafeWriteFile(c.path, content, 0644); err != nil {
 		return errors.New(fmt.Sprintf("cannot save %s, err: %v", c.path, err))
 	}
 	return nil
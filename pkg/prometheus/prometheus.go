@@ -7,6 +7,10 @@ import (
 	"go.uber.org/zap"
 	"io"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
 )
 
 type Prometheus struct {
@@ -17,15 +21,62 @@ type Prometheus struct {
 	port   int
 }
 
-func (p *Prometheus) Metrics() (*Stats, error) {
-	query := `sum(increase(shadowsocks_data_bytes{dir=~"c<p|c>p"}[30d]))%20by%20(access_key,proto,dir,service)`
-	url := fmt.Sprintf("http://%s:%d/api/v1/query?query=%s", p.host, p.port, query)
-	response, err := p.http.Get(url)
+// Window is a period to fetch the traffic of the given keys (or all the keys, if none is given) in.
+type Window struct {
+	Start time.Time
+	End   time.Time
+	Keys  []string
+}
+
+// MetricsBetween returns the traffic of all the keys between the given times,
+// grouped by key, protocol, direction, and service.
+func (p *Prometheus) MetricsBetween(start, end time.Time) (*Stats, error) {
+	return p.query(increase(Window{Start: start, End: end}))
+}
+
+// MetricsIn returns the traffic of the keys of all the given windows in a single query,
+// grouped by key, protocol, direction, and service.
+// The windows must not share keys, otherwise only the traffic in the first one is returned.
+func (p *Prometheus) MetricsIn(windows []Window) (*Stats, error) {
+	queries := make([]string, 0, len(windows))
+	for _, w := range windows {
+		queries = append(queries, increase(w))
+	}
+	return p.query(strings.Join(queries, " or "))
+}
+
+// increase returns the query of the traffic in the window.
+func increase(w Window) string {
+	selector := `dir=~"c<p|c>p"`
+	if len(w.Keys) > 0 {
+		quoted := make([]string, 0, len(w.Keys))
+		for _, k := range w.Keys {
+			quoted = append(quoted, regexp.QuoteMeta(k))
+		}
+		selector += fmt.Sprintf(`,access_key=~"%s"`, strings.Join(quoted, "|"))
+	}
+	var offset string
+	if o := int64(time.Since(w.End).Seconds()); o > 0 {
+		offset = fmt.Sprintf(" offset %ds", o)
+	}
+	return fmt.Sprintf(
+		`sum(increase(shadowsocks_data_bytes{%s}[%ds]%s)) by (access_key,proto,dir,service)`,
+		selector, int64(w.End.Sub(w.Start).Seconds()), offset,
+	)
+}
+
+// query runs the given instant query.
+func (p *Prometheus) query(query string) (*Stats, error) {
+	u := fmt.Sprintf("http://%s:%d/api/v1/query", p.host, p.port)
+	response, err := p.http.PostForm(u, url.Values{"query": {query}})
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
 	if response.StatusCode != http.StatusOK {
-		return nil, errors.New(fmt.Sprintf("unknown healthz status %s", response.Status))
+		return nil, errors.New(fmt.Sprintf("unknown query status %s", response.Status))
 	}
 
 	body, err := io.ReadAll(response.Body)
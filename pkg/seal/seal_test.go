@@ -0,0 +1,62 @@
+package seal
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, KeySize)
+	other := bytes.Repeat([]byte{2}, KeySize)
+	plaintext := []byte(`"a secret"`)
+
+	sealed, err := Seal(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Fatal("the sealed content holds the plaintext")
+	}
+	if again, _ := Seal(key, plaintext); bytes.Equal(again, sealed) {
+		t.Error("sealing twice gave the same content; the nonces must be random")
+	}
+
+	opened, err := Open(key, sealed)
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("opened %q (err: %v), want %q", opened, err, plaintext)
+	}
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	for _, c := range []struct {
+		name   string
+		key    []byte
+		sealed []byte
+	}{
+		{"wrong key", other, sealed},
+		{"tampered", key, tampered},
+		{"truncated", key, sealed[:4]},
+	} {
+		if opened, err = Open(c.key, c.sealed); !errors.Is(err, ErrOpen) || opened != nil {
+			t.Errorf("%s: opened %q (err: %v), want %v", c.name, opened, err, ErrOpen)
+		}
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	salt, err := NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := DeriveKey("passphrase", salt)
+	if err != nil || len(key) != KeySize {
+		t.Fatalf("derived %d bytes (err: %v), want %d", len(key), err, KeySize)
+	}
+	if again, _ := DeriveKey("passphrase", salt); !bytes.Equal(again, key) {
+		t.Error("the same passphrase and salt derived another key")
+	}
+	if other, _ := DeriveKey("other", salt); bytes.Equal(other, key) {
+		t.Error("another passphrase derived the same key")
+	}
+}
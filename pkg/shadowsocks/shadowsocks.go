@@ -3,11 +3,13 @@ package shadowsocks
 import (
 	"errors"
 	"fmt"
+	"github.com/miladrahimi/shadowsocks/pkg/utils"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v3"
 	"os"
 	"os/exec"
 	"runtime"
+	"sync"
 	"syscall"
 )
 
@@ -16,6 +18,7 @@ type Shadowsocks struct {
 	logger      *zap.Logger
 	binaryPaths map[string]string
 	configPath  string
+	mutex       sync.Mutex
 }
 
 func (s *Shadowsocks) binaryPath() string {
@@ -26,30 +29,61 @@ func (s *Shadowsocks) binaryPath() string {
 }
 
 func (s *Shadowsocks) Run(port int) {
-	s.command = exec.Command(
+	command := exec.Command(
 		s.binaryPath(),
 		"-config", s.configPath,
 		"-metrics", fmt.Sprintf("127.0.0.1:%d", port),
 		"--replay_history", "10000",
 	)
-	s.command.Stderr = os.Stderr
-	s.command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	command.Stdout = os.Stdout
 
 	s.logger.Debug("starting the shadowsocks service...")
-	if err := s.command.Run(); err != nil {
+	s.mutex.Lock()
+	err := command.Start()
+	if err == nil {
+		s.command = command
+	}
+	s.mutex.Unlock()
+
+	if err == nil {
+		err = command.Wait()
+	}
+	if err != nil {
 		s.logger.Fatal("cannot start the shadowsocks service", zap.Error(err))
 	}
 }
 
+// process returns the running process or nil if the service has not been started yet.
+func (s *Shadowsocks) process() *os.Process {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.command == nil {
+		return nil
+	}
+	return s.command.Process
+}
+
 func (s *Shadowsocks) Reconfigure() {
+	p := s.process()
+	if p == nil {
+		s.logger.Debug("the shadowsocks service is not running, reconfiguration skipped")
+		return
+	}
+
 	s.logger.Info("reconfiguring the shadowsocks service...")
-	if err := s.command.Process.Signal(syscall.SIGHUP); err != nil {
+	if err := p.Signal(syscall.SIGHUP); err != nil {
 		s.logger.Fatal("cannot reconfigure the shadowsocks service", zap.Error(err))
 	}
 }
 
 func (s *Shadowsocks) Shutdown() {
-	if err := s.command.Process.Kill(); err != nil {
+	p := s.process()
+	if p == nil {
+		return
+	}
+
+	if err := p.Kill(); err != nil {
 		s.logger.Error("cannot shutdown the shadowsocks service", zap.Error(err))
 	} else {
 		s.logger.Info("the shadowsocks service closed successfully")
@@ -57,12 +91,15 @@ func (s *Shadowsocks) Shutdown() {
 }
 
 func (s *Shadowsocks) Update(keys []Key) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	config := map[string][]Key{"keys": keys}
 	content, err := yaml.Marshal(config)
 	if err != nil {
 		return err
 	}
-	if err = os.WriteFile(s.configPath, content, 0755); err != nil {
+	if err = utils.SafeWriteFile(s.configPath, content, 0600); err != nil {
 		return errors.New(fmt.Sprintf("cannot save %s, err: %v", s.configPath, err))
 	}
 	return nil
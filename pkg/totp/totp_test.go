@@ -0,0 +1,67 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 secret of the test vectors of RFC 6238 ("12345678901234567890").
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// The vectors of RFC 6238, truncated to 6 digits.
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range vectors {
+		code, err := Code(rfcSecret, Step(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != want {
+			t.Errorf("code at %d = %s, want %s", unix, code, want)
+		}
+	}
+
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("accepted an invalid secret")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	step := Step(now)
+
+	cases := []struct {
+		offset int64
+		want   int64
+	}{
+		{-2, -1},
+		{-1, step - 1},
+		{0, step},
+		{1, step + 1},
+		{2, -1},
+	}
+	for _, c := range cases {
+		code, err := Code(secret, step+c.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Match(secret, code, now); got != c.want {
+			t.Errorf("code of step %+d matched %d, want %d", c.offset, got, c.want)
+		}
+	}
+
+	if got := Match(secret, "abcdef", now); got != -1 {
+		t.Errorf("a wrong code matched %d", got)
+	}
+}
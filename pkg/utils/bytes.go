@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// byteUnits are the units of Bytes from the largest to the smallest.
+// Decimal units are used for formatting; binary units are only accepted for parsing.
+var byteUnits = []struct {
+	name string
+	size int64
+}{
+	{"TiB", 1 << 40},
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"TB", 1000000000000},
+	{"GB", 1000000000},
+	{"MB", 1000000},
+	{"KB", 1000},
+	{"B", 1},
+}
+
+// Bytes is a size in bytes.
+// It is encoded into JSON as an exact human-readable string (e.g., "50GB"),
+// and decoded from such strings (decimal or binary units) or plain numbers of bytes.
+type Bytes int64
+
+// ParseBytes parses sizes like "50GB", "1.5 GiB", "700MB", or "1024" (bytes).
+func ParseBytes(s string) (Bytes, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	number, size := s, int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(u.name)) {
+			number, size = strings.TrimSpace(s[:len(s)-len(u.name)]), u.size
+			break
+		}
+	}
+
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || f*float64(size) > math.MaxInt64 {
+		return 0, errors.New(fmt.Sprintf("invalid size `%s`", s))
+	}
+	return Bytes(math.Round(f * float64(size))), nil
+}
+
+// String returns the size in the largest decimal unit, rounded to two decimal places (e.g., "1.23GB").
+func (b Bytes) String() string {
+	for _, u := range byteUnits {
+		if strings.Contains(u.name, "i") || int64(b) < u.size {
+			continue
+		}
+		s := strconv.FormatFloat(float64(b)/float64(u.size), 'f', 2, 64)
+		return strings.TrimSuffix(strings.TrimRight(s, "0"), ".") + u.name
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+// exact returns the size in the largest unit that represents it without loss (e.g., "50GB" or "1234B").
+func (b Bytes) exact() string {
+	if b == 0 {
+		return "0"
+	}
+	// Decimal units are preferred; sizes given in binary units (e.g., "1536MiB") keep them.
+	for _, decimal := range []bool{true, false} {
+		for _, u := range byteUnits {
+			if u.size > 1 && strings.Contains(u.name, "i") != decimal && int64(b)%u.size == 0 {
+				return strconv.FormatInt(int64(b)/u.size, 10) + u.name
+			}
+		}
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.exact())
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		if n < 0 {
+			return errors.New(fmt.Sprintf("invalid size %d", n))
+		}
+		*b = Bytes(n)
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New(fmt.Sprintf("invalid size %s", string(data)))
+	}
+	parsed, err := ParseBytes(s)
+	if err != nil {
+		return err
+	}
+	*b = parsed
+	return nil
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+const alphanumeric = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// SecureString generates a cryptographically secure random string of the given length.
+// The charset defaults to alphanumeric characters.
+// It panics if the system random source fails, which leaves no safe way to generate secrets.
+func SecureString(length int, charset ...string) string {
+	chars := alphanumeric
+	if len(charset) > 0 {
+		chars = charset[0]
+	}
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			panic(err)
+		}
+		b[i] = chars[n.Int64()]
+	}
+	return string(b)
+}
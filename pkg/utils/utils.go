@@ -1,8 +1,11 @@
 package utils
 
 import (
+	"errors"
 	"net"
 	"os"
+	"path/filepath"
+	"syscall"
 )
 
 // FreePort finds a free port.
@@ -31,3 +34,82 @@ func DirectoryExist(path string) bool {
 	}
 	return true
 }
+
+// AtomicWriteFile writes the content into a temporary file and renames it to the given path.
+// Readers see either the old or the new content, even if the process crashes midway.
+func AtomicWriteFile(path string, content []byte, perm os.FileMode) (err error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	if _, err = file.Write(content); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Chmod(perm); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDirectory(filepath.Dir(path))
+}
+
+// SafeWriteFile keeps the current content of the path as its last good generation (see BackupPath)
+// and then writes the new content atomically.
+func SafeWriteFile(path string, content []byte, perm os.FileMode) error {
+	if stat, err := os.Stat(path); err == nil {
+		temp := BackupPath(path) + ".tmp"
+		_ = os.Remove(temp)
+		if err = os.Link(path, temp); err == nil {
+			err = os.Rename(temp, BackupPath(path))
+		} else {
+			// The file system may not support hard links, so the generation is copied instead.
+			var current []byte
+			if current, err = os.ReadFile(path); err == nil {
+				err = AtomicWriteFile(BackupPath(path), current, stat.Mode().Perm())
+			}
+		}
+		if err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return AtomicWriteFile(path, content, perm)
+}
+
+// BackupPath returns the path of the last good generation of the given file.
+func BackupPath(path string) string {
+	return path + ".bak"
+}
+
+// syncDirectory flushes the directory entries, so renames in it survive crashes.
+func syncDirectory(path string) error {
+	directory, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = directory.Close()
+	}()
+
+	if err = directory.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
+}
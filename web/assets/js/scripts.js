@@ -1,22 +1,89 @@
-$.ajaxSetup({
-    headers: {
-        'Content-Type': "application/json",
-        'Authorization': `Bearer ${localStorage.getItem("token")}`,
+// The session tokens are refreshed this long (in milliseconds) before they expire.
+const sessionRefreshMargin = 5 * 60 * 1000
+
+function saveSession(response) {
+    localStorage.setItem("token", response["token"])
+    localStorage.setItem("refresh_token", response["refresh_token"])
+    localStorage.setItem("expires_at", response["expires_at"])
+    localStorage.setItem("role", response["role"])
+}
+
+function clearSession() {
+    ["token", "refresh_token", "expires_at", "role"].forEach(function (k) {
+        localStorage.removeItem(k)
+    })
+}
+
+function setupAuthorization() {
+    $.ajaxSetup({
+        headers: {
+            'Content-Type': "application/json",
+            'Authorization': `Bearer ${localStorage.getItem("token")}`,
+        }
+    });
+}
+
+function refreshSession(async) {
+    if (!localStorage.getItem("refresh_token")) {
+        return
+    }
+    $.ajax({
+        type: "POST",
+        url: "/v1/sign-in/refresh",
+        async: async,
+        dataType: "json",
+        headers: {'Content-Type': "application/json"},
+        data: JSON.stringify({"refresh_token": localStorage.getItem("refresh_token")}),
+        success: function (response) {
+            saveSession(response)
+            setupAuthorization()
+            scheduleRefresh()
+        },
+        error: function (response) {
+            if (response.status === 401) {
+                clearSession()
+            }
+        },
+    });
+}
+
+function scheduleRefresh() {
+    let remaining = parseInt(localStorage.getItem("expires_at")) - Date.now()
+    setTimeout(function () {
+        refreshSession(true)
+    }, Math.max(remaining - sessionRefreshMargin, 0))
+}
+
+if (localStorage.getItem("token")) {
+    if (parseInt(localStorage.getItem("expires_at")) - Date.now() < sessionRefreshMargin) {
+        refreshSession(false)
+    } else {
+        scheduleRefresh()
     }
-});
+}
+
+setupAuthorization()
 
 $('#sign-out').click(function () {
-    signOut()
+    $.ajax({
+        type: "POST",
+        url: "/v1/sign-out",
+        complete: function () {
+            signOut()
+        },
+    });
 })
 
 function signOut() {
-    localStorage.removeItem("token")
+    clearSession()
     window.location = "index.html"
 }
 
 function checkAuth(response) {
     if (response.status === 401) {
         signOut()
+    } else if (response.status === 403) {
+        alert("Your role does not have permission to do this.")
     }
 }
 
@@ -26,4 +93,4 @@ function parseBool(s) {
     } else {
         return Boolean(s)
     }
-}
\ No newline at end of file
+}